@@ -7,6 +7,9 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -96,9 +99,97 @@ func main() {
 	defer manifest.SaveJSON(manifestPath)
 
 	rtpServer := rtp.NewServer()
+
+	if ports := os.Getenv("RTP_PORT_RANGE"); ports != "" {
+		portRange, err := rtp.ParsePortRange(ports)
+		if err != nil {
+			log.Fatalf("invalid RTP_PORT_RANGE: %v", err)
+		}
+		rtpServer.PortRange = portRange
+	}
+
 	rtspServer := rtsp.NewRTSPServer(rtpServer, manifest)
+	rtspServer.RecordingDir = mediaDir
+
+	// clients must authenticate as a user of the file, if given
+	if usersFile := os.Getenv("RTSP_USERS_FILE"); usersFile != "" {
+		users, err := rtsp.LoadDigestUsers(usersFile)
+		if err != nil {
+			log.Fatalf("invalid RTSP_USERS_FILE: %v", err)
+		}
+
+		realm := os.Getenv("RTSP_REALM")
+		if realm == "" {
+			realm = "picast"
+		}
+
+		auth := rtsp.NewAuthenticator(realm, users)
+		auth.AllowBasic = os.Getenv("RTSP_ALLOW_BASIC") == "true"
+		rtspServer.Handler = rtsp.NewMiddleware(auth, rtspServer.Handler)
+	}
+
+	// new sessions beyond the budget are redirected to the least loaded peer
+	if maxSessions := os.Getenv("RTSP_MAX_SESSIONS"); maxSessions != "" {
+		n, err := strconv.Atoi(maxSessions)
+		if err != nil {
+			log.Fatalf("invalid RTSP_MAX_SESSIONS: %v", err)
+		}
+		rtspServer.Budget.MaxSessions = n
+	}
+
+	if maxBitrate := os.Getenv("RTSP_MAX_BITRATE"); maxBitrate != "" {
+		bitsPerSecond, err := strconv.ParseFloat(maxBitrate, 64)
+		if err != nil {
+			log.Fatalf("invalid RTSP_MAX_BITRATE: %v", err)
+		}
+		rtspServer.Budget.MaxBitrate = bitsPerSecond
+	}
+
+	if mode := os.Getenv("RTSP_REDIRECT_MODE"); mode != "" {
+		rtspServer.RedirectMode, err = rtsp.ParseRedirectMode(mode)
+		if err != nil {
+			log.Fatalf("invalid RTSP_REDIRECT_MODE: %v", err)
+		}
+	}
+
+	if peers := os.Getenv("HEARTBEAT_PEERS"); peers != "" {
+		rtspServer.Peers = strings.Split(peers, ",")
+	}
+
+	if interval := os.Getenv("HEARTBEAT_INTERVAL"); interval != "" {
+		rtspServer.HeartbeatInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("invalid HEARTBEAT_INTERVAL: %v", err)
+		}
+	}
+
+	rtspServer.AdvertisedURL = os.Getenv("RTSP_ADVERTISED_URL")
+
 	cli := mediaserver.NewCLI(manifest)
 	httpServer := http.NewServer(manifest)
+	httpServer.RTSPServer = rtspServer
+
+	// RTSP over TLS, with a self-signed certificate unless one is given
+	var rtsps *mediaserver.RTSPSConfig
+	if os.Getenv("RTSPS") == "true" {
+		rtsps = &mediaserver.RTSPSConfig{
+			Addr:     os.Getenv("RTSPS_ADDR"),
+			CertFile: os.Getenv("RTSPS_CERT_FILE"),
+			KeyFile:  os.Getenv("RTSPS_KEY_FILE"),
+		}
+
+		if rtsps.Addr == "" {
+			rtsps.Addr = fmt.Sprintf("localhost:%d", rtsp.DefaultRTSPSPort)
+		}
+
+		if rtsps.CertFile == "" {
+			rtsps.CertFile = path.Join(exeDir, "rtsps.crt")
+		}
+
+		if rtsps.KeyFile == "" {
+			rtsps.KeyFile = path.Join(exeDir, "rtsps.key")
+		}
+	}
 
-	mediaserver.RunPicastMediaServer(rtspServer, rtpServer, httpServer, cli)
+	mediaserver.RunPicastMediaServer(rtspServer, rtpServer, httpServer, cli, rtsps, os.Getenv("HEARTBEAT_ADDR"))
 }
@@ -7,12 +7,14 @@ require github.com/pion/sdp v1.3.0
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/oklog/run v1.1.0
+	github.com/pion/rtcp v1.2.16
 	github.com/pion/rtp v1.8.13
 	github.com/urfave/cli/v3 v3.1.1
+	golang.org/x/time v0.11.0
+	gopkg.in/vansante/go-ffprobe.v2 v2.2.1
 )
 
 require (
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	gopkg.in/vansante/go-ffprobe.v2 v2.2.1 // indirect
 )
@@ -30,12 +30,17 @@ type Server struct {
 	http.Server
 	mediaManifest media.Manifest
 	interruptOnce sync.Once
+	tunnels       tunnels
+
+	// serves the RTSP tunneled through HTTP, if set.
+	RTSPServer RTSPServer
 }
 
 func NewServer(manifest media.Manifest) *Server {
 	return &Server{
 		Server:        http.Server{},
 		mediaManifest: manifest,
+		tunnels:       newTunnels(),
 	}
 
 }
@@ -54,7 +59,7 @@ func (s *Server) handleGetManifest(rw http.ResponseWriter, r *http.Request) {
 
 	switch len(segments) {
 	case 1: // "/manifest" → return entire manifest
-		buf, err = s.mediaManifest.JSON()
+		buf, err = s.mediaManifest.PublicJSON()
 		if err != nil {
 			http.Error(rw, "Failed to encode manifest", http.StatusInternalServerError)
 			return
@@ -68,7 +73,7 @@ func (s *Server) handleGetManifest(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		buf, err = json.Marshal(metadata)
+		buf, err = json.Marshal(metadata.Public())
 		if err != nil {
 			http.Error(rw, "Failed to encode media entry", http.StatusInternalServerError)
 			return
@@ -91,6 +96,10 @@ func (s *Server) ListenAndServe(addr string) error {
 	http.HandleFunc("GET /manifest/{id}", s.handleGetManifest)
 	http.HandleFunc("GET /manifest/{id}/", s.handleGetManifest)
 
+	// RTSP tunnels, which may be opened at the URL of any media
+	http.HandleFunc("GET /", s.handleTunnelGet)
+	http.HandleFunc("POST /", s.handleTunnelPost)
+
 	s.Addr = addr
 
 	return s.Server.ListenAndServe()
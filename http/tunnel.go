@@ -0,0 +1,286 @@
+package http
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RTSP tunneled through HTTP, as QuickTime does. A client opens the tunnel
+// with a GET, the response to which carries everything the RTSP server sends,
+// and then sends its RTSP requests base64 encoded in the body of a POST. The
+// two requests are paired by the x-sessioncookie header.
+
+const (
+	tunnelContentType   = "application/x-rtsp-tunnelled"
+	headerSessionCookie = "x-sessioncookie"
+)
+
+// RTSPServer serves RTSP on the connections tunneled through HTTP.
+type RTSPServer interface {
+	// serves the connection until it is closed
+	ServeConn(c net.Conn)
+}
+
+type tunnels struct {
+	sync.Mutex
+	byCookie map[string]*tunnelConn
+}
+
+func newTunnels() tunnels {
+	return tunnels{byCookie: make(map[string]*tunnelConn)}
+}
+
+func (t *tunnels) add(cookie string, c *tunnelConn) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.byCookie[cookie]; ok {
+		return false
+	}
+
+	t.byCookie[cookie] = c
+	return true
+}
+
+func (t *tunnels) get(cookie string) (*tunnelConn, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	c, ok := t.byCookie[cookie]
+	return c, ok
+}
+
+func (t *tunnels) delete(cookie string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.byCookie, cookie)
+}
+
+// a virtual RTSP connection, which reads the requests decoded from the POSTs of
+// a tunnel and writes to the response of its GET
+type tunnelConn struct {
+	net.Conn // the hijacked connection of the GET
+
+	// the IP of the client that opened the tunnel, the only one that may POST
+	// to it, as the cookie alone could be guessed or overheard
+	clientIP string
+
+	// the decoded requests are written into one end of the pipe and read from
+	// the other, which supports the deadlines that the RTSP server sets
+	requests    net.Conn
+	requestSink net.Conn
+
+	postsLock sync.Mutex
+	posts     map[net.Conn]struct{} // hijacked connections of the POSTs
+	closeOnce sync.Once
+}
+
+func newTunnelConn(get net.Conn, clientIP string) *tunnelConn {
+	requests, requestSink := net.Pipe()
+
+	return &tunnelConn{
+		Conn:        get,
+		clientIP:    clientIP,
+		requests:    requests,
+		requestSink: requestSink,
+		posts:       make(map[net.Conn]struct{}),
+	}
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	return c.requests.Read(b)
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.requests.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	return c.requests.SetReadDeadline(t)
+}
+
+// closes the GET and every POST of the tunnel
+func (c *tunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.requests.Close()
+		c.requestSink.Close()
+
+		c.postsLock.Lock()
+		for post := range c.posts {
+			post.Close()
+		}
+		c.postsLock.Unlock()
+	})
+
+	return c.Conn.Close()
+}
+
+// decodes the requests of a POST into the tunnel until either is closed
+func (c *tunnelConn) receive(post net.Conn, body *bufio.Reader) error {
+	c.postsLock.Lock()
+	c.posts[post] = struct{}{}
+	c.postsLock.Unlock()
+
+	defer func() {
+		c.postsLock.Lock()
+		delete(c.posts, post)
+		c.postsLock.Unlock()
+	}()
+
+	_, err := io.Copy(c.requestSink, &base64Reader{r: body})
+	return err
+}
+
+// decodes base64 a quantum of 4 characters at a time, as clients encode each
+// request on its own, with padding between them. Whitespace is skipped.
+type base64Reader struct {
+	r       *bufio.Reader
+	quantum [4]byte
+	n       int
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	if len(p) < 3 {
+		return 0, io.ErrShortBuffer
+	}
+
+	var n int
+	for n+3 <= len(p) {
+		// return what is decoded so far, rather than wait for more
+		if n > 0 && b.r.Buffered() == 0 {
+			return n, nil
+		}
+
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+
+		b.quantum[b.n] = c
+		b.n++
+
+		if b.n < 4 {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.Decode(p[n:], b.quantum[:])
+		if err != nil {
+			return n, err
+		}
+		n += decoded
+		b.n = 0
+	}
+
+	return n, nil
+}
+
+// returns the IP of the client of a request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// opens the server to client channel of a tunnel, and serves RTSP on the
+// tunnel until it is closed
+func (s *Server) handleTunnelGet(rw http.ResponseWriter, r *http.Request) {
+	cookie := r.Header.Get(headerSessionCookie)
+	if cookie == "" || s.RTSPServer == nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	if _, ok := s.tunnels.get(cookie); ok {
+		http.Error(rw, "Tunnel already open", http.StatusBadRequest)
+		return
+	}
+
+	get, buf, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		log.Printf("failed to open RTSP tunnel from: %v: %v", r.RemoteAddr, err)
+		return
+	}
+
+	// the response never ends, so it is written without a length or chunking
+	fmt.Fprintf(buf, "HTTP/1.0 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"Date: %s\r\n"+
+		"Cache-Control: no-store\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Content-Type: %s\r\n\r\n", time.Now().UTC().Format(http.TimeFormat), tunnelContentType)
+
+	if err := buf.Flush(); err != nil {
+		get.Close()
+		return
+	}
+
+	tunnel := newTunnelConn(get, remoteIP(r))
+	if !s.tunnels.add(cookie, tunnel) {
+		tunnel.Close()
+		return
+	}
+	defer s.tunnels.delete(cookie)
+
+	log.Printf("opened RTSP tunnel from: %v", r.RemoteAddr)
+
+	s.RTSPServer.ServeConn(tunnel)
+	tunnel.Close()
+
+	log.Printf("closed RTSP tunnel from: %v", r.RemoteAddr)
+}
+
+// receives the client to server channel of a tunnel. Clients may send each
+// request in a new POST, so the tunnel outlives its POSTs.
+func (s *Server) handleTunnelPost(rw http.ResponseWriter, r *http.Request) {
+	cookie := r.Header.Get(headerSessionCookie)
+	if cookie == "" {
+		http.NotFound(rw, r)
+		return
+	}
+
+	tunnel, ok := s.tunnels.get(cookie)
+	if !ok {
+		http.Error(rw, "No such tunnel", http.StatusNotFound)
+		return
+	}
+
+	if remoteIP(r) != tunnel.clientIP {
+		log.Printf("refused RTSP tunnel POST from: %v, the tunnel was opened from: %v", r.RemoteAddr, tunnel.clientIP)
+		http.Error(rw, "Tunnel opened from another address", http.StatusForbidden)
+		return
+	}
+
+	// the body is read as it arrives, for as long as the client sends it,
+	// beyond any length it declared
+	post, buf, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		log.Printf("failed to receive RTSP tunnel from: %v: %v", r.RemoteAddr, err)
+		return
+	}
+	defer post.Close()
+
+	if err := tunnel.receive(post, buf.Reader); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+		log.Printf("RTSP tunnel from: %v closing: %v", r.RemoteAddr, err)
+		tunnel.Close()
+	}
+}
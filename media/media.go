@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"math/big"
+	"net/url"
 	"os"
 	"sync"
 
@@ -81,7 +82,53 @@ type Metadata struct {
 	Genre        string            `sdp:"genre" json:"genre"`                // Content category
 	Duration     float64           `sdp:"duration" json:"duration"`          // Runtime in seconds
 	ThumbnailURL string            `sdp:"thumbnail-url" json:"thumbnailURL"` // Preview image URL
-	Structure    ffprobe.ProbeData `sdp:"structure" json:"structure"`
+	Path         string            `sdp:"-" json:"path"`                     // Location of the MPEG-TS content
+	Structure    ffprobe.ProbeData `sdp:"-" json:"structure"`                // ffprobe output, described per track
+	Upstream     string            `sdp:"-" json:"upstream,omitempty"`       // rtsp:// URL of a stream that is relayed, instead of content at Path
+}
+
+// IsRelay reports whether the media is the stream of an upstream RTSP server,
+// which is relayed rather than read from a file.
+func (m Metadata) IsRelay() bool {
+	return m.Upstream != ""
+}
+
+// Public returns the metadata as it may be shown to clients, without the
+// credentials of the upstream URL of a relay.
+func (m Metadata) Public() Metadata {
+	if m.Upstream == "" {
+		return m
+	}
+
+	// a URL that can't be parsed can't be shown without its credentials
+	u, err := url.Parse(m.Upstream)
+	if err != nil {
+		m.Upstream = ""
+		return m
+	}
+
+	u.User = nil
+	m.Upstream = u.String()
+
+	return m
+}
+
+// OpenSource opens the content of the media for reading from the start.
+func (m Metadata) OpenSource() (Source, error) {
+	if m.Path == "" {
+		return nil, fmt.Errorf("media %s has no content path", m.UID)
+	}
+
+	return LoadOnDemandFileSource(m.Path)
+}
+
+// LoadSeekIndex loads the keyframe index that ingest stored beside the content.
+func (m Metadata) LoadSeekIndex() (SeekIndex, error) {
+	if m.Path == "" {
+		return SeekIndex{}, fmt.Errorf("media %s has no content path", m.UID)
+	}
+
+	return LoadSeekIndexFromFile(SeekIndexPath(m.Path))
 }
 
 // LoadMetaDataFromJSON decodes JSON media metadata from an io.Reader.
@@ -128,6 +175,7 @@ func (m Metadata) WriteJSONToFile(name string) error {
 type Manifest interface {
 	Get(uid UID) (Metadata, bool)
 	JSON() ([]byte, error)
+	PublicJSON() ([]byte, error) // JSON of the Public metadata, to serve to clients
 	SaveJSON(path string) error
 	ContainsUID(id UID) bool
 }
@@ -162,7 +210,30 @@ type MutableManifest interface {
 //     i.e all reads must finish before any write, and no write can begin while a read is occurring.
 type FileManifest struct {
 	lock     sync.RWMutex
-	metadata map[UID]Metadata `json:"metadata"`
+	metadata map[UID]Metadata
+}
+
+// the JSON document layout of a FileManifest
+type fileManifestJSON struct {
+	Metadata map[UID]Metadata `json:"metadata"`
+}
+
+func (m *FileManifest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileManifestJSON{Metadata: m.metadata})
+}
+
+func (m *FileManifest) UnmarshalJSON(b []byte) error {
+	var doc fileManifestJSON
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	if doc.Metadata == nil {
+		doc.Metadata = make(map[UID]Metadata)
+	}
+
+	m.metadata = doc.Metadata
+	return nil
 }
 
 func NewFileManifest() MutableManifest {
@@ -194,6 +265,20 @@ func (m *FileManifest) JSON() ([]byte, error) {
 	return manifestJSON, nil
 }
 
+// PublicJSON serializes the manifest like JSON, with each metadata made
+// Public.
+func (m *FileManifest) PublicJSON() ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	public := make(map[UID]Metadata, len(m.metadata))
+	for uid, metadata := range m.metadata {
+		public[uid] = metadata.Public()
+	}
+
+	return json.MarshalIndent(fileManifestJSON{Metadata: public}, "", "  ")
+}
+
 func (m *FileManifest) SaveJSON(path string) error {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
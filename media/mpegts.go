@@ -0,0 +1,168 @@
+package media
+
+// Minimal MPEG-TS (ISO/IEC 13818-1) packet inspection, enough to find clock
+// references and random access points without demuxing the elementary streams.
+
+const (
+	TSPacketSize = 188
+	TSSyncByte   = 0x47
+
+	// the PID of the program association table, which lists the PIDs of the
+	// program map tables
+	PATPID = 0x0000
+
+	// the MPEG-TS system clock, in 90kHz units, wraps at 2^33
+	TSClockRate = 90000
+	TSClockWrap = uint64(1) << 33
+)
+
+// TSPacket is a view of one 188 byte transport stream packet.
+type TSPacket []byte
+
+// true iff the packet is a full sized packet starting with the sync byte
+func (p TSPacket) Valid() bool {
+	return len(p) == TSPacketSize && p[0] == TSSyncByte
+}
+
+func (p TSPacket) PID() uint16 {
+	return uint16(p[1]&0x1F)<<8 | uint16(p[2])
+}
+
+// payload_unit_start_indicator, true iff a PES packet or PSI section begins here
+func (p TSPacket) PayloadUnitStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p TSPacket) hasAdaptationField() bool {
+	return p[3]&0x20 != 0 && p[4] > 0
+}
+
+func (p TSPacket) hasPayload() bool {
+	return p[3]&0x10 != 0
+}
+
+// returns the adaptation field without its length byte, or nil
+func (p TSPacket) adaptationField() []byte {
+	if !p.hasAdaptationField() {
+		return nil
+	}
+
+	end := 5 + int(p[4])
+	if end > TSPacketSize {
+		return nil
+	}
+
+	return p[5:end]
+}
+
+// random_access_indicator, set by the muxer on packets that begin a keyframe
+func (p TSPacket) RandomAccess() bool {
+	af := p.adaptationField()
+	return len(af) > 0 && af[0]&0x40 != 0
+}
+
+// discontinuity_indicator, set when the PCR time base jumps
+func (p TSPacket) Discontinuity() bool {
+	af := p.adaptationField()
+	return len(af) > 0 && af[0]&0x80 != 0
+}
+
+// returns the program clock reference base in 90kHz units, if present
+func (p TSPacket) PCR() (uint64, bool) {
+	af := p.adaptationField()
+
+	if len(af) < 7 || af[0]&0x10 == 0 {
+		return 0, false
+	}
+
+	base := uint64(af[1])<<25 | uint64(af[2])<<17 | uint64(af[3])<<9 | uint64(af[4])<<1 | uint64(af[5])>>7
+	return base, true
+}
+
+// returns the payload of the packet, after any adaptation field
+func (p TSPacket) Payload() []byte {
+	if !p.hasPayload() {
+		return nil
+	}
+
+	start := 4
+	if p[3]&0x20 != 0 {
+		start += 1 + int(p[4])
+	}
+
+	if start >= TSPacketSize {
+		return nil
+	}
+
+	return p[start:]
+}
+
+// returns the presentation timestamp in 90kHz units of a PES packet starting in
+// this packet, if present
+func (p TSPacket) PTS() (uint64, bool) {
+	if !p.PayloadUnitStart() {
+		return 0, false
+	}
+
+	pes := p.Payload()
+
+	// packet_start_code_prefix + stream_id + length + flags + header length + PTS
+	if len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return 0, false
+	}
+
+	if pes[7]&0x80 == 0 {
+		return 0, false
+	}
+
+	pts := uint64(pes[9]&0x0E)<<29 |
+		uint64(pes[10])<<22 |
+		uint64(pes[11]&0xFE)<<14 |
+		uint64(pes[12])<<7 |
+		uint64(pes[13])>>1
+
+	return pts, true
+}
+
+// returns the PIDs of the program map tables listed by the program association
+// table that begins in this packet, if it does.
+func (p TSPacket) ProgramMapPIDs() ([]uint16, bool) {
+	if p.PID() != PATPID || !p.PayloadUnitStart() {
+		return nil, false
+	}
+
+	payload := p.Payload()
+	if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return nil, false
+	}
+
+	// skip the pointer field to the start of the section
+	section := payload[1+int(payload[0]):]
+
+	// table_id 0 + section header, up to the first program
+	if len(section) < 8 || section[0] != 0x00 {
+		return nil, false
+	}
+
+	// the section length counts the bytes after it, including a 4 byte CRC
+	end := min(3+(int(section[1]&0x0F)<<8|int(section[2]))-4, len(section))
+
+	var pids []uint16
+	for i := 8; i+4 <= end; i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		pid := uint16(section[i+2]&0x1F)<<8 | uint16(section[i+3])
+
+		// program 0 points at the network information table instead
+		if program != 0 {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, true
+}
+
+// returns the number of 90kHz ticks from `from` to `to`, accounting for the
+// 33 bit wraparound of the system clock.
+func TSClockDiff(from, to uint64) uint64 {
+	return (to + TSClockWrap - from) % TSClockWrap
+}
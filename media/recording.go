@@ -0,0 +1,192 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrRecordingClosed = errors.New("recording closed")
+
+// Recording is MPEG-TS that is muxed into a file from the elementary streams of
+// a live stream, e.g one pushed by an encoder. It can be watched live while it
+// is recorded.
+type Recording struct {
+	Path    string
+	Started time.Time
+
+	lock     sync.Mutex
+	file     *os.File
+	muxer    *TSMuxer
+	size     int64
+	joinAt   int64         // offset of the tables ahead of the latest random access point, where watchers join
+	tablesAt int64         // offset of the latest program tables
+	grown    chan struct{} // closed and replaced whenever the file grows, or is closed
+	closed   bool
+}
+
+// CreateRecording creates (or truncates) the file at `name` to record
+// elementary streams of the given stream types into, see NewTSMuxer.
+func CreateRecording(name string, streamTypes ...byte) (*Recording, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recording{
+		Path:    name,
+		Started: time.Now(),
+		file:    file,
+		grown:   make(chan struct{}),
+	}
+
+	if r.muxer, err = NewTSMuxer(recordingWriter{r}, streamTypes...); err != nil {
+		file.Close()
+		os.Remove(name)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// the muxer writes through the recording, which tracks where watchers may join
+type recordingWriter struct {
+	r *Recording
+}
+
+func (w recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.r.file.Write(p)
+
+	// the muxer writes the tables right before each random access point
+	if pkt := TSPacket(p); n == TSPacketSize {
+		switch {
+		case pkt.PID() == PATPID:
+			w.r.tablesAt = w.r.size
+		case pkt.RandomAccess():
+			w.r.joinAt = w.r.tablesAt
+		}
+	}
+
+	w.r.size += int64(n)
+	return n, err
+}
+
+// PID returns the PID that the elementary stream is recorded in.
+func (r *Recording) PID(stream int) uint16 {
+	return r.muxer.PID(stream)
+}
+
+// Elapsed returns the 90kHz ticks since the recording started, to time the
+// first access unit of a stream by.
+func (r *Recording) Elapsed() uint64 {
+	return uint64(time.Since(r.Started).Seconds() * TSClockRate)
+}
+
+// WriteAccessUnit records an access unit of an elementary stream, see
+// TSMuxer.WriteAccessUnit. It is safe for concurrent use.
+func (r *Recording) WriteAccessUnit(stream int, pts, dts uint64, keyframe bool, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return ErrRecordingClosed
+	}
+
+	if err := r.muxer.WriteAccessUnit(stream, pts, dts, keyframe, data); err != nil {
+		return err
+	}
+
+	close(r.grown)
+	r.grown = make(chan struct{})
+	return nil
+}
+
+// Close ends the recording. Watchers read to the end of it, then io.EOF.
+func (r *Recording) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+	close(r.grown)
+
+	return r.file.Close()
+}
+
+// Watch opens the recording at its latest random access point, to follow it
+// live.
+func (r *Recording) Watch() (LiveSource, error) {
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	joinAt := r.joinAt
+	r.lock.Unlock()
+
+	if _, err := file.Seek(joinAt, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &recordingWatcher{
+		recording: r,
+		file:      file,
+		offset:    joinAt,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// reads a recording as it grows, waiting for more at the end of what has been
+// written until the recording is closed.
+type recordingWatcher struct {
+	recording *Recording
+	file      *os.File
+	offset    int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (w *recordingWatcher) Read(p []byte) (int, error) {
+	for {
+		r := w.recording
+
+		r.lock.Lock()
+		size, closed, grown := r.size, r.closed, r.grown
+		r.lock.Unlock()
+
+		if w.offset < size {
+			n, err := w.file.Read(p[:min(int64(len(p)), size-w.offset)])
+			w.offset += int64(n)
+
+			if errors.Is(err, io.EOF) && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+
+		if closed {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-grown:
+		case <-w.done:
+			return 0, ErrRecordingClosed
+		}
+	}
+}
+
+func (w *recordingWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+
+	return w.file.Close()
+}
@@ -0,0 +1,83 @@
+package media
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordingWatch(t *testing.T) {
+	r, err := CreateRecording(filepath.Join(t.TempDir(), "recording.ts"), StreamTypeH264)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	write := func(pts uint64, keyframe bool) {
+		t.Helper()
+
+		if err := r.WriteAccessUnit(0, pts, pts, keyframe, bytes.Repeat([]byte{1}, 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(0, true)
+	write(3000, false)
+
+	// follows the recording from the start, as it grows
+	early, err := r.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer early.Close()
+
+	followed := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(early)
+		followed <- b
+	}()
+
+	write(6000, true)
+
+	// joins at the latest keyframe
+	late, err := r.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+
+	write(9000, false)
+	r.Close()
+
+	recorded, err := os.ReadFile(r.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := <-followed; !bytes.Equal(b, recorded) {
+		t.Errorf("the watcher from the start read %d bytes of %d", len(b), len(recorded))
+	}
+
+	b, err := io.ReadAll(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) == 0 || !bytes.HasSuffix(recorded, b) || TSPacket(b[:TSPacketSize]).PID() != PATPID {
+		t.Fatalf("the late watcher did not join at the program tables of the latest keyframe")
+	}
+
+	var pts uint64
+	for i := 0; i < len(b); i += TSPacketSize {
+		if p, ok := TSPacket(b[i : i+TSPacketSize]).PTS(); ok {
+			pts = p
+			break
+		}
+	}
+
+	if pts != 6000+muxDelay {
+		t.Errorf("the late watcher began at PTS %d, want the keyframe at %d", pts, 6000+muxDelay)
+	}
+}
@@ -0,0 +1,179 @@
+package media
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/rebeljah/picast/util/fileutil"
+)
+
+// the file extension of the seek index stored beside each MPEG-TS file
+const SeekIndexExt = ".idx"
+
+// MaxPCRStep is the largest PCR jump that is taken as elapsed time, rather than
+// a discontinuity of the time base.
+const MaxPCRStep = 10 * TSClockRate
+
+var ErrNoSeekPoint = errors.New("no seek point")
+
+// SeekPoint is a keyframe (random access point) in an MPEG-TS file.
+type SeekPoint struct {
+	Time   float64 `json:"t"`   // presentation time in seconds from the start of the media
+	Offset int64   `json:"o"`   // byte offset of the TS packet that begins the keyframe
+	PCR    uint64  `json:"pcr"` // the program clock at the keyframe, in 90kHz units
+}
+
+// SeekIndex maps presentation time to the byte offsets of keyframes, so that
+// playback can begin anywhere in a file without decoding it.
+type SeekIndex struct {
+	Points []SeekPoint `json:"points"` // ordered by time
+}
+
+// SeekIndexPath returns the path of the seek index of the media at `mediaPath`.
+func SeekIndexPath(mediaPath string) string {
+	return mediaPath + SeekIndexExt
+}
+
+// BuildSeekIndex scans MPEG-TS from r and records every packet flagged as a
+// random access point. Times are measured on the PCR, starting at zero at the
+// first PCR in the stream, and continue smoothly across PCR discontinuities.
+func BuildSeekIndex(r io.Reader) (SeekIndex, error) {
+	var index SeekIndex
+	var offset int64
+	var elapsed uint64 // 90kHz ticks since the first PCR
+	var lastPCR uint64
+	var hasPCR bool
+
+	reader := bufio.NewReaderSize(r, TSPacketSize*512)
+	buf := make([]byte, TSPacketSize)
+
+	for {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return index, nil
+			}
+			return index, err
+		}
+
+		pkt := TSPacket(buf)
+
+		// skip forward one byte at a time until the stream is in sync again
+		if !pkt.Valid() {
+			skipped, err := resyncReader(reader, buf)
+			if err != nil {
+				return index, nil
+			}
+			offset += skipped
+		}
+
+		if pcr, ok := pkt.PCR(); ok {
+			if hasPCR && !pkt.Discontinuity() {
+				if step := TSClockDiff(lastPCR, pcr); step < MaxPCRStep {
+					elapsed += step
+				}
+			}
+
+			lastPCR, hasPCR = pcr, true
+		}
+
+		if pkt.RandomAccess() && hasPCR {
+			index.Points = append(index.Points, SeekPoint{
+				Time:   float64(elapsed) / TSClockRate,
+				Offset: offset,
+				PCR:    lastPCR,
+			})
+		}
+
+		offset += TSPacketSize
+	}
+}
+
+// shifts buf left one byte at a time, filling from r, until buf holds a valid
+// packet. Returns the number of bytes skipped.
+func resyncReader(r io.ByteReader, buf []byte) (int64, error) {
+	var skipped int64
+
+	for !TSPacket(buf).Valid() {
+		b, err := r.ReadByte()
+		if err != nil {
+			return skipped, err
+		}
+
+		copy(buf, buf[1:])
+		buf[len(buf)-1] = b
+		skipped++
+	}
+
+	return skipped, nil
+}
+
+// Lookup returns the last keyframe at or before time t (in seconds).
+func (idx SeekIndex) Lookup(t float64) (SeekPoint, error) {
+	// first point after t
+	i := sort.Search(len(idx.Points), func(i int) bool {
+		return idx.Points[i].Time > t
+	})
+
+	if i == 0 {
+		if len(idx.Points) == 0 {
+			return SeekPoint{}, ErrNoSeekPoint
+		}
+		return idx.Points[0], nil
+	}
+
+	return idx.Points[i-1], nil
+}
+
+// Duration returns the time of the last keyframe in the index.
+func (idx SeekIndex) Duration() float64 {
+	if len(idx.Points) == 0 {
+		return 0
+	}
+
+	return idx.Points[len(idx.Points)-1].Time
+}
+
+// WriteJSONToFile atomically replaces the file at `name` with the index.
+func (idx SeekIndex) WriteJSONToFile(name string) error {
+	buf, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	return fileutil.ReplaceFileContents(name, buf)
+}
+
+// LoadSeekIndexFromFile reads an index written by WriteJSONToFile.
+func LoadSeekIndexFromFile(name string) (SeekIndex, error) {
+	var index SeekIndex
+
+	file, err := os.Open(name)
+	if err != nil {
+		return index, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&index)
+	return index, err
+}
+
+// BuildSeekIndexFile indexes the MPEG-TS file at `mediaPath` and saves the
+// index beside it.
+func BuildSeekIndexFile(mediaPath string) (SeekIndex, error) {
+	file, err := os.Open(mediaPath)
+	if err != nil {
+		return SeekIndex{}, err
+	}
+	defer file.Close()
+
+	index, err := BuildSeekIndex(file)
+	if err != nil {
+		return index, err
+	}
+
+	return index, index.WriteJSONToFile(SeekIndexPath(mediaPath))
+}
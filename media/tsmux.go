@@ -0,0 +1,342 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A minimal MPEG-TS (ISO/IEC 13818-1) muxer of one program, which carries each
+// access unit of an elementary stream in a PES packet of its own.
+
+// stream types of the elementary streams that can be muxed (ISO/IEC 13818-1
+// table 2-34)
+const (
+	StreamTypeAAC  byte = 0x0F // ADTS framed AAC
+	StreamTypeH264 byte = 0x1B // Annex B framed H.264
+)
+
+const (
+	muxProgramNumber uint16 = 1
+	muxPMTPID        uint16 = 0x1000
+	muxFirstPID      uint16 = 0x100 // of the first elementary stream, the rest follow
+
+	// presentation times are ahead of the PCR by this much, which leaves time
+	// for the decoder to buffer each access unit.
+	muxDelay = TSClockRate / 2
+)
+
+// TSMuxer writes access units of elementary streams into MPEG-TS. The program
+// tables are repeated ahead of every random access point so that playback can
+// begin there.
+type TSMuxer struct {
+	w       io.Writer
+	streams []muxStream
+	pcrPID  uint16
+
+	continuity  map[uint16]byte
+	wroteTables bool
+	lastRandom  uint64 // PTS of the last random access point of audio only muxes
+	pcr         uint64 // the latest DTS of the stream that carries the PCR
+}
+
+type muxStream struct {
+	pid        uint16
+	streamID   byte // of its PES packets
+	streamType byte
+}
+
+func isVideoStreamType(streamType byte) bool {
+	return streamType == StreamTypeH264
+}
+
+// NewTSMuxer returns a muxer of elementary streams of the given stream types,
+// numbered in order from 0. The PCR is carried by the first video stream, or
+// the first stream if there is no video.
+func NewTSMuxer(w io.Writer, streamTypes ...byte) (*TSMuxer, error) {
+	if len(streamTypes) == 0 {
+		return nil, fmt.Errorf("nothing to mux")
+	}
+
+	m := &TSMuxer{
+		w:          w,
+		continuity: make(map[uint16]byte),
+	}
+
+	var videos, audios byte
+	hasVideo := false
+
+	for i, streamType := range streamTypes {
+		stream := muxStream{pid: muxFirstPID + uint16(i), streamType: streamType}
+
+		switch streamType {
+		case StreamTypeH264:
+			stream.streamID = 0xE0 + videos
+			videos++
+		case StreamTypeAAC:
+			stream.streamID = 0xC0 + audios
+			audios++
+		default:
+			return nil, fmt.Errorf("unsupported stream type: %#x", streamType)
+		}
+
+		if isVideoStreamType(streamType) && !hasVideo {
+			m.pcrPID, hasVideo = stream.pid, true
+		}
+
+		m.streams = append(m.streams, stream)
+	}
+
+	if !hasVideo {
+		m.pcrPID = m.streams[0].pid
+	}
+
+	return m, nil
+}
+
+// PID returns the PID of the elementary stream
+func (m *TSMuxer) PID(stream int) uint16 {
+	return m.streams[stream].pid
+}
+
+// WriteAccessUnit writes one access unit of an elementary stream, presented at
+// `pts` and decoded at `dts` (90kHz), which only differ for video with B-frames.
+// The PCR follows the decoding times, which unlike presentation times never go
+// back. A keyframe of the stream that carries the PCR becomes a random access
+// point, ahead of which the program tables are written. Audio only muxes mark
+// an access unit random access about once a second.
+func (m *TSMuxer) WriteAccessUnit(stream int, pts, dts uint64, keyframe bool, data []byte) error {
+	if stream < 0 || stream >= len(m.streams) {
+		return fmt.Errorf("no such stream: %d", stream)
+	}
+
+	s := m.streams[stream]
+	carriesPCR := s.pid == m.pcrPID
+
+	randomAccess := carriesPCR && keyframe
+	if randomAccess && !isVideoStreamType(s.streamType) {
+		randomAccess = !m.wroteTables || TSClockDiff(m.lastRandom, pts) >= TSClockRate
+	}
+
+	if randomAccess || !m.wroteTables {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	if randomAccess {
+		m.lastRandom = pts
+	}
+
+	if carriesPCR {
+		m.pcr = max(m.pcr, dts)
+	}
+
+	pes := newPES(s.streamID, (pts+muxDelay)%TSClockWrap, (dts+muxDelay)%TSClockWrap, data)
+
+	for first := true; len(pes) > 0; first = false {
+		var adaptation []byte
+
+		if first && (carriesPCR || randomAccess) {
+			adaptation = []byte{0}
+
+			if randomAccess {
+				adaptation[0] |= 0x40
+			}
+
+			if carriesPCR {
+				adaptation[0] |= 0x10
+				adaptation = append(adaptation, encodePCR(m.pcr%TSClockWrap)...)
+			}
+		}
+
+		room := TSPacketSize - 4
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+
+		n := min(room, len(pes))
+
+		if err := m.writePacket(s.pid, first, adaptation, pes[:n]); err != nil {
+			return err
+		}
+
+		pes = pes[n:]
+	}
+
+	return nil
+}
+
+// writes one TS packet carrying the payload, which must fit. The adaptation
+// field holds `adaptation`, its flags and optional fields, and is stuffed to
+// fill the rest of the packet.
+func (m *TSMuxer) writePacket(pid uint16, unitStart bool, adaptation []byte, payload []byte) error {
+	pkt := make([]byte, 4, TSPacketSize)
+
+	pkt[0] = TSSyncByte
+	pkt[1] = byte(pid>>8) & 0x1F
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.continuity[pid] // payload only
+
+	if unitStart {
+		pkt[1] |= 0x40
+	}
+
+	m.continuity[pid] = (m.continuity[pid] + 1) & 0x0F
+
+	if stuffing := TSPacketSize - 4 - len(payload); adaptation != nil || stuffing > 0 {
+		pkt[3] |= 0x20
+
+		length := stuffing - 1
+		pkt = append(pkt, byte(length))
+
+		if length > 0 {
+			if adaptation == nil {
+				adaptation = []byte{0} // no flags
+			}
+
+			pkt = append(pkt, adaptation...)
+
+			for len(pkt) < 5+length {
+				pkt = append(pkt, 0xFF)
+			}
+		}
+	}
+
+	pkt = append(pkt, payload...)
+
+	_, err := m.w.Write(pkt)
+	return err
+}
+
+// writes the program association table and the program map table
+func (m *TSMuxer) writeTables() error {
+	pat := []byte{
+		0x00,       // table_id
+		0xB0, 0x00, // section length, set below
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version 0, current
+		0x00, 0x00, // section_number, last_section_number
+		byte(muxProgramNumber >> 8), byte(muxProgramNumber),
+		0xE0 | byte(muxPMTPID>>8), byte(muxPMTPID & 0xFF),
+	}
+
+	pmt := []byte{
+		0x02,       // table_id
+		0xB0, 0x00, // section length, set below
+		byte(muxProgramNumber >> 8), byte(muxProgramNumber),
+		0xC1,       // version 0, current
+		0x00, 0x00, // section_number, last_section_number
+		0xE0 | byte(m.pcrPID>>8), byte(m.pcrPID),
+		0xF0, 0x00, // no program descriptors
+	}
+
+	for _, s := range m.streams {
+		pmt = append(pmt, s.streamType, 0xE0|byte(s.pid>>8), byte(s.pid), 0xF0, 0x00)
+	}
+
+	if err := m.writeSection(PATPID, pat); err != nil {
+		return err
+	}
+
+	if err := m.writeSection(muxPMTPID, pmt); err != nil {
+		return err
+	}
+
+	m.wroteTables = true
+	return nil
+}
+
+// completes the length and CRC of a PSI section and writes it in one packet,
+// after a pointer field and padded with 0xFF.
+func (m *TSMuxer) writeSection(pid uint16, section []byte) error {
+	length := len(section) - 3 + 4
+	section[1] |= byte(length>>8) & 0x0F
+	section[2] = byte(length)
+
+	section = binary.BigEndian.AppendUint32(section, crc32MPEG2(section))
+
+	payload := make([]byte, 0, TSPacketSize-4)
+	payload = append(payload, 0x00) // pointer_field
+	payload = append(payload, section...)
+
+	for len(payload) < cap(payload) {
+		payload = append(payload, 0xFF)
+	}
+
+	return m.writePacket(pid, true, nil, payload)
+}
+
+// returns a PES packet of the access unit, with a presentation timestamp, and a
+// decoding timestamp if it differs
+func newPES(streamID byte, pts, dts uint64, data []byte) []byte {
+	headerLength := 5 // the PTS
+	if dts != pts {
+		headerLength += 5
+	}
+
+	// unbounded (0) is only allowed for video, which is the only stream with
+	// access units this large.
+	length := 3 + headerLength + len(data)
+	if length > 0xFFFF {
+		length = 0
+	}
+
+	pes := make([]byte, 0, 9+headerLength+len(data))
+	pes = append(pes, 0x00, 0x00, 0x01, streamID, byte(length>>8), byte(length))
+
+	if dts != pts {
+		pes = append(pes, 0x80, 0xC0, byte(headerLength))
+		pes = appendTimestamp(pes, 0x30, pts)
+		pes = appendTimestamp(pes, 0x10, dts)
+	} else {
+		pes = append(pes, 0x80, 0x80, byte(headerLength)) // PTS only
+		pes = appendTimestamp(pes, 0x20, pts)
+	}
+
+	return append(pes, data...)
+}
+
+// appends a 33 bit PES timestamp behind its 4 bit prefix
+func appendTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	return append(b,
+		prefix|byte(ts>>29)&0x0E|1,
+		byte(ts>>22),
+		byte(ts>>14)&0xFE|1,
+		byte(ts>>7),
+		byte(ts<<1)|1,
+	)
+}
+
+// encodes a program clock reference of the base in 90kHz units, with no
+// extension.
+func encodePCR(base uint64) []byte {
+	return []byte{
+		byte(base >> 25),
+		byte(base >> 17),
+		byte(base >> 9),
+		byte(base >> 1),
+		byte(base<<7) | 0x7E,
+		0x00,
+	}
+}
+
+// the CRC of PSI sections (ISO/IEC 13818-1 annex A), which unlike hash/crc32
+// is not bit reflected.
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
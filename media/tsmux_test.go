@@ -0,0 +1,121 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testFrameTime = TSClockRate / 30
+
+// presentation order of the frames of a GOP of H.264 with B-frames, in the
+// order they are decoded: I0 P3 B1 B2 P5 B4
+var testGOPOrder = []uint64{0, 3, 1, 2, 5, 4}
+
+// muxes GOPs of video sent in decoding order, and returns the MPEG-TS
+func muxTestGOPs(t *testing.T, gops int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	muxer, err := NewTSMuxer(&buf, StreamTypeH264, StreamTypeAAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for gop := range gops {
+		for i, order := range testGOPOrder {
+			frame := uint64(gop*len(testGOPOrder) + i)
+			dts := frame * testFrameTime
+			// presented a frame later than decoded, which leaves room to reorder
+			pts := (uint64(gop*len(testGOPOrder)) + order + 1) * testFrameTime
+
+			if err := muxer.WriteAccessUnit(0, pts, dts, i == 0, bytes.Repeat([]byte{byte(i)}, 400)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := muxer.WriteAccessUnit(1, dts, dts, true, []byte{0xFF, 0xF1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestTSMuxerPCRFollowsDecodingOrder(t *testing.T) {
+	ts := muxTestGOPs(t, 3)
+
+	var lastPCR uint64
+	var pcrs, withDTS int
+
+	for i := 0; i < len(ts); i += TSPacketSize {
+		pkt := TSPacket(ts[i : i+TSPacketSize])
+
+		if !pkt.Valid() {
+			t.Fatalf("packet %d is not valid", i/TSPacketSize)
+		}
+
+		if pcr, ok := pkt.PCR(); ok {
+			if pcrs > 0 && pcr < lastPCR {
+				t.Fatalf("PCR went back from %d to %d", lastPCR, pcr)
+			}
+			lastPCR = pcr
+			pcrs++
+		}
+
+		pts, ok := pkt.PTS()
+		if !ok || pkt.PID() != muxFirstPID {
+			continue
+		}
+
+		// the decoder is given the time it needs ahead of every access unit
+		if pts < lastPCR+muxDelay {
+			t.Errorf("PTS %d is less than %d ahead of the PCR %d", pts, muxDelay, lastPCR)
+		}
+
+		if pkt.Payload()[7]&0xC0 == 0xC0 {
+			withDTS++
+		}
+	}
+
+	if pcrs != 3*len(testGOPOrder) {
+		t.Errorf("got %d PCRs, want one per video access unit: %d", pcrs, 3*len(testGOPOrder))
+	}
+
+	// the I and P frames are decoded ahead of when they are presented, the
+	// B-frames as they are presented
+	if withDTS != 3*3 {
+		t.Errorf("got %d PES packets with a DTS, want one per I and P frame: %d", withDTS, 3*3)
+	}
+}
+
+func TestTSMuxerSeekIndex(t *testing.T) {
+	ts := muxTestGOPs(t, 4)
+
+	index, err := BuildSeekIndex(bytes.NewReader(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.Points) != 4 {
+		t.Fatalf("got %d seek points, want one per GOP: %+v", len(index.Points), index.Points)
+	}
+
+	for gop, point := range index.Points {
+		want := float64(gop*len(testGOPOrder)*testFrameTime) / TSClockRate
+		if point.Time != want {
+			t.Errorf("GOP %d: seek point at %vs, want %vs", gop, point.Time, want)
+		}
+
+		pkt := TSPacket(ts[point.Offset : point.Offset+TSPacketSize])
+		if !pkt.RandomAccess() || pkt.PID() != muxFirstPID {
+			t.Errorf("GOP %d: seek point at %d is not the keyframe", gop, point.Offset)
+		}
+
+		// playback that begins at the seek point finds the program tables
+		// right ahead of it
+		if tables := TSPacket(ts[point.Offset-2*TSPacketSize:]); tables.PID() != PATPID {
+			t.Errorf("GOP %d: no program tables ahead of the seek point", gop)
+		}
+	}
+}
@@ -7,12 +7,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/rebeljah/picast/media"
 	"github.com/urfave/cli/v3"
+	"gopkg.in/vansante/go-ffprobe.v2"
 )
 
 type ErrReadCancelled struct {
@@ -135,19 +139,67 @@ func (c *CLI) commandMediaAdd(ctx context.Context, cmd *cli.Command) error {
 
 		// MPEG-TS Output Settings
 		"-f", "mpegts", // Force MPEG-TS output format
-		"-mpegts_flags", "no_rtcp", // Disable RTCP to reduce overhead
 		"-flags", "+global_header", // Add global headers for some streaming protocols
 		"-y",       // Overwrite output file without asking
 		outputName, // Output file name/path
 	}
 
-	// TODO: Execute ffmpeg command
-	log.Printf("Would execute: ffmpeg %s", strings.Join(ffmpegArgs, " "))
+	log.Printf("executing: ffmpeg %s", strings.Join(ffmpegArgs, " "))
 
-	// TODO: Index RTP packets byte offsets for efficient seek
-	// TODO: Add to manifest
+	ffmpeg := exec.CommandContext(ctx, "ffmpeg", ffmpegArgs...)
+	ffmpeg.Stderr = os.Stderr
+
+	if err := ffmpeg.Run(); err != nil {
+		return fmt.Errorf("converting %s: %w", pName, err)
+	}
+
+	// the tracks of the converted media are described to clients
+	probe, err := ffprobe.ProbeURL(ctx, outputName)
+	if err != nil {
+		return fmt.Errorf("probing %s: %w", outputName, err)
+	}
+
+	// Index keyframe byte offsets for efficient seek
+	log.Println("Indexing keyframes for seek...")
+
+	index, err := media.BuildSeekIndexFile(outputName)
+	if err != nil {
+		return fmt.Errorf("indexing %s: %w", outputName, err)
+	}
+
+	log.Printf("indexed %d keyframes over %.1fs", len(index.Points), index.Duration())
+
+	uid, err := media.NewUID()
+	if err != nil {
+		return err
+	}
+
+	metadata := media.Metadata{
+		Title:     strings.TrimSuffix(filepath.Base(pName), filepath.Ext(pName)),
+		UID:       uid,
+		Duration:  index.Duration(),
+		Path:      outputName,
+		Structure: *probe,
+	}
+
+	if probe.Format != nil {
+		metadata.Duration = probe.Format.Duration().Seconds()
+	}
+
+	switch video, audio := probe.FirstVideoStream() != nil, probe.FirstAudioStream() != nil; {
+	case video && audio:
+		metadata.MediaType = media.AudioVideo
+	case video:
+		metadata.MediaType = media.StandaloneVideo
+	case audio:
+		metadata.MediaType = media.StandaloneAudio
+	}
+
+	c.manifest.Put(metadata)
+	fmt.Printf("added %q with id: %s\n", metadata.Title, metadata.UID)
+
+	return nil
 
-	panic("")
 	// TODO Instead of allowing multiple elementary file or containers + elementary files,
 	// just convert ALL media to a single mpeg-ts container. If the user
 	// wants to add an audio track, it can be encoded into the exiting .ts
@@ -160,6 +212,41 @@ func (c *CLI) commandMediaAdd(ctx context.Context, cmd *cli.Command) error {
 	//  - then later packetize (~7 MPEG-TS pkt / RTP pkt) -> stream -> depacketize -> play
 }
 
+// adds the stream of an upstream RTSP server, e.g an IP camera, which is
+// relayed to clients as media of the server.
+func (c *CLI) commandMediaRelay(ctx context.Context, cmd *cli.Command) error {
+	upstream := cmd.String("url")
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", upstream, err)
+	}
+
+	if u.Scheme != "rtsp" && u.Scheme != "rtsps" {
+		return fmt.Errorf("not an rtsp:// or rtsps:// URL: %s", upstream)
+	}
+
+	uid, err := media.NewUID()
+	if err != nil {
+		return err
+	}
+
+	metadata := media.Metadata{
+		Title:    cmd.String("title"),
+		UID:      uid,
+		Upstream: upstream,
+	}
+
+	if metadata.Title == "" {
+		metadata.Title = u.Host + u.Path
+	}
+
+	c.manifest.Put(metadata)
+	fmt.Printf("added %q with id: %s\n", metadata.Title, metadata.UID)
+
+	return nil
+}
+
 func NewCLI(manifest media.MutableManifest) *CLI {
 	c := make(chan error, 1)
 
@@ -205,6 +292,24 @@ func (c *CLI) Run() error {
 						},
 						Action: c.commandMediaAdd,
 					},
+					{
+						Name:  "relay",
+						Usage: "add the stream of another RTSP server, e.g an IP camera, to relay from the media server",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "url",
+								Aliases:  []string{"u"},
+								Usage:    "the rtsp:// URL of the stream, with any credentials of the upstream server",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:    "title",
+								Aliases: []string{"t"},
+								Usage:   "the title of the media, by default the host and path of the URL",
+							},
+						},
+						Action: c.commandMediaRelay,
+					},
 					{
 						Name:  "remove",
 						Usage: "remove music or video from the media server",
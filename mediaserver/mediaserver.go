@@ -13,7 +13,17 @@ import (
 	"github.com/rebeljah/picast/rtsp"
 )
 
-func RunPicastMediaServer(rtspServer *rtsp.RTSPServer, rtpServer *rtp.Server, httpServer *http.Server, cli *CLI) {
+// RTSPSConfig configures the RTSP server to also serve RTSP over TLS.
+type RTSPSConfig struct {
+	Addr     string
+	CertFile string // PEM, generated along with the key if neither exists
+	KeyFile  string // PEM
+}
+
+// runs the media server until interrupted. RTSP over TLS is served too if
+// rtsps is not nil, and its certificate is reloaded on SIGHUP. Heartbeats are
+// exchanged with the peers of the RTSP server on heartbeatAddr, if not empty.
+func RunPicastMediaServer(rtspServer *rtsp.RTSPServer, rtpServer *rtp.Server, httpServer *http.Server, cli *CLI, rtsps *RTSPSConfig, heartbeatAddr string) {
 	var rg run.Group
 
 	// add actors
@@ -44,6 +54,47 @@ func RunPicastMediaServer(rtspServer *rtsp.RTSPServer, rtpServer *rtp.Server, ht
 		rtspServer.Interrupt,
 	)
 
+	// RTSPS server, which shares the sessions of the RTSP server
+	if rtsps != nil {
+		rg.Add(
+			func() error {
+				return rtspServer.ListenAndServeTLS(rtsps.Addr, rtsps.CertFile, rtsps.KeyFile)
+			},
+			rtspServer.Interrupt,
+		)
+
+		reloadTrap := make(chan os.Signal, 1)
+		signal.Notify(reloadTrap, syscall.SIGHUP)
+		rg.Add(
+			func() error {
+				for range reloadTrap {
+					if err := rtspServer.ReloadCertificates(); err != nil {
+						log.Printf("failed to reload RTSPS certificate: %v", err)
+						continue
+					}
+
+					log.Println("reloaded RTSPS certificate")
+				}
+
+				return nil
+			},
+			func(error) {
+				signal.Stop(reloadTrap)
+				close(reloadTrap)
+			},
+		)
+	}
+
+	// heartbeats with the other nodes that serve the library
+	if heartbeatAddr != "" {
+		rg.Add(
+			func() error {
+				return rtspServer.ListenAndServeHeartbeats(heartbeatAddr)
+			},
+			rtspServer.Interrupt,
+		)
+	}
+
 	// HTTP server
 	rg.Add(
 		func() error {
@@ -0,0 +1,359 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtsp"
+)
+
+// Depacketizers reassemble the access units of a recorded track from its RTP
+// packets and write them into the elementary stream of the recording.
+
+var ErrUnsupportedEncoding = errors.New("unsupported RTP encoding")
+
+type depacketizer interface {
+	// writes the access units that the packet completes, if any
+	depacketize(pkt *rtp.Packet) error
+}
+
+func newDepacketizer(args rtsp.IngestArguments) (depacketizer, error) {
+	m := args.Media
+
+	if m.ClockRate == 0 {
+		return nil, fmt.Errorf("%w: %s without a clock rate", ErrUnsupportedEncoding, m.Encoding)
+	}
+
+	clock := ingestClock{recording: args.Recording, rate: m.ClockRate}
+
+	switch m.Encoding {
+	case "H264":
+		return newH264Depacketizer(args.Recording, args.Stream, clock, m.Format)
+	case "MPEG4-GENERIC":
+		return newAACDepacketizer(args.Recording, args.Stream, clock, m.Format)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, m.Encoding)
+	}
+}
+
+// maps the RTP timestamps of a track onto the 90kHz clock of the recording.
+// The first packet is timed by when it arrived in the recording, so that tracks
+// with unrelated RTP timestamps line up.
+type ingestClock struct {
+	recording *media.Recording
+	rate      uint32 // of the RTP timestamps
+	started   bool
+	base      uint64 // 90kHz time of the first packet
+	last      uint32 // RTP timestamp of the last packet
+	elapsed   int64  // RTP ticks from the first packet to the last, unwrapped
+	lastDTS   uint64
+}
+
+func (c *ingestClock) pts(timestamp uint32) uint64 {
+	if !c.started {
+		c.started = true
+		c.base = c.recording.Elapsed()
+		c.last = timestamp
+	}
+
+	c.elapsed += int64(int32(timestamp - c.last))
+	c.last = timestamp
+
+	ticks := int64(c.base) + c.elapsed*media.TSClockRate/int64(c.rate)
+	return uint64(max(0, ticks))
+}
+
+// returns the decoding time of an access unit presented at `pts`, for video
+// sent in decoding order, whose RTP timestamps go back and forth with B-frames.
+// An access unit is decoded by when it arrived or is presented, whichever is
+// first, and never before the last one.
+func (c *ingestClock) dts(pts uint64) uint64 {
+	c.lastDTS = max(c.lastDTS, min(pts, c.recording.Elapsed()))
+	return c.lastDTS
+}
+
+// the NAL unit types of H.264 (ITU-T H.264 table 7-1) that matter to recording
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// an access unit delimiter, which MPEG-TS requires to begin each access unit of
+// H.264 (ISO/IEC 13818-1 2.14.1)
+var h264AccessUnitDelimiter = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}
+
+// reassembles H.264 (RFC6184) access units, which end at the marker bit or a
+// new timestamp.
+type h264Depacketizer struct {
+	recording *media.Recording
+	stream    int
+	clock     ingestClock
+	packet    codecs.H264Packet
+
+	// the SPS and PPS of sprop-parameter-sets, in Annex B, for IDR frames
+	// that arrive without them
+	parameterSets []byte
+
+	au       []byte // Annex B NAL units of the access unit so far
+	auTime   uint32
+	keyframe bool
+	hasSPS   bool
+}
+
+func newH264Depacketizer(recording *media.Recording, stream int, clock ingestClock, format map[string]string) (*h264Depacketizer, error) {
+	if mode := format["packetization-mode"]; mode != "" && mode != "0" && mode != "1" {
+		return nil, fmt.Errorf("%w: H264 packetization-mode %s", ErrUnsupportedEncoding, mode)
+	}
+
+	d := &h264Depacketizer{
+		recording: recording,
+		stream:    stream,
+		clock:     clock,
+	}
+
+	if sprop := format["sprop-parameter-sets"]; sprop != "" {
+		for set := range strings.SplitSeq(sprop, ",") {
+			nal, err := base64.StdEncoding.DecodeString(set)
+			if err != nil {
+				return nil, fmt.Errorf("bad sprop-parameter-sets: %q", sprop)
+			}
+
+			d.parameterSets = append(d.parameterSets, annexBStartCode...)
+			d.parameterSets = append(d.parameterSets, nal...)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *h264Depacketizer) depacketize(pkt *rtp.Packet) error {
+	// the marker of the last access unit was lost
+	if len(d.au) > 0 && pkt.Timestamp != d.auTime {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+
+	nals, err := d.packet.Unmarshal(pkt.Payload)
+	if err != nil {
+		return err
+	}
+
+	// nothing until the last fragment of a fragmented NAL unit
+	if len(nals) > 0 {
+		d.auTime = pkt.Timestamp
+
+		for nal := range bytes.SplitSeq(nals, annexBStartCode) {
+			if len(nal) == 0 {
+				continue
+			}
+
+			switch nal[0] & 0x1F {
+			case h264NALIDR:
+				d.keyframe = true
+			case h264NALSPS:
+				d.hasSPS = true
+			}
+		}
+
+		d.au = append(d.au, nals...)
+	}
+
+	if pkt.Marker && len(d.au) > 0 {
+		return d.flush()
+	}
+
+	return nil
+}
+
+// writes the access unit so far, behind a delimiter
+func (d *h264Depacketizer) flush() error {
+	var parameterSets []byte
+	if d.keyframe && !d.hasSPS {
+		parameterSets = d.parameterSets
+	}
+
+	au := slices.Concat(h264AccessUnitDelimiter, parameterSets, d.au)
+
+	pts := d.clock.pts(d.auTime)
+	err := d.recording.WriteAccessUnit(d.stream, pts, d.clock.dts(pts), d.keyframe, au)
+
+	d.au, d.keyframe, d.hasSPS = nil, false, false
+	return err
+}
+
+// the sampling frequencies of AAC, by their index in the AudioSpecificConfig
+// and the ADTS header (ISO/IEC 14496-3 table 1.18)
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// samples in each AAC access unit
+const aacFrameSamples = 1024
+
+// reassembles AAC access units sent in the AAC-hbr mode of RFC3640, and frames
+// them in ADTS, which is how MPEG-TS carries AAC.
+type aacDepacketizer struct {
+	recording *media.Recording
+	stream    int
+	clock     ingestClock
+
+	sizeLength       int // bits of each AU header that give the AU size
+	indexLength      int // bits of the index of the first AU header
+	indexDeltaLength int // bits of the index of the rest
+
+	// from the AudioSpecificConfig
+	objectType  byte
+	sampleRate  byte // index
+	channelConf byte
+}
+
+func newAACDepacketizer(recording *media.Recording, stream int, clock ingestClock, format map[string]string) (*aacDepacketizer, error) {
+	if mode := format["mode"]; !strings.EqualFold(mode, "AAC-hbr") {
+		return nil, fmt.Errorf("%w: MPEG4-GENERIC mode %q", ErrUnsupportedEncoding, mode)
+	}
+
+	d := &aacDepacketizer{
+		recording: recording,
+		stream:    stream,
+		clock:     clock,
+	}
+
+	for name, length := range map[string]*int{
+		"sizelength":       &d.sizeLength,
+		"indexlength":      &d.indexLength,
+		"indexdeltalength": &d.indexDeltaLength,
+	} {
+		value, ok := format[name]
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 16 {
+			return nil, fmt.Errorf("bad MPEG4-GENERIC %s: %q", name, value)
+		}
+		*length = n
+	}
+
+	if d.sizeLength == 0 {
+		return nil, errors.New("MPEG4-GENERIC without a sizelength")
+	}
+
+	config, err := hex.DecodeString(format["config"])
+	if err != nil || len(config) < 2 {
+		return nil, fmt.Errorf("bad MPEG4-GENERIC config: %q", format["config"])
+	}
+
+	d.objectType = config[0] >> 3
+	d.sampleRate = (config[0]&0x07)<<1 | config[1]>>7
+	d.channelConf = (config[1] >> 3) & 0x0F
+
+	if d.objectType == 0 || d.objectType > 4 || int(d.sampleRate) >= len(aacSampleRates) {
+		return nil, fmt.Errorf("%w: AAC config %x", ErrUnsupportedEncoding, config)
+	}
+
+	if rate := aacSampleRates[d.sampleRate]; rate != clock.rate {
+		return nil, fmt.Errorf("AAC clock rate %d is not its sample rate %d", clock.rate, rate)
+	}
+
+	return d, nil
+}
+
+func (d *aacDepacketizer) depacketize(pkt *rtp.Packet) error {
+	payload := pkt.Payload
+
+	if len(payload) < 2 {
+		return fmt.Errorf("AAC payload too short: %d bytes", len(payload))
+	}
+
+	headersLength := (int(payload[0])<<8 | int(payload[1]) + 7) / 8
+
+	if len(payload) < 2+headersLength {
+		return fmt.Errorf("AAC payload too short for its AU headers")
+	}
+
+	headers := bitReader{b: payload[2 : 2+headersLength]}
+	data := payload[2+headersLength:]
+
+	var sizes []int
+	for i := 0; headers.remaining() >= d.sizeLength+d.indexDeltaLength; i++ {
+		size := headers.read(d.sizeLength)
+
+		if i == 0 {
+			headers.read(d.indexLength)
+		} else {
+			headers.read(d.indexDeltaLength)
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	pts := d.clock.pts(pkt.Timestamp)
+
+	for i, size := range sizes {
+		// an AU fragmented over several packets, which encoders only do for
+		// frames larger than the MTU, is dropped
+		if size > len(data) {
+			return nil
+		}
+
+		frameTime := uint64(i) * aacFrameSamples * media.TSClockRate / uint64(d.clock.rate)
+
+		if err := d.recording.WriteAccessUnit(d.stream, pts+frameTime, pts+frameTime, true, d.adts(data[:size])); err != nil {
+			return err
+		}
+
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// frames a raw AAC access unit in ADTS (ISO/IEC 14496-3 1.A.2), without a CRC
+func (d *aacDepacketizer) adts(au []byte) []byte {
+	length := 7 + len(au)
+
+	header := []byte{
+		0xFF,
+		0xF1, // MPEG-4, no CRC
+		(d.objectType-1)<<6 | d.sampleRate<<2 | d.channelConf>>2,
+		(d.channelConf&0x03)<<6 | byte(length>>11)&0x03,
+		byte(length >> 3),
+		byte(length&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+
+	return append(header, au...)
+}
+
+// reads big endian bit fields
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.b)*8 - r.pos
+}
+
+func (r *bitReader) read(bits int) int {
+	var v int
+
+	for range bits {
+		bit := r.b[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+
+	return v
+}
@@ -0,0 +1,158 @@
+package rtp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/rebeljah/picast/media"
+)
+
+type testAccessUnit struct {
+	pts  uint64
+	data []byte
+}
+
+// returns a recording of a single elementary stream, and a function that
+// closes it and returns the access units recorded
+func newTestRecording(t *testing.T, streamType byte) (*media.Recording, func() []testAccessUnit) {
+	t.Helper()
+
+	recording, err := media.CreateRecording(filepath.Join(t.TempDir(), "recording.ts"), streamType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return recording, func() []testAccessUnit {
+		recording.Close()
+
+		ts, err := os.ReadFile(recording.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var aus []testAccessUnit
+		var pes []byte
+
+		flush := func() {
+			if len(pes) > 0 {
+				pts := uint64(pes[9]&0x0E)<<29 | uint64(pes[10])<<22 | uint64(pes[11]&0xFE)<<14 |
+					uint64(pes[12])<<7 | uint64(pes[13])>>1
+				aus = append(aus, testAccessUnit{pts: pts, data: pes[9+int(pes[8]):]})
+			}
+		}
+
+		for i := 0; i+media.TSPacketSize <= len(ts); i += media.TSPacketSize {
+			pkt := media.TSPacket(ts[i : i+media.TSPacketSize])
+			if pkt.PID() != recording.PID(0) {
+				continue
+			}
+
+			if pkt.PayloadUnitStart() {
+				flush()
+				pes = nil
+			}
+			pes = append(pes, pkt.Payload()...)
+		}
+		flush()
+
+		return aus
+	}
+}
+
+func TestH264FragmentedNALUnit(t *testing.T) {
+	recording, recorded := newTestRecording(t, media.StreamTypeH264)
+
+	d, err := newH264Depacketizer(recording, 0, ingestClock{recording: recording, rate: 90000}, map[string]string{
+		"packetization-mode":   "1",
+		"sprop-parameter-sets": "Z0IAKeKQ,aM48gA==",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an IDR slice, sent in three FU-A fragments
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xAB}, 3000)...)
+	fragments := [][]byte{idr[1:1000], idr[1000:2000], idr[2000:]}
+	headers := []byte{0x80 | 5, 5, 0x40 | 5} // start, middle, end
+
+	for i, fragment := range fragments {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: uint16(i), Timestamp: 1234, Marker: i == len(fragments)-1},
+			Payload: append([]byte{0x60 | 28, headers[i]}, fragment...),
+		}
+
+		if err := d.depacketize(pkt); err != nil {
+			t.Fatal(err)
+		}
+
+		if i < len(fragments)-1 && len(d.au) > 0 {
+			t.Fatalf("access unit begun before the last fragment of the NAL unit")
+		}
+	}
+
+	aus := recorded()
+	if len(aus) != 1 {
+		t.Fatalf("got %d access units, want 1", len(aus))
+	}
+
+	// behind a delimiter and the parameter sets that the IDR frame lacks
+	want := append([]byte{}, h264AccessUnitDelimiter...)
+	want = append(want, d.parameterSets...)
+	want = append(want, annexBStartCode...)
+	want = append(want, idr...)
+
+	if !bytes.Equal(aus[0].data, want) {
+		t.Fatalf("got access unit of %d bytes, want %d: % x...", len(aus[0].data), len(want), aus[0].data[:min(32, len(aus[0].data))])
+	}
+}
+
+func TestAACAccessUnits(t *testing.T) {
+	recording, recorded := newTestRecording(t, media.StreamTypeAAC)
+
+	d, err := newAACDepacketizer(recording, 0, ingestClock{recording: recording, rate: 44100}, map[string]string{
+		"mode":             "AAC-hbr",
+		"sizelength":       "13",
+		"indexlength":      "3",
+		"indexdeltalength": "3",
+		"config":           "1210", // AAC LC, 44.1kHz, stereo
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := bytes.Repeat([]byte{1}, 100), bytes.Repeat([]byte{2}, 200)
+
+	// two AU headers of 16 bits: the size in 13, the index (delta) in 3
+	payload := []byte{0x00, 32, 100 >> 5, 100 << 3 & 0xFF, 200 >> 5, 200 << 3 & 0xFF}
+	payload = append(payload, first...)
+	payload = append(payload, second...)
+
+	if err := d.depacketize(&rtp.Packet{Header: rtp.Header{Timestamp: 5000}, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	aus := recorded()
+	if len(aus) != 2 {
+		t.Fatalf("got %d access units, want 2", len(aus))
+	}
+
+	for i, raw := range [][]byte{first, second} {
+		data := aus[i].data
+
+		if len(data) != 7+len(raw) || data[0] != 0xFF || data[1] != 0xF1 || !bytes.Equal(data[7:], raw) {
+			t.Fatalf("access unit %d is not framed in ADTS: % x", i, data[:min(16, len(data))])
+		}
+
+		if length := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5; length != len(data) {
+			t.Errorf("access unit %d: ADTS frame length %d, want %d", i, length, len(data))
+		}
+	}
+
+	// the second is presented a frame after the first
+	if step := aus[1].pts - aus[0].pts; step != aacFrameSamples*media.TSClockRate/44100 {
+		t.Errorf("access units %d ticks apart, want %d", step, aacFrameSamples*media.TSClockRate/44100)
+	}
+}
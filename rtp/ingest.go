@@ -0,0 +1,238 @@
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtsp"
+)
+
+// the largest RTP packet received, which is as large as an interleaved frame
+const maxIngestPacketSize = 0xFFFF
+
+// Ingest receives one track of a live stream from a client that records it
+// (RFC2326-10.11), and writes it into the recording.
+type Ingest struct {
+	id            rtsp.StreamUID
+	transportInfo rtsp.TransportInfo
+	payloadType   uint8
+	depacketizer  depacketizer // only accessed by the receive loop
+	raddr         net.Addr     // the client
+	rtpConn       *net.UDPConn // bound to the server RTP port, for UDP transports
+	rtcpConn      *net.UDPConn // bound to the server RTCP port, for UDP transports
+	rtspConn      rtsp.InterleavedConn
+	stop          chan struct{}
+	teardownOnce  sync.Once
+
+	recording  atomic.Bool  // media is dropped until RECORD, and while paused
+	receivedAt atomic.Int64 // unix nanoseconds of the last packet
+}
+
+type ingests map[rtsp.StreamUID]*Ingest
+
+func (in *Ingest) teardown() {
+	in.teardownOnce.Do(func() {
+		close(in.stop)
+	})
+}
+
+// opens the reader of the RTP the client sends. UDP transports receive on the
+// server port pair bound at setup, while interleaved transports read from the
+// RTSP connection.
+func (in *Ingest) openTransport() (io.ReadCloser, error) {
+	if in.transportInfo.IsInterleaved() {
+		if in.rtspConn == nil {
+			return nil, errors.New("interleaved transport without an RTSP connection")
+		}
+
+		return in.rtspConn.ChannelReader(uint8(in.transportInfo.InterleavedStart)), nil
+	}
+
+	return in.rtpConn, nil
+}
+
+func (in *Ingest) statistics() rtsp.StreamStats {
+	var stats rtsp.StreamStats
+
+	if at := in.receivedAt.Load(); at != 0 {
+		stats.ReceivedAt = time.Unix(0, at)
+	}
+
+	return stats
+}
+
+// SetupIngest prepares to receive a track of a live stream into the recording,
+// which begins on RecordStream.
+func (s *Server) SetupIngest(args rtsp.IngestArguments) (rtsp.TransportInfo, error) {
+	log.Printf(
+		"setting up RTP ingest from: %v with stream id: %v",
+		args.RAddr, args.StreamID,
+	)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.ingests[args.StreamID]; ok {
+		return rtsp.TransportInfo{}, fmt.Errorf("ingest already exists with ID: %s", args.StreamID)
+	}
+
+	if args.Recording == nil {
+		return rtsp.TransportInfo{}, fmt.Errorf("ingest %s has no recording", args.StreamID)
+	}
+
+	depacketizer, err := newDepacketizer(args)
+	if err != nil {
+		return rtsp.TransportInfo{}, err
+	}
+
+	selectedTransport, err := negotiateTransport(args.AcceptableTransports, args.RAddr, args.Conn, rtsp.RECORD)
+	if err != nil {
+		return rtsp.TransportInfo{}, err
+	}
+
+	var rtpConn, rtcpConn *net.UDPConn
+	if !selectedTransport.IsInterleaved() {
+		rtpAddr, rtcpAddr, err := clientUDPAddrs(args.RAddr, selectedTransport)
+		if err != nil {
+			return rtsp.TransportInfo{}, err
+		}
+
+		if rtpConn, rtcpConn, err = s.allocatePorts(rtpAddr, rtcpAddr); err != nil {
+			return rtsp.TransportInfo{}, err
+		}
+
+		selectedTransport.ServerPortStart = rtpConn.LocalAddr().(*net.UDPAddr).Port
+		selectedTransport.ServerPortEnd = rtcpConn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	ingest := &Ingest{
+		id:            args.StreamID,
+		transportInfo: selectedTransport,
+		payloadType:   args.Media.PayloadType,
+		depacketizer:  depacketizer,
+		raddr:         args.RAddr,
+		rtpConn:       rtpConn,
+		rtcpConn:      rtcpConn,
+		stop:          make(chan struct{}),
+	}
+
+	if selectedTransport.IsInterleaved() {
+		ingest.rtspConn = args.Conn
+	}
+
+	s.ingests[args.StreamID] = ingest
+
+	go s.ingestTrack(ingest)
+
+	return selectedTransport, nil
+}
+
+// receives RTP packets into the recording until the ingest is torn down or the
+// recording is closed. Packets of other payload types, and those received
+// while not recording, are dropped.
+func (s *Server) ingestTrack(ingest *Ingest) {
+	defer log.Printf("RTP ingest with id: %v from: %v torn down\n", ingest.id, ingest.raddr)
+	defer s.teardownIngest(ingest)
+
+	conn, err := ingest.openTransport()
+	if err != nil {
+		log.Printf("RTP server failed to open %v transport from: %v: %v", ingest.transportInfo.LowerTransport, ingest.raddr, err)
+		return
+	}
+
+	// the client's RTCP is not used, but the port is held until teardown
+	if ingest.rtcpConn != nil {
+		defer ingest.rtcpConn.Close()
+	}
+
+	// interrupt the read as soon as the ingest is stopped
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ingest.stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxIngestPacketSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// e.g. an ICMP port unreachable from a client that is not sending yet
+			continue
+		}
+
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			log.Printf("RTP ingest %v received invalid RTP: %v", ingest.id, err)
+			continue
+		}
+
+		if pkt.PayloadType != ingest.payloadType || !ingest.recording.Load() {
+			continue
+		}
+
+		ingest.receivedAt.Store(time.Now().UnixNano())
+
+		err = ingest.depacketizer.depacketize(&pkt)
+
+		if errors.Is(err, media.ErrRecordingClosed) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("RTP ingest %v failed to depacketize: %v", ingest.id, err)
+		}
+	}
+}
+
+func (s *Server) teardownIngest(ingest *Ingest) {
+	if ingest == nil {
+		return
+	}
+
+	ingest.teardown()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ingests[ingest.id] == ingest {
+		delete(s.ingests, ingest.id)
+	}
+}
+
+func (s *Server) getIngest(uid rtsp.StreamUID) (*Ingest, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	ingest, ok := s.ingests[uid]
+	return ingest, ok
+}
+
+// begin or resume writing the media the client sends into the recording
+func (s *Server) RecordStream(uid rtsp.StreamUID) error {
+	ingest, ok := s.getIngest(uid)
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchStream, uid)
+	}
+
+	ingest.recording.Store(true)
+	return nil
+}
@@ -0,0 +1,385 @@
+package rtp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/rebeljah/picast/media"
+)
+
+// Packetizes MPEG-TS into RTP as described by RFC2250-2. Each RTP payload holds
+// a whole number of TS packets, and the timestamp of each RTP packet is the
+// transmission time of its first TS packet, measured on the PCR.
+
+const (
+	tsPacketsPerRTP = 7 // 7 * 188 bytes fits an ethernet MTU
+	mp2tPayloadType = 33
+)
+
+// returns a random value for the initial sequence number, timestamp and SSRC
+// of a stream (RFC3550-5.1).
+func randomUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// tracks the position of a TS stream in the media on the PCR. Packets between
+// PCRs are timed by extrapolating from the rate between the last two PCRs.
+type pcrClock struct {
+	elapsed uint64 // 90kHz ticks from the start of the media to the last PCR
+	lastPCR uint64
+	hasPCR  bool
+
+	packetsSincePCR uint64  // TS packets read since the last PCR
+	ticksPerPacket  float64 // measured between the last two PCRs
+	now             uint64  // 90kHz ticks from the start of the media to the last TS packet
+}
+
+// advances the clock past one TS packet, and returns the time of the packet
+func (c *pcrClock) advance(pkt media.TSPacket) uint64 {
+	pcr, ok := pkt.PCR()
+
+	if !ok {
+		if c.hasPCR {
+			c.packetsSincePCR++
+		}
+		return c.tick(c.elapsed + uint64(float64(c.packetsSincePCR)*c.ticksPerPacket))
+	}
+
+	if c.hasPCR && !pkt.Discontinuity() {
+		if step := media.TSClockDiff(c.lastPCR, pcr); step < media.MaxPCRStep {
+			c.elapsed += step
+
+			c.ticksPerPacket = float64(step) / float64(c.packetsSincePCR+1)
+		}
+	}
+
+	c.lastPCR, c.hasPCR = pcr, true
+	c.packetsSincePCR = 0
+
+	return c.tick(c.elapsed)
+}
+
+// extrapolation may overshoot the next PCR, time never runs backwards.
+func (c *pcrClock) tick(t uint64) uint64 {
+	c.now = max(c.now, t)
+	return c.now
+}
+
+// Packetizer reads MPEG-TS from a source and groups it into RTP packets.
+type Packetizer struct {
+	reader *bufio.Reader
+	clock  pcrClock
+
+	ssrc      uint32
+	timestamp uint32 // random offset of the RTP timestamp from the start of the media
+
+	// set when the timestamps jump, e.g after a seek, and cleared by the next packet
+	discontinuous bool
+
+	// the PIDs that are packetized, or nil to packetize every TS packet
+	pids map[uint16]bool
+
+	// the program tables, followed as the PAT lists the PMTs. The latest packet
+	// of each leads the keyframes of trick play.
+	pmtPIDs map[uint16]bool
+	tables  map[uint16]media.TSPacket
+
+	// PIDs that are never packetized, may be swapped at any time
+	excluded atomic.Pointer[map[uint16]bool]
+}
+
+// NewPacketizer returns a Packetizer with a random SSRC and timestamp offset,
+// positioned at the start of the media. If any PIDs are given, only the TS
+// packets of those PIDs and the program tables that describe them are
+// packetized, e.g to stream one track of the media.
+func NewPacketizer(r io.Reader, pids ...uint16) (*Packetizer, error) {
+	ssrc, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Packetizer{
+		reader:    bufio.NewReaderSize(r, media.TSPacketSize*tsPacketsPerRTP*8),
+		ssrc:      ssrc,
+		timestamp: timestamp,
+		pmtPIDs:   make(map[uint16]bool),
+		tables:    make(map[uint16]media.TSPacket),
+	}
+
+	if len(pids) > 0 {
+		p.pids = make(map[uint16]bool, len(pids))
+		for _, pid := range pids {
+			p.pids[pid] = true
+		}
+	}
+
+	return p, nil
+}
+
+// true iff the TS packet belongs to the packetized PIDs, or the program tables
+// that describe them.
+func (p *Packetizer) selects(pkt media.TSPacket) bool {
+	if excluded := p.excluded.Load(); excluded != nil && (*excluded)[pkt.PID()] {
+		return false
+	}
+
+	if p.pids == nil {
+		return true
+	}
+
+	return p.pids[pkt.PID()] || p.isTable(pkt.PID())
+}
+
+func (p *Packetizer) isTable(pid uint16) bool {
+	return pid == media.PATPID || p.pmtPIDs[pid]
+}
+
+// follows the program tables through a TS packet
+func (p *Packetizer) noteTables(pkt media.TSPacket) {
+	if pmts, ok := pkt.ProgramMapPIDs(); ok {
+		for _, pid := range pmts {
+			p.pmtPIDs[pid] = true
+		}
+	}
+
+	if p.isTable(pkt.PID()) && pkt.PayloadUnitStart() {
+		p.tables[pkt.PID()] = pkt
+	}
+}
+
+// Reset discards any buffered input and continues reading from r, which is
+// positioned at the seek point. The zero SeekPoint is the start of the media.
+func (p *Packetizer) Reset(r io.Reader, point media.SeekPoint) {
+	p.reader.Reset(r)
+	p.resetClock(point)
+	p.discontinuous = true
+}
+
+func (p *Packetizer) resetClock(point media.SeekPoint) {
+	ticksPerPacket := p.clock.ticksPerPacket
+	elapsed := uint64(point.Time * media.TSClockRate)
+
+	p.clock = pcrClock{
+		elapsed:        elapsed,
+		lastPCR:        point.PCR,
+		hasPCR:         point != media.SeekPoint{},
+		ticksPerPacket: ticksPerPacket,
+		now:            elapsed,
+	}
+}
+
+// Exclude stops packetizing the TS packets of the given PIDs, in place of any
+// excluded before. It is safe to call while packets are read.
+func (p *Packetizer) Exclude(pids ...uint16) {
+	excluded := make(map[uint16]bool, len(pids))
+	for _, pid := range pids {
+		excluded[pid] = true
+	}
+
+	p.excluded.Store(&excluded)
+}
+
+func (p *Packetizer) SSRC() uint32 {
+	return p.ssrc
+}
+
+// NPT returns the normal play time, in seconds, of the last TS packet read.
+func (p *Packetizer) NPT() float64 {
+	return float64(p.clock.now) / media.TSClockRate
+}
+
+// RTPTime returns the RTP timestamp of the last TS packet read.
+func (p *Packetizer) RTPTime() uint32 {
+	return p.rtpTime(p.clock.now)
+}
+
+func (p *Packetizer) rtpTime(ticks uint64) uint32 {
+	return p.timestamp + uint32(ticks)
+}
+
+// discards bytes until the reader is at a sync byte, which is followed by
+// another sync byte one packet later when that much input is available.
+func (p *Packetizer) resync() error {
+	for {
+		b, err := p.reader.Peek(media.TSPacketSize + 1)
+		if len(b) == 0 {
+			return err
+		}
+
+		if b[0] == media.TSSyncByte && (len(b) <= media.TSPacketSize || b[media.TSPacketSize] == media.TSSyncByte) {
+			return nil
+		}
+
+		if _, err := p.reader.Discard(1); err != nil {
+			return err
+		}
+	}
+}
+
+// Next reads up to 7 TS packets into the payload of an RTP packet. The
+// sequence number is left for the sender to assign. The marker bit is set on
+// the first packet after a discontinuity of the timestamps (RFC2250-2.1).
+// Returns io.EOF once the source holds no more whole TS packets.
+func (p *Packetizer) Next() (rtp.Packet, error) {
+	payload := make([]byte, 0, media.TSPacketSize*tsPacketsPerRTP)
+	var start uint64
+
+	for len(payload) < cap(payload) {
+		if err := p.resync(); err != nil {
+			if len(payload) > 0 && errors.Is(err, io.EOF) {
+				break
+			}
+			return rtp.Packet{}, err
+		}
+
+		pkt := make(media.TSPacket, media.TSPacketSize)
+		if _, err := io.ReadFull(p.reader, pkt); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			if len(payload) > 0 && errors.Is(err, io.EOF) {
+				break
+			}
+			return rtp.Packet{}, err
+		}
+
+		// the clock runs on every PCR, even of packets that are not selected
+		t := p.clock.advance(pkt)
+		p.noteTables(pkt)
+
+		if !p.selects(pkt) {
+			continue
+		}
+
+		if len(payload) == 0 {
+			start = t
+		}
+
+		payload = append(payload, pkt...)
+	}
+
+	return p.packet(payload, start), nil
+}
+
+// Keyframe packetizes just the keyframe at the seek point, for trick play. r
+// must be positioned at the keyframe. The TS packets of its PID are read up to
+// the start of the next frame, and sent after the latest program tables so
+// that the keyframe can be decoded on its own. Every packet has the timestamp
+// of `ticks` on the media timeline of Next. Returns no packets if the keyframe
+// does not belong to one of the given PIDs.
+func (p *Packetizer) Keyframe(r io.Reader, point media.SeekPoint, pids map[uint16]bool, ticks uint64) ([]rtp.Packet, error) {
+	p.reader.Reset(r)
+	p.resetClock(point)
+
+	var frame []byte
+	var pid uint16
+
+	for n := 0; n < maxKeyframePackets; n++ {
+		if err := p.resync(); err != nil {
+			if len(frame) > 0 && errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		pkt := make(media.TSPacket, media.TSPacketSize)
+		if _, err := io.ReadFull(p.reader, pkt); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			if len(frame) > 0 && errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		p.clock.advance(pkt)
+		p.noteTables(pkt)
+
+		if len(frame) == 0 {
+			if !pkt.RandomAccess() || !pids[pkt.PID()] || !p.selects(pkt) {
+				return nil, nil
+			}
+			pid = pkt.PID()
+		} else if pkt.PID() != pid {
+			continue
+		} else if pkt.PayloadUnitStart() {
+			break
+		}
+
+		frame = append(frame, pkt...)
+	}
+
+	var data []byte
+
+	for _, tablePID := range slices.Sorted(maps.Keys(p.tables)) {
+		if table := p.tables[tablePID]; p.selects(table) {
+			data = append(data, table...)
+		}
+	}
+
+	data = append(data, frame...)
+
+	var packets []rtp.Packet
+
+	for len(data) > 0 {
+		n := min(len(data), media.TSPacketSize*tsPacketsPerRTP)
+		packets = append(packets, p.packet(data[:n], ticks))
+		data = data[n:]
+	}
+
+	return packets, nil
+}
+
+// returns an RTP packet of the payload, timed at `ticks` on the media timeline
+func (p *Packetizer) packet(payload []byte, ticks uint64) rtp.Packet {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			Marker:      p.discontinuous,
+			PayloadType: mp2tPayloadType,
+			Timestamp:   p.rtpTime(ticks),
+			SSRC:        p.ssrc,
+		},
+		Payload: payload,
+	}
+
+	p.discontinuous = false
+	return packet
+}
+
+// unwraps the 32 bit RTP timestamps of a stream into a media timeline, to pace
+// the stream on.
+type rtpTimeline struct {
+	started   bool
+	timestamp uint32
+	ticks     int64 // 90kHz ticks since the first packet
+}
+
+func (l *rtpTimeline) advance(timestamp uint32) time.Duration {
+	if l.started {
+		l.ticks += int64(int32(timestamp - l.timestamp))
+	}
+
+	l.started, l.timestamp = true, timestamp
+
+	return time.Duration(float64(l.ticks) * float64(time.Second) / media.TSClockRate)
+}
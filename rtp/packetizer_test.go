@@ -0,0 +1,254 @@
+package rtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/rebeljah/picast/media"
+)
+
+// returns a TS packet of the PID, with a PCR unless pcr is negative
+func testTSPacket(pid uint16, pcr int64) []byte {
+	pkt := make([]byte, media.TSPacketSize)
+	pkt[0] = media.TSSyncByte
+	pkt[1] = byte(pid>>8) & 0x1F
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 // payload only
+
+	if pcr >= 0 {
+		base := uint64(pcr)
+
+		pkt[3] |= 0x20
+		pkt[4] = 7    // adaptation field length
+		pkt[5] = 0x10 // PCR flag
+		copy(pkt[6:], []byte{byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base<<7) | 0x7E, 0})
+	}
+
+	return pkt
+}
+
+// reads every RTP packet of the packetizer
+func packetizeAll(t *testing.T, p *Packetizer) []rtp.Packet {
+	t.Helper()
+
+	var packets []rtp.Packet
+
+	for {
+		packet, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packets = append(packets, packet)
+	}
+}
+
+// returns the PIDs of the TS packets in an RTP payload, checking that it holds
+// a whole number of them
+func payloadPIDs(t *testing.T, payload []byte) []uint16 {
+	t.Helper()
+
+	if len(payload)%media.TSPacketSize != 0 {
+		t.Fatalf("payload of %d bytes is not whole TS packets", len(payload))
+	}
+
+	var pids []uint16
+	for i := 0; i < len(payload); i += media.TSPacketSize {
+		pkt := media.TSPacket(payload[i : i+media.TSPacketSize])
+		if !pkt.Valid() {
+			t.Fatalf("TS packet %d of the payload is out of sync", i/media.TSPacketSize)
+		}
+
+		pids = append(pids, pkt.PID())
+	}
+
+	return pids
+}
+
+func TestPacketizerPacketsPerRTP(t *testing.T) {
+	var ts []byte
+	for range 15 {
+		ts = append(ts, testTSPacket(0x100, -1)...)
+	}
+
+	p, err := NewPacketizer(bytes.NewReader(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := packetizeAll(t, p)
+
+	var got []int
+	for _, packet := range packets {
+		got = append(got, len(payloadPIDs(t, packet.Payload)))
+
+		if packet.PayloadType != mp2tPayloadType || packet.SSRC != p.SSRC() {
+			t.Errorf("got payload type %d and SSRC %x, want %d and %x", packet.PayloadType, packet.SSRC, mp2tPayloadType, p.SSRC())
+		}
+	}
+
+	if want := []int{7, 7, 1}; !slices.Equal(got, want) {
+		t.Fatalf("got RTP packets of %v TS packets, want %v", got, want)
+	}
+}
+
+func TestPacketizerResync(t *testing.T) {
+	var ts []byte
+	ts = append(ts, "junk"...)
+	ts = append(ts, testTSPacket(0x100, -1)...)
+	ts = append(ts, testTSPacket(0x101, -1)...)
+	ts = append(ts, 0x47, 0x00, 0x47) // sync bytes that are not followed by a packet
+	ts = append(ts, testTSPacket(0x102, -1)...)
+	ts = append(ts, testTSPacket(0x103, -1)[:100]...) // cut short
+
+	p, err := NewPacketizer(bytes.NewReader(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := packetizeAll(t, p)
+	if len(packets) != 1 {
+		t.Fatalf("got %d RTP packets, want 1", len(packets))
+	}
+
+	if got, want := payloadPIDs(t, packets[0].Payload), []uint16{0x100, 0x101, 0x102}; !slices.Equal(got, want) {
+		t.Fatalf("got TS packets of PIDs %x, want %x", got, want)
+	}
+}
+
+func TestPacketizerPIDs(t *testing.T) {
+	var ts bytes.Buffer
+
+	muxer, err := media.NewTSMuxer(&ts, media.StreamTypeH264, media.StreamTypeAAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range uint64(4) {
+		if err := muxer.WriteAccessUnit(0, i*3000, i*3000, i == 0, make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := muxer.WriteAccessUnit(1, i*3000, i*3000, true, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	audio := muxer.PID(1)
+
+	p, err := NewPacketizer(&ts, audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the PMT is found through the PAT
+	want := map[uint16]bool{media.PATPID: true, 0x1000: true, audio: true}
+	got := make(map[uint16]bool)
+
+	for _, packet := range packetizeAll(t, p) {
+		for _, pid := range payloadPIDs(t, packet.Payload) {
+			if !want[pid] {
+				t.Fatalf("packetized TS packet of PID %#x, want only %#x and the program tables", pid, audio)
+			}
+			got[pid] = true
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("packetized PIDs %v, want %v", got, want)
+	}
+}
+
+func TestPacketizerMarksDiscontinuity(t *testing.T) {
+	var ts []byte
+	for range 14 {
+		ts = append(ts, testTSPacket(0x100, -1)...)
+	}
+
+	p, err := NewPacketizer(bytes.NewReader(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var markers []bool
+	for range 2 {
+		packet, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		markers = append(markers, packet.Marker)
+	}
+
+	p.Reset(bytes.NewReader(ts), media.SeekPoint{})
+
+	for range 2 {
+		packet, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		markers = append(markers, packet.Marker)
+	}
+
+	if want := []bool{false, false, true, false}; !slices.Equal(markers, want) {
+		t.Fatalf("got markers %v, want %v", markers, want)
+	}
+}
+
+func TestPacketizerTimestamps(t *testing.T) {
+	tests := []struct {
+		name string
+		pcrs []int64 // of the first of each 7 TS packets
+		want []uint64
+	}{
+		{"PCRs", []int64{1000, 4000, 7000}, []uint64{0, 3000, 6000}},
+		{"PCR wrap", []int64{int64(media.TSClockWrap) - 1000, 2000, 5000}, []uint64{0, 3000, 6000}},
+		{"PCR jump", []int64{1000, 1000 + 20*media.TSClockRate, 1000 + 20*media.TSClockRate + 3000}, []uint64{0, 0, 3000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ts []byte
+			for _, pcr := range tt.pcrs {
+				ts = append(ts, testTSPacket(0x100, pcr)...)
+				for range tsPacketsPerRTP - 1 {
+					ts = append(ts, testTSPacket(0x100, -1)...)
+				}
+			}
+
+			p, err := NewPacketizer(bytes.NewReader(ts))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the RTP timestamps wrap past 32 bits along the way
+			p.timestamp = 0xFFFFFFFF - 2000
+
+			packets := packetizeAll(t, p)
+			if len(packets) != len(tt.want) {
+				t.Fatalf("got %d RTP packets, want %d", len(packets), len(tt.want))
+			}
+
+			for i, packet := range packets {
+				// the 90kHz PCR is the RTP clock, from a random offset
+				if got := packet.Timestamp - packets[0].Timestamp; uint64(got) != tt.want[i] {
+					t.Errorf("RTP packet %d at %d ticks, want %d", i, got, tt.want[i])
+				}
+			}
+
+			// the TS packets after the last PCR are timed at the rate between
+			// the last two
+			last, step := tt.want[len(tt.want)-1], tt.want[len(tt.want)-1]-tt.want[len(tt.want)-2]
+			wantNPT := (float64(last) + float64(tsPacketsPerRTP-1)*float64(step)/tsPacketsPerRTP) / media.TSClockRate
+
+			if npt := p.NPT(); npt < wantNPT-0.0001 || npt > wantNPT+0.0001 {
+				t.Errorf("NPT %v after the last TS packet, want %v", npt, wantNPT)
+			}
+		})
+	}
+}
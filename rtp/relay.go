@@ -0,0 +1,267 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/rebeljah/picast/rtsp"
+)
+
+// Relay sends one track of a stream that the RTSP server relays from upstream
+// to a client. Packets are sent as they come, with the SSRC, sequence numbers
+// and timestamps of the upstream, and dropped while the stream is paused.
+type Relay struct {
+	id            rtsp.StreamUID
+	transportInfo rtsp.TransportInfo
+	packets       <-chan rtsp.Packet
+	raddr         net.Addr     // the client
+	rtpConn       *net.UDPConn // bound to the server RTP port, for UDP transports
+	rtcpConn      *net.UDPConn // bound to the server RTCP port, for UDP transports
+	rtspConn      rtsp.InterleavedConn
+	stop          chan struct{}
+	teardownOnce  sync.Once
+
+	playing     atomic.Bool
+	packetsSent atomic.Uint32
+	octetsSent  atomic.Uint32
+	ssrc        atomic.Uint32 // of the last packet sent
+
+	statsLock     sync.Mutex
+	stats         rtsp.StreamStats // from the receiver reports of the client
+	bitrateSample bitrateSample
+}
+
+type relays map[rtsp.StreamUID]*Relay
+
+func (rl *Relay) teardown() {
+	rl.teardownOnce.Do(func() {
+		close(rl.stop)
+	})
+}
+
+// opens the writers of RTP and RTCP, and the reader of the client's RTCP. UDP
+// transports use the server port pair bound at setup, while interleaved
+// transports use the channel pair of the RTSP connection.
+func (rl *Relay) openTransport() (io.WriteCloser, io.ReadWriteCloser, error) {
+	if rl.transportInfo.IsInterleaved() {
+		if rl.rtspConn == nil {
+			return nil, nil, errors.New("interleaved transport without an RTSP connection")
+		}
+
+		channel := uint8(rl.transportInfo.InterleavedEnd)
+
+		return nopWriteCloser{rl.rtspConn.ChannelWriter(uint8(rl.transportInfo.InterleavedStart))},
+			interleavedChannel{
+				Writer:     rl.rtspConn.ChannelWriter(channel),
+				ReadCloser: rl.rtspConn.ChannelReader(channel),
+			}, nil
+	}
+
+	return rl.rtpConn, rl.rtcpConn, nil
+}
+
+func (rl *Relay) statistics() rtsp.StreamStats {
+	now := time.Now()
+	octets := rl.octetsSent.Load()
+
+	rl.statsLock.Lock()
+
+	// the bitrate is measured over the time since the last sample, as for streams
+	if elapsed := now.Sub(rl.bitrateSample.at); elapsed >= bitrateSampleInterval {
+		if !rl.bitrateSample.at.IsZero() {
+			rl.stats.Bitrate = float64(octets-rl.bitrateSample.octets) * 8 / elapsed.Seconds()
+		}
+		rl.bitrateSample = bitrateSample{at: now, octets: octets}
+	}
+
+	stats := rl.stats
+	rl.statsLock.Unlock()
+
+	stats.SSRC = rl.ssrc.Load()
+	stats.PacketsSent = rl.packetsSent.Load()
+	stats.OctetsSent = octets
+
+	return stats
+}
+
+// SetupRelay prepares to send a track of a relayed stream to the client, which
+// begins on PlayStream.
+func (s *Server) SetupRelay(args rtsp.RelayArguments) (rtsp.TransportInfo, error) {
+	log.Printf(
+		"setting up RTP relay to: %v with stream id: %v",
+		args.RAddr, args.StreamID,
+	)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.relays[args.StreamID]; ok {
+		return rtsp.TransportInfo{}, fmt.Errorf("relay already exists with ID: %s", args.StreamID)
+	}
+
+	if args.Packets == nil {
+		return rtsp.TransportInfo{}, fmt.Errorf("relay %s has no packets", args.StreamID)
+	}
+
+	selectedTransport, err := negotiateTransport(args.AcceptableTransports, args.RAddr, args.Conn, rtsp.PLAY)
+	if err != nil {
+		return rtsp.TransportInfo{}, err
+	}
+
+	var rtpConn, rtcpConn *net.UDPConn
+	if !selectedTransport.IsInterleaved() {
+		rtpAddr, rtcpAddr, err := clientUDPAddrs(args.RAddr, selectedTransport)
+		if err != nil {
+			return rtsp.TransportInfo{}, err
+		}
+
+		if rtpConn, rtcpConn, err = s.allocatePorts(rtpAddr, rtcpAddr); err != nil {
+			return rtsp.TransportInfo{}, err
+		}
+
+		selectedTransport.ServerPortStart = rtpConn.LocalAddr().(*net.UDPAddr).Port
+		selectedTransport.ServerPortEnd = rtcpConn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	relay := &Relay{
+		id:            args.StreamID,
+		transportInfo: selectedTransport,
+		packets:       args.Packets,
+		raddr:         args.RAddr,
+		rtpConn:       rtpConn,
+		rtcpConn:      rtcpConn,
+		stop:          make(chan struct{}),
+	}
+
+	if selectedTransport.IsInterleaved() {
+		relay.rtspConn = args.Conn
+	}
+
+	s.relays[args.StreamID] = relay
+
+	go s.relayTrack(relay)
+
+	return selectedTransport, nil
+}
+
+// sends the packets of the track while playing, until the relay is torn down
+// or the packets end.
+func (s *Server) relayTrack(relay *Relay) {
+	defer log.Printf("RTP relay with id: %v to: %v torn down\n", relay.id, relay.raddr)
+	defer s.teardownRelay(relay)
+
+	rtpConn, rtcpConn, err := relay.openTransport()
+	if err != nil {
+		log.Printf("RTP server failed to open %v transport to: %v: %v", relay.transportInfo.LowerTransport, relay.raddr, err)
+		return
+	}
+	defer rtpConn.Close()
+	defer rtcpConn.Close()
+
+	go relay.readRTCP(rtcpConn)
+
+	for {
+		select {
+		case <-relay.stop:
+			return
+		case p, ok := <-relay.packets:
+			if !ok {
+				return
+			}
+
+			if !relay.playing.Load() {
+				continue
+			}
+
+			w := rtpConn
+			if p.RTCP {
+				w = rtcpConn
+			}
+
+			if _, err := w.Write(p.Data); droppedWrite(err) {
+				continue
+			} else if err != nil {
+				return
+			}
+
+			if !p.RTCP && len(p.Data) >= 12 {
+				relay.packetsSent.Add(1)
+				relay.octetsSent.Add(uint32(len(p.Data) - 12))
+				relay.ssrc.Store(binary.BigEndian.Uint32(p.Data[8:12]))
+			}
+		}
+	}
+}
+
+// reads the receiver reports of the client into the stats, until the
+// transport is closed. The reports are of the upstream sources, and are not
+// passed on.
+func (rl *Relay) readRTCP(r io.Reader) {
+	buf := make([]byte, rtcpReadBufferSize)
+
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// e.g. an ICMP port unreachable from a client that is not listening yet
+			continue
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			log.Printf("RTP relay %v received invalid RTCP: %v", rl.id, err)
+			continue
+		}
+
+		for _, packet := range packets {
+			rr, ok := packet.(*rtcp.ReceiverReport)
+			if !ok {
+				continue
+			}
+
+			rl.statsLock.Lock()
+			rl.stats.HasReceiverReport = true
+			rl.stats.ReportedAt = time.Now()
+
+			if len(rr.Reports) > 0 {
+				rl.stats.FractionLost = float64(rr.Reports[0].FractionLost) / 256
+				rl.stats.TotalLost = rr.Reports[0].TotalLost
+			}
+			rl.statsLock.Unlock()
+		}
+	}
+}
+
+func (s *Server) teardownRelay(relay *Relay) {
+	if relay == nil {
+		return
+	}
+
+	relay.teardown()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.relays[relay.id] == relay {
+		delete(s.relays, relay.id)
+	}
+}
+
+func (s *Server) getRelay(uid rtsp.StreamUID) (*Relay, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	relay, ok := s.relays[uid]
+	return relay, ok
+}
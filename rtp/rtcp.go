@@ -0,0 +1,232 @@
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtsp"
+)
+
+const (
+	// the minimum interval between RTCP reports (RFC3550-6.2)
+	senderReportInterval = 5 * time.Second
+
+	rtcpReadBufferSize = 1500
+
+	// seconds from the NTP epoch (1900) to the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+// returns t as a 64 bit NTP timestamp, 32.32 fixed point seconds since 1900
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// returns the middle 32 bits of an NTP timestamp, the format used by the LSR
+// and DLSR fields of reception reports, in units of 1/65536 seconds.
+func compactNTPTime(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
+
+func compactNTPDuration(d uint32) time.Duration {
+	return time.Duration(d) * time.Second / 65536
+}
+
+// an interleaved channel pair, read and written as one RTCP transport
+type interleavedChannel struct {
+	io.Writer
+	io.ReadCloser
+}
+
+// opens the transport of RTCP, on the odd port or channel of the pair that
+// carries RTP.
+func (s *Stream) openRTCPTransport() (io.ReadWriteCloser, error) {
+	if s.transportInfo.IsInterleaved() {
+		if s.rtspConn == nil {
+			return nil, errors.New("interleaved transport without an RTSP connection")
+		}
+
+		channel := uint8(s.transportInfo.InterleavedEnd)
+
+		return interleavedChannel{
+			Writer:     s.rtspConn.ChannelWriter(channel),
+			ReadCloser: s.rtspConn.ChannelReader(channel),
+		}, nil
+	}
+
+	return s.rtcpConn, nil
+}
+
+// sends a sender report every interval, and reads the receiver reports of the
+// client, until the stream is stopped. The stream says goodbye on its way out.
+func (s *Stream) serveRTCP() {
+	conn, err := s.openRTCPTransport()
+	if err != nil {
+		log.Printf("RTP stream %v failed to open RTCP transport: %v", s.id, err)
+		return
+	}
+	defer conn.Close()
+
+	go s.readRTCP(conn)
+
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.writeRTCP(conn, &rtcp.Goodbye{Sources: []uint32{s.ssrc}})
+			return
+		case <-ticker.C:
+			// nothing to report until the first packet is sent
+			if s.packetsSent.Load() == 0 {
+				continue
+			}
+
+			s.writeRTCP(conn)
+		}
+	}
+}
+
+// writes a compound packet, which begins with a sender report and SDES as
+// every compound packet must (RFC3550-6.1), followed by any extra packets.
+func (s *Stream) writeRTCP(w io.Writer, extra ...rtcp.Packet) {
+	packets := []rtcp.Packet{
+		s.senderReport(time.Now()),
+		&rtcp.SourceDescription{
+			Chunks: []rtcp.SourceDescriptionChunk{{
+				Source: s.ssrc,
+				Items: []rtcp.SourceDescriptionItem{{
+					Type: rtcp.SDESCNAME,
+					Text: fmt.Sprintf("picast-%s", s.id),
+				}},
+			}},
+		},
+	}
+
+	b, err := rtcp.Marshal(append(packets, extra...))
+	if err != nil {
+		log.Printf("RTP stream %v failed to marshal RTCP: %v", s.id, err)
+		return
+	}
+
+	if _, err := w.Write(b); err != nil {
+		log.Printf("RTP stream %v RTCP write error: %v", s.id, err)
+	}
+}
+
+// maps the wall clock time `now` to the RTP clock, extrapolating from the
+// last packet sent (RFC3550-6.4.1).
+func (s *Stream) senderReport(now time.Time) *rtcp.SenderReport {
+	rtpTime := s.lastTime.Load()
+
+	if sentAt := s.lastSentAt.Load(); sentAt != 0 {
+		elapsed := now.Sub(time.Unix(0, sentAt))
+		rtpTime += uint32(elapsed.Seconds() * media.TSClockRate)
+	}
+
+	return &rtcp.SenderReport{
+		SSRC:        s.ssrc,
+		NTPTime:     toNTPTime(now),
+		RTPTime:     rtpTime,
+		PacketCount: s.packetsSent.Load(),
+		OctetCount:  s.octetsSent.Load(),
+	}
+}
+
+// reads RTCP from the client into the stream stats until the transport is
+// closed.
+func (s *Stream) readRTCP(r io.Reader) {
+	buf := make([]byte, rtcpReadBufferSize)
+
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// e.g. an ICMP port unreachable from a client that is not listening yet
+			continue
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			log.Printf("RTP stream %v received invalid RTCP: %v", s.id, err)
+			continue
+		}
+
+		now := time.Now()
+
+		for _, packet := range packets {
+			var reports []rtcp.ReceptionReport
+
+			switch p := packet.(type) {
+			case *rtcp.ReceiverReport:
+				reports = p.Reports
+			case *rtcp.SenderReport:
+				reports = p.Reports
+			}
+
+			for _, report := range reports {
+				if report.SSRC == s.ssrc {
+					s.updateStats(report, now)
+				}
+			}
+		}
+	}
+}
+
+func (s *Stream) updateStats(report rtcp.ReceptionReport, now time.Time) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	s.stats.HasReceiverReport = true
+	s.stats.ReportedAt = now
+	s.stats.FractionLost = float64(report.FractionLost) / 256
+	s.stats.TotalLost = report.TotalLost
+	s.stats.Jitter = time.Duration(float64(report.Jitter) / media.TSClockRate * float64(time.Second))
+
+	// the client echoes the time of our last sender report, and how long it
+	// held it before reporting (RFC3550-6.4.1)
+	if report.LastSenderReport != 0 {
+		rtt := compactNTPTime(toNTPTime(now)) - report.LastSenderReport - report.Delay
+		if int32(rtt) >= 0 {
+			s.stats.RTT = compactNTPDuration(rtt)
+		}
+	}
+}
+
+func (s *Stream) statistics() rtsp.StreamStats {
+	now := time.Now()
+	octets := s.octetsSent.Load()
+
+	s.statsLock.Lock()
+
+	// the bitrate is measured over the time since the last sample
+	if elapsed := now.Sub(s.bitrateSample.at); elapsed >= bitrateSampleInterval {
+		if !s.bitrateSample.at.IsZero() {
+			s.stats.Bitrate = float64(octets-s.bitrateSample.octets) * 8 / elapsed.Seconds()
+		}
+		s.bitrateSample = bitrateSample{at: now, octets: octets}
+	}
+
+	stats := s.stats
+	s.statsLock.Unlock()
+
+	stats.SSRC = s.ssrc
+	stats.PacketsSent = s.packetsSent.Load()
+	stats.OctetsSent = octets
+	stats.Position = math.Float64frombits(s.lastNPT.Load())
+
+	return stats
+}
@@ -0,0 +1,106 @@
+package rtp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/rebeljah/picast/media"
+)
+
+func TestWriteRTCP(t *testing.T) {
+	s := &Stream{id: "abc", ssrc: 0xCAFE}
+	s.packetsSent.Store(10)
+	s.octetsSent.Store(13160)
+	s.lastTime.Store(5000)
+	s.lastSentAt.Store(time.Now().Add(-time.Second).UnixNano())
+
+	var buf bytes.Buffer
+	s.writeRTCP(&buf, &rtcp.Goodbye{Sources: []uint32{s.ssrc}})
+
+	packets, err := rtcp.Unmarshal(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packets) != 3 {
+		t.Fatalf("got %d packets, want SR, SDES and BYE: %v", len(packets), packets)
+	}
+
+	sr, ok := packets[0].(*rtcp.SenderReport)
+	if !ok {
+		t.Fatalf("got %T first, want a sender report", packets[0])
+	}
+
+	if sr.SSRC != s.ssrc || sr.PacketCount != 10 || sr.OctetCount != 13160 {
+		t.Errorf("got sender report %+v", sr)
+	}
+
+	// the RTP clock of the report is extrapolated from the last packet sent
+	if elapsed := sr.RTPTime - 5000; elapsed < media.TSClockRate || elapsed > media.TSClockRate*11/10 {
+		t.Errorf("sender report at %d RTP ticks after the last packet, want a second", elapsed)
+	}
+
+	if ntp := time.Unix(int64(sr.NTPTime>>32)-ntpEpochOffset, 0); time.Since(ntp).Abs() > 2*time.Second {
+		t.Errorf("sender report at NTP time %v, want now", ntp)
+	}
+
+	sdes, ok := packets[1].(*rtcp.SourceDescription)
+	if !ok || len(sdes.Chunks) != 1 || sdes.Chunks[0].Source != s.ssrc {
+		t.Fatalf("got %v second, want the SDES of the stream", packets[1])
+	}
+
+	if items := sdes.Chunks[0].Items; len(items) != 1 || items[0].Type != rtcp.SDESCNAME || items[0].Text != "picast-abc" {
+		t.Errorf("got SDES items %+v, want the CNAME", items)
+	}
+
+	if bye, ok := packets[2].(*rtcp.Goodbye); !ok || len(bye.Sources) != 1 || bye.Sources[0] != s.ssrc {
+		t.Errorf("got %v last, want the BYE of the stream", packets[2])
+	}
+}
+
+func TestReadReceiverReport(t *testing.T) {
+	s := &Stream{id: "abc", ssrc: 0xCAFE}
+
+	// the client got our sender report 300ms ago, and held it for 100ms
+	lsr := compactNTPTime(toNTPTime(time.Now().Add(-300 * time.Millisecond)))
+	dlsr := uint32(65536 / 10)
+
+	b, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{
+			{SSRC: 0xBEEF, FractionLost: 255}, // of another stream
+			{
+				SSRC:             s.ssrc,
+				FractionLost:     64,
+				TotalLost:        3,
+				Jitter:           900,
+				LastSenderReport: lsr,
+				Delay:            dlsr,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.readRTCP(bytes.NewReader(b))
+
+	stats := s.statistics()
+
+	if !stats.HasReceiverReport || time.Since(stats.ReportedAt) > time.Second {
+		t.Fatalf("the receiver report was not read: %+v", stats)
+	}
+
+	if stats.FractionLost != 0.25 || stats.TotalLost != 3 {
+		t.Errorf("got loss %v and %d lost, want 0.25 and 3", stats.FractionLost, stats.TotalLost)
+	}
+
+	if stats.Jitter != 10*time.Millisecond {
+		t.Errorf("got jitter %v, want 10ms", stats.Jitter)
+	}
+
+	if stats.RTT < 190*time.Millisecond || stats.RTT > 250*time.Millisecond {
+		t.Errorf("got RTT %v, want 200ms", stats.RTT)
+	}
+}
@@ -1,54 +1,335 @@
 package rtp
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"maps"
+	"math"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/pion/rtp"
+	"github.com/rebeljah/picast/media"
 	"github.com/rebeljah/picast/rtsp"
+	"github.com/rebeljah/picast/util/bpipes"
+	"golang.org/x/time/rate"
 	"gopkg.in/vansante/go-ffprobe.v2"
 )
 
+const (
+	packetsOutBufSize = 64
+
+	// the largest RTP packet sent, a header and 7 TS packets
+	maxRTPPacketSize = 12 + tsPacketsPerRTP*media.TSPacketSize
+
+	// how often the send bitrate is measured at most
+	bitrateSampleInterval = time.Second
+)
+
+var ErrNoSuchStream = errors.New("no such stream")
+var ErrNotSeekable = errors.New("stream source is not seekable")
+
+// an RTP packet on its way through a stream's send pipeline
+type outPacket struct {
+	rtp.Packet
+	epoch uint32  // packets from before the latest seek are stale
+	npt   float64 // normal play time of the packet, in seconds
+}
+
+type seekRequest struct {
+	start float64
+	scale float64
+	reply chan seekReply
+}
+
+type seekReply struct {
+	info rtsp.PlayInfo
+	err  error
+}
+
 type Stream struct {
 	id            rtsp.StreamUID
+	track         rtsp.TrackID
 	transportInfo rtsp.TransportInfo
 	structureInfo ffprobe.ProbeData
+	source        media.Source
+	packetizer    *Packetizer // only accessed by the source reader
+	trick         *trickPlay  // only accessed by the source reader, nil in normal play
+	scale         float64     // of the last PLAY, which RTSP sends one at a time
+	seekIndex     *media.SeekIndex
+	seeks         chan seekRequest
 	stop          chan struct{}
-	packetsOut    chan rtp.Packet
-	raddr         *net.UDPAddr
+	packetsOut    chan outPacket // head of the send pipeline, closed by the source reader
+	pauser        *bpipes.PauserStage
+	pacer         *bpipes.PacerStage
+	sendLimiter   *rate.Limiter // bytes per second, unlimited unless capped
+	raddr         net.Addr      // the client
+	rtpConn       *net.UDPConn  // bound to the server RTP port, for UDP transports
+	rtcpConn      *net.UDPConn  // bound to the server RTCP port, for UDP transports
+	ssrc          uint32
+	rtspConn      rtsp.InterleavedConn // set iff the transport is interleaved
+	teardownOnce  sync.Once
+
+	epoch   atomic.Uint32 // incremented by the source reader on every seek
+	nextSeq atomic.Uint32 // sequence number of the next packet sent
+
+	// where the last packet sent was in the media
+	lastNPT    atomic.Uint64 // math.Float64bits of the npt
+	lastTime   atomic.Uint32 // RTP timestamp
+	lastSentAt atomic.Int64  // unix nanoseconds
+
+	packetsSent atomic.Uint32
+	octetsSent  atomic.Uint32
+
+	statsLock     sync.Mutex
+	stats         rtsp.StreamStats // from the receiver reports of the client
+	bitrateSample bitrateSample
 }
 
+// the octets sent at a point in time, to measure the send bitrate from
+type bitrateSample struct {
+	at     time.Time
+	octets uint32
+}
+
+// opens the writer that RTP packets are sent over. UDP transports send from the
+// server port pair bound at setup, while interleaved transports write into the
+// RTSP connection.
+func (s *Stream) openTransport() (io.WriteCloser, error) {
+	if s.transportInfo.IsInterleaved() {
+		if s.rtspConn == nil {
+			return nil, errors.New("interleaved transport without an RTSP connection")
+		}
+
+		w := s.rtspConn.ChannelWriter(uint8(s.transportInfo.InterleavedStart))
+		return nopWriteCloser{w}, nil
+	}
+
+	return s.rtpConn, nil
+}
+
+// the RTSP server owns the connection behind interleaved writers.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 func (s *Stream) teardown() {
-	close(s.packetsOut)
-	close(s.stop)
+	s.teardownOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// moves the source to the last keyframe at or before `start` and resets the
+// packetizer, to play on from there at the scale.
+func (s *Stream) seekSource(start, scale float64) (rtsp.PlayInfo, error) {
+	seeker, ok := s.source.(io.Seeker)
+	if !ok {
+		return rtsp.PlayInfo{}, ErrNotSeekable
+	}
+
+	point := media.SeekPoint{}
+
+	if s.seekIndex != nil {
+		var err error
+		if point, err = s.seekIndex.Lookup(start); err != nil {
+			return rtsp.PlayInfo{}, err
+		}
+	} else if start != 0 {
+		return rtsp.PlayInfo{}, ErrNotSeekable
+	}
+
+	var trick *trickPlay
+
+	if scale != 1 {
+		var err error
+		if trick, err = s.newTrickPlay(point, scale); err != nil {
+			return rtsp.PlayInfo{}, err
+		}
+	}
+
+	if _, err := seeker.Seek(point.Offset, io.SeekStart); err != nil {
+		return rtsp.PlayInfo{}, err
+	}
+
+	s.packetizer.Reset(s.source, point)
+	s.trick = trick
+
+	// everything still in the pipeline is from before the seek
+	s.epoch.Add(1)
+
+	return rtsp.PlayInfo{
+		Start:          s.packetizer.NPT(),
+		SequenceNumber: uint16(s.nextSeq.Load()),
+		RTPTime:        s.packetizer.RTPTime(),
+	}, nil
+}
+
+// reads the source into RTP packets and feeds them to the head of the send
+// pipeline until the stream is stopped. The read position is held while the
+// pipeline is paused because the pipeline stops pulling packets. Seeks are
+// handled between packets, and at the end of the source.
+func (s *Stream) readSource() {
+	defer close(s.packetsOut)
+	defer s.source.Close()
+
+	var atEnd bool
+
+	handleSeek := func(req seekRequest) {
+		info, err := s.seekSource(req.start, req.scale)
+		atEnd = atEnd && err != nil
+		req.reply <- seekReply{info: info, err: err}
+	}
+
+	for {
+		// wait for a seek back into the media once the end is reached
+		if atEnd {
+			select {
+			case req := <-s.seeks:
+				handleSeek(req)
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+
+		packet, err := s.nextPacket()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("RTP stream %v source read error: %v", s.id, err)
+			}
+			atEnd = true
+			continue
+		}
+
+		pkt := outPacket{
+			Packet: packet,
+			epoch:  s.epoch.Load(),
+			npt:    s.packetizer.NPT(),
+		}
+
+		select {
+		case s.packetsOut <- pkt:
+		case req := <-s.seeks:
+			handleSeek(req)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Stream) nextPacket() (rtp.Packet, error) {
+	if s.trick != nil {
+		return s.nextTrickPacket()
+	}
+
+	return s.packetizer.Next()
+}
+
+// returns the media time of packets in the send pipeline, to pace it in real
+// time. The timeline is discontinuous at the marked packet after a seek, and
+// stale packets are not paced so that they drain quickly.
+func (s *Stream) pacingTime() func(any) (time.Duration, bool) {
+	var timeline rtpTimeline
+
+	return func(data any) (time.Duration, bool) {
+		pkt := data.(outPacket)
+
+		if pkt.epoch != s.epoch.Load() {
+			return 0, true
+		}
+
+		return timeline.advance(pkt.Timestamp), pkt.Marker
+	}
+}
+
+// asks the source reader to seek, and waits for it to finish
+func (s *Stream) seek(start, scale float64) (rtsp.PlayInfo, error) {
+	req := seekRequest{start: start, scale: scale, reply: make(chan seekReply, 1)}
+
+	select {
+	case s.seeks <- req:
+	case <-s.stop:
+		return rtsp.PlayInfo{}, ErrNoSuchStream
+	}
+
+	reply := <-req.reply
+	return reply.info, reply.err
+}
+
+// where the stream will resume from, approximated by the last packet sent
+func (s *Stream) position() rtsp.PlayInfo {
+	return rtsp.PlayInfo{
+		Start:          math.Float64frombits(s.lastNPT.Load()),
+		SequenceNumber: uint16(s.nextSeq.Load()),
+		RTPTime:        s.lastTime.Load(),
+	}
 }
 
 type streams map[rtsp.StreamUID]*Stream
 
 // implements rtsp.RTPServer
 type Server struct {
+	sync.Mutex     // guards streams, ingests and relays
 	streams        streams
+	ingests        ingests
+	relays         relays
 	interruptCause chan error
 	interruptOnce  sync.Once
+	nextPortPair   atomic.Uint32
+
+	// the server ports that UDP streams are sent from
+	PortRange PortRange
 }
 
 func NewServer() *Server {
 	return &Server{
 		streams:        make(streams),
+		ingests:        make(ingests),
+		relays:         make(relays),
 		interruptCause: make(chan error, 1),
+		PortRange:      PortRange{Min: DefaultPortMin, Max: DefaultPortMax},
 	}
 }
 
+// sends the packets that make it through the stream's pipeline until the
+// stream is torn down.
 func (s *Server) streamTrack(stream *Stream) {
 	defer log.Printf("RTP stream with id: %v to: %v torn down\n", stream.id, stream.raddr)
 	defer s.teardownStream(stream)
 
-	conn, err := net.DialUDP("udp", nil, stream.raddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// interrupt waits in the send loop as soon as the stream is stopped
+	go func() {
+		select {
+		case <-stream.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go stream.readSource()
+
+	packets, pipelineErrs := bpipes.NewPipeline(ctx, stream.packetsOut, stream.pauser, stream.pacer)
+
+	go stream.serveRTCP()
+
+	conn, err := stream.openTransport()
 	if err != nil {
-		log.Printf("RTP server failed to dial udp: %v", stream.raddr)
+		log.Printf("RTP server failed to open %v transport to: %v: %v", stream.transportInfo.LowerTransport, stream.raddr, err)
 		return
 	}
 	defer conn.Close()
@@ -57,29 +338,84 @@ func (s *Server) streamTrack(stream *Stream) {
 		select {
 		case <-stream.stop:
 			return
-		case pkt := <-stream.packetsOut:
+		case err := <-pipelineErrs:
+			if !errors.Is(err, bpipes.ErrHeadClosed) {
+				log.Printf("RTP stream %v pipeline error: %v", stream.id, err)
+			}
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			// drop packets read before a seek
+			if pkt.epoch != stream.epoch.Load() {
+				continue
+			}
+
+			// sequence numbers are assigned on send so that they stay contiguous
+			// across seeks.
+			seq := stream.nextSeq.Add(1) - 1
+			pkt.SequenceNumber = uint16(seq)
+
+			stream.lastNPT.Store(math.Float64bits(pkt.npt))
+			stream.lastTime.Store(pkt.Timestamp)
+
 			b, err := pkt.Marshal()
 			if err != nil {
 				return
 			}
 
+			if err := stream.sendLimiter.WaitN(ctx, len(b)); err != nil {
+				return
+			}
+
 			_, err = conn.Write(b)
 
+			if droppedWrite(err) {
+				continue
+			}
+
 			if err != nil {
 				return
 			}
+
+			stream.packetsSent.Add(1)
+			stream.octetsSent.Add(uint32(len(pkt.Payload)))
+			stream.lastSentAt.Store(time.Now().UnixNano())
 		}
 	}
 }
 
+// reports whether a failed write only lost its packet. A UDP client that is
+// not listening on its port, e.g. before it has bound it or while it
+// restarts, makes the next write fail with ECONNREFUSED from the ICMP port
+// unreachable, which should not end the stream.
+func droppedWrite(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
 func (s *Server) Interrupt(err error) {
 	s.interruptOnce.Do(func() {
 		log.Printf("Interrupting RTP server: %v\n", err)
 
-		for v := range maps.Values(s.streams) {
+		s.Lock()
+		streams := slices.Collect(maps.Values(s.streams))
+		ingests := slices.Collect(maps.Values(s.ingests))
+		relays := slices.Collect(maps.Values(s.relays))
+		s.Unlock()
+
+		for _, v := range streams {
 			s.teardownStream(v)
 		}
 
+		for _, v := range ingests {
+			s.teardownIngest(v)
+		}
+
+		for _, v := range relays {
+			s.teardownRelay(v)
+		}
+
 		s.interruptCause <- err
 	})
 }
@@ -90,46 +426,151 @@ func (s *Server) SetupStream(args rtsp.SetupArguments) (rtsp.TransportInfo, erro
 		args.RAddr, args.StreamID,
 	)
 
+	s.Lock()
+	defer s.Unlock()
+
 	// Method SETUP not currently supported for a Ready / Playing track
 	// currently, SETUP only applies to an RTSP stream in the `Init` state
 	if _, ok := s.streams[args.StreamID]; ok {
 		return rtsp.TransportInfo{}, fmt.Errorf("stream already exists with ID: %s", args.StreamID)
 	}
 
-	clientUDPAddr, err := net.ResolveUDPAddr("udp", args.RAddr.String())
+	if args.Source == nil {
+		return rtsp.TransportInfo{}, fmt.Errorf("stream %s has no source", args.StreamID)
+	}
+
+	pids, err := trackPIDs(args.Spec, args.Track)
+	if err != nil {
+		return rtsp.TransportInfo{}, err
+	}
+
+	packetizer, err := NewPacketizer(args.Source, pids...)
 	if err != nil {
 		return rtsp.TransportInfo{}, err
 	}
 
-	selectedTransport := args.AcceptableTransports[0] // TODO: HACK! just selects most preferred without validation
+	initialSeq, err := randomUint32()
+	if err != nil {
+		return rtsp.TransportInfo{}, err
+	}
+
+	selectedTransport, err := negotiateTransport(args.AcceptableTransports, args.RAddr, args.Conn, rtsp.PLAY)
+	if err != nil {
+		return rtsp.TransportInfo{}, err
+	}
+
+	selectedTransport.SSRC, selectedTransport.HasSSRC = packetizer.SSRC(), true
+
+	var rtpConn, rtcpConn *net.UDPConn
+	if !selectedTransport.IsInterleaved() {
+		rtpAddr, rtcpAddr, err := clientUDPAddrs(args.RAddr, selectedTransport)
+		if err != nil {
+			return rtsp.TransportInfo{}, err
+		}
 
-	s.streams[args.StreamID] = &Stream{
+		if rtpConn, rtcpConn, err = s.allocatePorts(rtpAddr, rtcpAddr); err != nil {
+			return rtsp.TransportInfo{}, err
+		}
+
+		selectedTransport.ServerPortStart = rtpConn.LocalAddr().(*net.UDPAddr).Port
+		selectedTransport.ServerPortEnd = rtcpConn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	stream := &Stream{
 		id:            args.StreamID,
+		track:         args.Track,
 		transportInfo: selectedTransport,
 		structureInfo: args.Spec,
+		source:        args.Source,
+		packetizer:    packetizer,
+		seekIndex:     args.SeekIndex,
+		seeks:         make(chan seekRequest),
 		stop:          make(chan struct{}),
-		packetsOut:    make(chan rtp.Packet), // TODO buffer this channel?
-		raddr:         clientUDPAddr,
+		packetsOut:    make(chan outPacket, packetsOutBufSize),
+		pauser:        bpipes.NewPauserStage(), // streams begin paused until PLAY
+		sendLimiter:   rate.NewLimiter(rate.Inf, maxRTPPacketSize),
+		raddr:         args.RAddr,
+		rtpConn:       rtpConn,
+		rtcpConn:      rtcpConn,
+		ssrc:          packetizer.SSRC(),
+		scale:         1,
+	}
+
+	stream.pacer = bpipes.NewPacerStage(stream.pacingTime())
+	stream.nextSeq.Store(initialSeq)
+	stream.lastTime.Store(packetizer.RTPTime())
+
+	if selectedTransport.IsInterleaved() {
+		stream.rtspConn = args.Conn
 	}
 
-	go s.streamTrack(s.streams[args.StreamID])
+	s.streams[args.StreamID] = stream
+
+	go s.streamTrack(stream)
 
 	return selectedTransport, nil
 }
 
+// returns the PIDs that carry a track in the MPEG-TS, or none to stream every
+// track of the media. ffprobe identifies the streams of MPEG-TS by their PID.
+func trackPIDs(spec ffprobe.ProbeData, track rtsp.TrackID) ([]uint16, error) {
+	if track == rtsp.WholeMedia {
+		return nil, nil
+	}
+
+	for _, stream := range spec.Streams {
+		if stream == nil || rtsp.TrackID(stream.Index) != track {
+			continue
+		}
+
+		pid, err := strconv.ParseUint(strings.TrimPrefix(stream.ID, "0x"), 16, 13)
+		if err != nil {
+			return nil, fmt.Errorf("track %d has no PID: %q", track, stream.ID)
+		}
+
+		return []uint16{uint16(pid)}, nil
+	}
+
+	return nil, fmt.Errorf("no such track: %d", track)
+}
+
 func (s *Server) teardownStream(stream *Stream) {
 	if stream == nil {
 		return
 	}
 
 	stream.teardown()
-	delete(s.streams, stream.id)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.streams[stream.id] == stream {
+		delete(s.streams, stream.id)
+	}
+}
+
+func (s *Server) getStream(uid rtsp.StreamUID) (*Stream, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	stream, ok := s.streams[uid]
+	return stream, ok
 }
 
 // close the underlying connection and cleans up the stream state
 //   - if the stream id is not found, this is a no-op.
 func (s *Server) TeardownStream(streamUID rtsp.StreamUID) {
-	stream, ok := s.streams[streamUID]
+	if ingest, ok := s.getIngest(streamUID); ok {
+		s.teardownIngest(ingest)
+		return
+	}
+
+	if relay, ok := s.getRelay(streamUID); ok {
+		s.teardownRelay(relay)
+		return
+	}
+
+	stream, ok := s.getStream(streamUID)
 
 	if !ok {
 		return
@@ -138,18 +579,179 @@ func (s *Server) TeardownStream(streamUID rtsp.StreamUID) {
 	s.teardownStream(stream)
 }
 
-// begin streaming
-func (s *Server) PlayStream(uid rtsp.StreamUID) {
-	panic("not impl")
+// begin or resume sending packets, from the current read position or from the
+// keyframe at or before the requested start. Playing at a new scale restarts
+// from the keyframe at or before the current position. A relay plays on from
+// the packet it receives next, at normal play.
+func (s *Server) PlayStream(args rtsp.PlayArguments) (rtsp.PlayInfo, error) {
+	if relay, ok := s.getRelay(args.StreamID); ok {
+		if cmp.Or(args.Scale, 1) != 1 {
+			return rtsp.PlayInfo{}, fmt.Errorf("%w: %v", rtsp.ErrUnsupportedScale, args.Scale)
+		}
+
+		if cmp.Or(args.Speed, 1) != 1 {
+			return rtsp.PlayInfo{}, fmt.Errorf("%w: %v", rtsp.ErrUnsupportedSpeed, args.Speed)
+		}
+
+		relay.playing.Store(true)
+		return rtsp.PlayInfo{}, nil
+	}
+
+	stream, ok := s.getStream(args.StreamID)
+
+	if !ok {
+		return rtsp.PlayInfo{}, fmt.Errorf("%w: %s", ErrNoSuchStream, args.StreamID)
+	}
+
+	scale, speed := cmp.Or(args.Scale, 1), cmp.Or(args.Speed, 1)
+
+	if speed > maxSpeed {
+		return rtsp.PlayInfo{}, fmt.Errorf("%w: %v", rtsp.ErrUnsupportedSpeed, speed)
+	}
+
+	// e.g a live stream, which can only play on from where it is
+	if scale != 1 && stream.seekIndex == nil {
+		return rtsp.PlayInfo{}, fmt.Errorf("%w: %v", rtsp.ErrUnsupportedScale, scale)
+	}
+
+	info := stream.position()
+
+	if args.Seek || scale != stream.scale {
+		start := info.Start
+		if args.Seek {
+			start = args.Start
+		}
+
+		var err error
+		if info, err = stream.seek(start, scale); err != nil {
+			return rtsp.PlayInfo{}, err
+		}
+
+		stream.scale = scale
+	}
+
+	// setting the rate reanchors the pacer too, so that it doesn't rush to
+	// catch up on the time spent paused
+	stream.pacer.SetRate(speed)
+	stream.pauser.SetPaused(false)
+	return info, nil
+}
+
+// stop sending packets, holding the read position until the stream is played
+// again. A recorded stream stops recording until RecordStream.
+func (s *Server) PauseStream(uid rtsp.StreamUID) error {
+	if ingest, ok := s.getIngest(uid); ok {
+		ingest.recording.Store(false)
+		return nil
+	}
+
+	if relay, ok := s.getRelay(uid); ok {
+		relay.playing.Store(false)
+		return nil
+	}
+
+	stream, ok := s.getStream(uid)
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchStream, uid)
+	}
+
+	stream.pauser.SetPaused(true)
+	return nil
 }
 
-func (s *Server) PauseStream(uid rtsp.StreamUID) {
-	panic("not impl")
+func (s *Server) StreamStats(uid rtsp.StreamUID) (rtsp.StreamStats, error) {
+	if ingest, ok := s.getIngest(uid); ok {
+		return ingest.statistics(), nil
+	}
+
+	if relay, ok := s.getRelay(uid); ok {
+		return relay.statistics(), nil
+	}
+
+	stream, ok := s.getStream(uid)
+
+	if !ok {
+		return rtsp.StreamStats{}, fmt.Errorf("%w: %s", ErrNoSuchStream, uid)
+	}
+
+	return stream.statistics(), nil
+}
+
+// caps the rate the stream sends at, e.g while catching up after a stall. A cap
+// below the bitrate of the media plays it slower than real time. Zero or less
+// removes the cap, while a cap below rtsp.MinBitrateCap is refused.
+func (s *Server) SetBitrateCap(uid rtsp.StreamUID, bitsPerSecond int) error {
+	stream, ok := s.getStream(uid)
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchStream, uid)
+	}
+
+	if bitsPerSecond <= 0 {
+		stream.sendLimiter.SetLimit(rate.Inf)
+		return nil
+	}
+
+	// a cap below a byte per second would stop the stream
+	if bitsPerSecond < rtsp.MinBitrateCap {
+		return fmt.Errorf("bitrate cap below %d bits per second: %d", rtsp.MinBitrateCap, bitsPerSecond)
+	}
+
+	bytesPerSecond := bitsPerSecond / 8
+
+	stream.sendLimiter.SetBurst(max(bytesPerSecond/10, maxRTPPacketSize))
+	stream.sendLimiter.SetLimit(rate.Limit(bytesPerSecond))
+	return nil
+}
+
+// streams only the audio tracks in the language, an ISO 639 code as tagged in
+// the media, along with every track that is not audio. Only a stream of the
+// whole media can change its audio.
+func (s *Server) SelectAudioLanguage(uid rtsp.StreamUID, language string) error {
+	stream, ok := s.getStream(uid)
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchStream, uid)
+	}
+
+	if stream.track != rtsp.WholeMedia {
+		return fmt.Errorf("%w: stream %s is a single track", rtsp.ErrNoSuchLanguage, uid)
+	}
+
+	var excluded []uint16
+	var found bool
+
+	for _, st := range stream.structureInfo.Streams {
+		if st == nil || ffprobe.StreamType(st.CodecType) != ffprobe.StreamAudio {
+			continue
+		}
+
+		pids, err := trackPIDs(stream.structureInfo, rtsp.TrackID(st.Index))
+		if err != nil {
+			return err
+		}
+
+		if lang, _ := st.TagList.GetString("language"); strings.EqualFold(lang, language) {
+			found = true
+		} else {
+			excluded = append(excluded, pids...)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %q", rtsp.ErrNoSuchLanguage, language)
+	}
+
+	stream.packetizer.Exclude(excluded...)
+	return nil
 }
 
 func (s *Server) IsServing(uid rtsp.StreamUID) bool {
-	_, ok := s.streams[uid]
-	return ok
+	_, streaming := s.getStream(uid)
+	_, ingesting := s.getIngest(uid)
+	_, relaying := s.getRelay(uid)
+	return streaming || ingesting || relaying
 }
 
 func (s *Server) InterruptCause() <-chan error {
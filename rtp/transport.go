@@ -0,0 +1,188 @@
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rebeljah/picast/rtsp"
+)
+
+// the default range of server ports that RTP/RTCP port pairs are bound in
+const (
+	DefaultPortMin = 50000
+	DefaultPortMax = 50999
+)
+
+var ErrNoPortsAvailable = errors.New("no RTP ports available")
+
+// PortRange is an inclusive range of UDP ports. RTP is sent from the even port
+// of each pair in the range, and RTCP from the odd port after it.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a range of the form `min-max`, e.g `50000-50999`.
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return PortRange{}, fmt.Errorf("bad port range: %q", s)
+	}
+
+	min, err := strconv.Atoi(lo)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("bad port range: %q", s)
+	}
+
+	max, err := strconv.Atoi(hi)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("bad port range: %q", s)
+	}
+
+	r := PortRange{Min: min, Max: max}
+	if r.pairs() == 0 || min < 1 || max > 0xFFFF {
+		return PortRange{}, fmt.Errorf("bad port range: %q", s)
+	}
+
+	return r, nil
+}
+
+// the first even port of the range
+func (r PortRange) start() int {
+	return r.Min + r.Min%2
+}
+
+// the number of whole even/odd pairs in the range
+func (r PortRange) pairs() int {
+	return max(0, (r.Max-r.start()+1)/2)
+}
+
+// binds an even/odd server port pair in the server's port range, connected to
+// the client's RTP and RTCP ports. Pairs are tried round robin from the pair
+// after the last one bound, so that ports are not reused right away.
+func (s *Server) allocatePorts(rtpAddr, rtcpAddr *net.UDPAddr) (*net.UDPConn, *net.UDPConn, error) {
+	pairs := s.PortRange.pairs()
+	offset := int(s.nextPortPair.Load())
+
+	for i := range pairs {
+		pair := (offset + i) % pairs
+		port := s.PortRange.start() + 2*pair
+
+		rtpConn, err := net.DialUDP("udp", &net.UDPAddr{Port: port}, rtpAddr)
+		if err != nil {
+			continue
+		}
+
+		rtcpConn, err := net.DialUDP("udp", &net.UDPAddr{Port: port + 1}, rtcpAddr)
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+
+		s.nextPortPair.Store(uint32(pair + 1))
+		return rtpConn, rtcpConn, nil
+	}
+
+	return nil, nil, ErrNoPortsAvailable
+}
+
+// returns the client's RTP and RTCP ports, on the host of its RTSP connection
+func clientUDPAddrs(rtspAddr net.Addr, transport rtsp.TransportInfo) (*net.UDPAddr, *net.UDPAddr, error) {
+	host, _, err := net.SplitHostPort(rtspAddr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rtpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(transport.ClientPortStart)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rtcpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(transport.ClientPortEnd)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rtpAddr, rtcpAddr, nil
+}
+
+// returns the first of the client's transports, in its order of preference,
+// that the server can stream over in the mode, PLAY or RECORD. Port and channel
+// pairs given as a single value are completed with the odd value after it, for
+// RTCP.
+func negotiateTransport(transports []rtsp.TransportInfo, raddr net.Addr, conn rtsp.InterleavedConn, mode rtsp.RTSPMethod) (rtsp.TransportInfo, error) {
+	for _, t := range transports {
+		if !isSupportedTransport(t, raddr, conn, mode) {
+			continue
+		}
+
+		t.Mode = rtsp.TransportUnicast
+
+		if t.IsInterleaved() {
+			if t.InterleavedEnd <= t.InterleavedStart {
+				t.InterleavedEnd = t.InterleavedStart + 1
+			}
+		} else if t.ClientPortEnd <= t.ClientPortStart {
+			t.ClientPortEnd = t.ClientPortStart + 1
+		}
+
+		return t, nil
+	}
+
+	return rtsp.TransportInfo{}, rtsp.ErrUnsupportedTransport
+}
+
+// only unicast RTP/AVP is supported, over UDP to the client's ports or
+// interleaved in the RTSP connection.
+func isSupportedTransport(t rtsp.TransportInfo, raddr net.Addr, conn rtsp.InterleavedConn, mode rtsp.RTSPMethod) bool {
+	if !strings.EqualFold(t.Protocol, "RTP") || !strings.EqualFold(t.Profile, "AVP") {
+		return false
+	}
+
+	if t.Mode == rtsp.TransportMulticast {
+		return false
+	}
+
+	// the mode is PLAY unless given (RFC2326-12.39)
+	methods := t.Methods
+	if len(methods) == 0 {
+		methods = []rtsp.RTSPMethod{rtsp.PLAY}
+	}
+
+	if !slices.Contains(methods, mode) {
+		return false
+	}
+
+	// streaming to a third party would make the server an amplifier
+	if t.Destination != "" && !isHostOf(t.Destination, raddr) {
+		return false
+	}
+
+	switch t.LowerTransport {
+	case rtsp.LowerTransportTCP:
+		return conn != nil && t.InterleavedStart < 0xFF
+	case rtsp.LowerTransportUDP:
+		return t.ClientPortStart > 0 && t.ClientPortStart < 0xFFFF
+	default:
+		return false
+	}
+}
+
+// true iff host is the host of addr
+func isHostOf(host string, addr net.Addr) bool {
+	addrHost, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	hostIP, addrIP := net.ParseIP(host), net.ParseIP(addrHost)
+	if hostIP != nil && addrIP != nil {
+		return hostIP.Equal(addrIP)
+	}
+
+	return strings.EqualFold(host, addrHost)
+}
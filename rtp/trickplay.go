@@ -0,0 +1,129 @@
+package rtp
+
+import (
+	"io"
+	"math"
+	"slices"
+
+	"github.com/pion/rtp"
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtsp"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// Trick play (RFC2326-12.34): at a scale other than 1, only the keyframes of
+// the seek index are sent, forwards or in reverse. Each keyframe is timed on
+// the RTP timeline by its distance in the media from where trick play began,
+// divided by the scale, so that paced in real time the normal play time
+// advances at the scale.
+
+const (
+	maxScale = 16 // fastest fast-forward or rewind
+	maxSpeed = 4  // fastest delivery, relative to real time
+
+	// the most TS packets of a keyframe that are sent, the rest is cut
+	maxKeyframePackets = 2048
+)
+
+type trickPlay struct {
+	scale  float64
+	origin media.SeekPoint // where trick play began
+	pids   map[uint16]bool // the PIDs that keyframes are sent from
+
+	points  []media.SeekPoint
+	next    int          // index of the next keyframe, stepping in the direction of play
+	pending []rtp.Packet // the rest of the keyframe being sent
+}
+
+// the PIDs of the video in the stream, whose keyframes are sent in trick play
+func keyframePIDs(spec ffprobe.ProbeData, track rtsp.TrackID) (map[uint16]bool, error) {
+	pids := make(map[uint16]bool)
+
+	for _, st := range spec.Streams {
+		if st == nil || ffprobe.StreamType(st.CodecType) != ffprobe.StreamVideo {
+			continue
+		}
+
+		if track != rtsp.WholeMedia && rtsp.TrackID(st.Index) != track {
+			continue
+		}
+
+		ids, err := trackPIDs(spec, rtsp.TrackID(st.Index))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pid := range ids {
+			pids[pid] = true
+		}
+	}
+
+	return pids, nil
+}
+
+// returns trick play from the keyframe at the seek point, or
+// rtsp.ErrUnsupportedScale if the stream can't be played at the scale.
+func (s *Stream) newTrickPlay(point media.SeekPoint, scale float64) (*trickPlay, error) {
+	if s.seekIndex == nil || math.Abs(scale) > maxScale {
+		return nil, rtsp.ErrUnsupportedScale
+	}
+
+	pids, err := keyframePIDs(s.structureInfo, s.track)
+	if err != nil {
+		return nil, err
+	}
+
+	// e.g an audio track, which has no keyframes to skip between
+	if len(pids) == 0 {
+		return nil, rtsp.ErrUnsupportedScale
+	}
+
+	next := max(0, slices.Index(s.seekIndex.Points, point))
+
+	return &trickPlay{
+		scale:  scale,
+		origin: point,
+		pids:   pids,
+		points: s.seekIndex.Points,
+		next:   next,
+	}, nil
+}
+
+// reads the source a keyframe at a time into RTP packets. Returns io.EOF past
+// the last keyframe in the direction of play.
+func (s *Stream) nextTrickPacket() (rtp.Packet, error) {
+	t := s.trick
+
+	for len(t.pending) == 0 {
+		if t.next < 0 || t.next >= len(t.points) {
+			return rtp.Packet{}, io.EOF
+		}
+
+		point := t.points[t.next]
+
+		if t.scale > 0 {
+			t.next++
+		} else {
+			t.next--
+		}
+
+		if _, err := s.source.(io.Seeker).Seek(point.Offset, io.SeekStart); err != nil {
+			return rtp.Packet{}, err
+		}
+
+		delivery := math.Abs(point.Time-t.origin.Time) / math.Abs(t.scale)
+		ticks := uint64((t.origin.Time + delivery) * media.TSClockRate)
+
+		packets, err := s.packetizer.Keyframe(s.source, point, t.pids, ticks)
+		if err != nil {
+			return rtp.Packet{}, err
+		}
+
+		t.pending = packets
+	}
+
+	packet := t.pending[0]
+	t.pending = t.pending[1:]
+
+	return packet, nil
+}
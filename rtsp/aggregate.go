@@ -0,0 +1,127 @@
+package rtsp
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rebeljah/picast/media"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// Aggregate control (RFC2326-1.3): the URL of a media, `media/{uid}`, controls
+// every stream set up in a session at once, while the URL of one of its tracks,
+// `media/{uid}/trackID=N`, controls just the stream of that track. Live streams
+// are addressed alike by name, `live/{name}`, with the control URLs of their
+// tracks as they were announced.
+
+// a request path that addresses a media, or one track of a media
+type mediaPath struct {
+	UID   media.UID
+	Track TrackID // WholeMedia for the aggregate URL of the media
+
+	Live    string // name of a live stream, see RTSPServer.resolveMediaPath
+	control string // control URL of a track of the live stream
+}
+
+// parses a `media/{uid}` or `media/{uid}/trackID=N` request path, or a
+// `live/{name}[/control]` path that is left for the server to resolve. If the
+// path does not address a media entry, the returned status is the error status
+// to respond with.
+func parseMediaPath(u *url.URL) (mediaPath, RTSPStatus) {
+	path := strings.Trim(u.Path, "/ ")
+	segments := strings.Split(path, "/")
+
+	if len(segments) != 2 && len(segments) != 3 {
+		return mediaPath{}, NotFound
+	}
+
+	switch segments[0] {
+	case "media":
+		p := mediaPath{UID: media.UID(segments[1]), Track: WholeMedia}
+
+		if len(segments) == 3 {
+			track, ok := parseTrackControl(segments[2])
+			if !ok {
+				return mediaPath{}, NotFound
+			}
+
+			p.Track = track
+		}
+
+		return p, OK
+	case "live":
+		p := mediaPath{Live: segments[1], Track: WholeMedia}
+
+		if len(segments) == 3 {
+			p.control = segments[2]
+		}
+
+		return p, OK
+	default:
+		return mediaPath{}, MethodNotAllowed
+	}
+}
+
+// parses a `trackID=N` control URL
+func parseTrackControl(control string) (TrackID, bool) {
+	value, ok := strings.CutPrefix(control, "trackID=")
+	if !ok {
+		return 0, false
+	}
+
+	track, err := strconv.Atoi(value)
+	if err != nil || track < 0 {
+		return 0, false
+	}
+
+	return TrackID(track), true
+}
+
+// true iff the media structure has a stream for the track
+func hasTrack(structure ffprobe.ProbeData, track TrackID) bool {
+	for _, stream := range structure.Streams {
+		if stream != nil && TrackID(stream.Index) == track {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the control URL of a track, for the RTP-Info of a response to a
+// request for the given URL.
+func trackURL(requestURL *url.URL, path mediaPath, track TrackID) string {
+	if track == WholeMedia || path.Track != WholeMedia {
+		return requestURL.String()
+	}
+
+	return newContentBase(requestURL, path.UID).String() + trackControl(int(track))
+}
+
+// returns the tracks of the session that a request for the path controls. Once
+// more than one track is set up, PLAY, PAUSE and RECORD are only allowed on the
+// aggregate URL, so that the tracks stay in sync. The caller must hold the
+// session lock.
+func (s *Session) controlledTracks(path mediaPath, method RTSPMethod) ([]TrackID, RTSPStatus) {
+	if len(s.Streams) == 0 {
+		return nil, MethodNotValidInThisState
+	}
+
+	if path.UID != s.ContentID {
+		return nil, NotFound
+	}
+
+	if path.Track == WholeMedia {
+		return s.Tracks(), OK
+	}
+
+	if _, ok := s.Streams[path.Track]; !ok {
+		return nil, NotFound
+	}
+
+	if len(s.Streams) > 1 && (method == PLAY || method == PAUSE || method == RECORD) {
+		return nil, OnlyAggregateOperationAllowed
+	}
+
+	return []TrackID{path.Track}, OK
+}
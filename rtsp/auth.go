@@ -0,0 +1,378 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the time a nonce can be authenticated with, once issued
+const DefaultNonceTTL = 5 * time.Minute
+
+var ErrBadUserFile = errors.New("bad user file")
+
+// UserStore looks up the secrets of users, which are hashed as in the user
+// files of htdigest, i.e MD5(username:realm:password) in hex. As the hash is
+// what Digest authentication (RFC2617-3.2.2.2) computes from the password,
+// the password itself is never stored.
+type UserStore interface {
+	Secret(username, realm string) (string, bool)
+}
+
+// HashSecret returns the secret of a user in the realm, for a UserStore.
+func HashSecret(username, realm, password string) string {
+	return md5Hex(username + ":" + realm + ":" + password)
+}
+
+// DigestUsers is a UserStore of the users in an htdigest file, where each line
+// is `username:realm:secret`.
+type DigestUsers map[string]string // secrets by username:realm
+
+// ReadDigestUsers reads the users of an htdigest file. Blank lines and lines
+// beginning with `#` are skipped.
+func ReadDigestUsers(r io.Reader) (DigestUsers, error) {
+	users := make(DigestUsers)
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || parts[0] == "" || len(parts[2]) != 2*md5.Size {
+			return nil, fmt.Errorf("%w: line %d", ErrBadUserFile, n)
+		}
+
+		if _, err := hex.DecodeString(parts[2]); err != nil {
+			return nil, fmt.Errorf("%w: line %d", ErrBadUserFile, n)
+		}
+
+		users[parts[0]+":"+parts[1]] = strings.ToLower(parts[2])
+	}
+
+	return users, scanner.Err()
+}
+
+// LoadDigestUsers reads the users of the htdigest file at the path.
+func LoadDigestUsers(path string) (DigestUsers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadDigestUsers(f)
+}
+
+func (u DigestUsers) Secret(username, realm string) (string, bool) {
+	secret, ok := u[username+":"+realm]
+	return secret, ok
+}
+
+// Authenticator is middleware that authenticates requests with the Digest
+// scheme of RFC2617, or with Basic if allowed, and challenges those that are
+// not. Serve requests with NewMiddleware(authenticator, next), so that nothing
+// is served before the client is known. The name of the user is then given by
+// Request.User.
+type Authenticator struct {
+	realm string
+	users UserStore
+
+	// the time a nonce can be used for, after which the client is challenged
+	// again and retries with a new nonce. Credentials sent with qop=auth are
+	// only accepted once for each nonce count, but clients that digest without
+	// a qop, as many RTSP clients do, send credentials that can be replayed
+	// until their nonce expires.
+	NonceTTL time.Duration
+
+	// accept Basic credentials, which send the password in the clear, and
+	// offer Basic in challenges after Digest.
+	AllowBasic bool
+
+	// decides whether the user may make the request, e.g to restrict access
+	// to media, if set. Requests that are not authorized are forbidden.
+	Authorize func(user string, r *Request) bool
+
+	// signs the expiry of each nonce into it, so that nonces need not be kept
+	// to be checked
+	nonceKey []byte
+
+	// the last nonce count of each nonce used with qop=auth, until it expires
+	lock   sync.Mutex
+	counts map[string]uint64
+}
+
+func NewAuthenticator(realm string, users UserStore) *Authenticator {
+	nonceKey := make([]byte, sha256.Size)
+	rand.Read(nonceKey)
+
+	return &Authenticator{
+		realm:    realm,
+		users:    users,
+		NonceTTL: DefaultNonceTTL,
+		nonceKey: nonceKey,
+		counts:   make(map[string]uint64),
+	}
+}
+
+func (a *Authenticator) ServeRTSP(w ResponseWriter, r *Request) {
+	user, stale, err := a.authenticate(r)
+
+	if err != nil {
+		if _, ok := r.Headers.GetLine(HeaderNameAuthorization); ok {
+			log.Printf("RTSP authentication from %v failed: %v", r.RemoteAddr, err)
+		}
+
+		a.challenge(w, stale)
+		return
+	}
+
+	if a.Authorize != nil && !a.Authorize(user, r) {
+		w.WriteHeader(Forbidden)
+		return
+	}
+
+	r.user = user
+}
+
+// returns the user that the request is authenticated as, or whether it was
+// refused only for a nonce that expired
+func (a *Authenticator) authenticate(r *Request) (user string, stale bool, err error) {
+	header, ok := r.Headers.GetLine(HeaderNameAuthorization)
+	if !ok {
+		return "", false, errors.New("no credentials")
+	}
+
+	scheme, credentials, _ := strings.Cut(header.ValueNoError(), " ")
+
+	switch {
+	case strings.EqualFold(scheme, "Digest"):
+		return a.authenticateDigest(r, parseAuthParams(credentials))
+	case strings.EqualFold(scheme, "Basic") && a.AllowBasic:
+		user, err := a.authenticateBasic(strings.TrimSpace(credentials))
+		return user, false, err
+	default:
+		return "", false, fmt.Errorf("unsupported scheme: %q", scheme)
+	}
+}
+
+// RFC2617-3.2.2
+func (a *Authenticator) authenticateDigest(r *Request, params map[string]string) (string, bool, error) {
+	username, nonce, uri := params["username"], params["nonce"], params["uri"]
+
+	if params["realm"] != a.realm {
+		return "", false, fmt.Errorf("wrong realm: %q", params["realm"])
+	}
+
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", false, fmt.Errorf("unsupported algorithm: %q", algorithm)
+	}
+
+	// clients differ in whether they digest the absolute URL or its path
+	if r.URL == nil || (uri != r.URL.String() && uri != r.URL.RequestURI()) {
+		return "", false, fmt.Errorf("digest of another URI: %q", uri)
+	}
+
+	secret, ok := a.users.Secret(username, a.realm)
+	if !ok {
+		return "", false, fmt.Errorf("unknown user: %q", username)
+	}
+
+	ha2 := md5Hex(string(r.Method) + ":" + uri)
+
+	qop := params["qop"]
+
+	var expected string
+	switch qop {
+	case "":
+		expected = md5Hex(secret + ":" + nonce + ":" + ha2)
+	case "auth":
+		expected = md5Hex(strings.Join([]string{secret, nonce, params["nc"], params["cnonce"], qop, ha2}, ":"))
+	default:
+		return "", false, fmt.Errorf("unsupported qop: %q", qop)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", false, fmt.Errorf("wrong credentials for user: %q", username)
+	}
+
+	expires, issued := a.nonceExpiry(nonce)
+	if !issued {
+		return "", false, fmt.Errorf("nonce not issued here, for user: %q", username)
+	}
+
+	// the credentials are right, but may only be used while the nonce is
+	if !time.Now().Before(expires) {
+		return "", true, fmt.Errorf("stale nonce for user: %q", username)
+	}
+
+	if qop == "auth" && !a.countNonce(nonce, params["nc"]) {
+		return "", false, fmt.Errorf("replayed nonce count for user: %q", username)
+	}
+
+	return username, false, nil
+}
+
+// RFC2617-2
+func (a *Authenticator) authenticateBasic(credentials string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", errors.New("malformed Basic credentials")
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", errors.New("malformed Basic credentials")
+	}
+
+	secret, ok := a.users.Secret(username, a.realm)
+	if !ok {
+		return "", fmt.Errorf("unknown user: %q", username)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(HashSecret(username, a.realm, password))) != 1 {
+		return "", fmt.Errorf("wrong credentials for user: %q", username)
+	}
+
+	return username, nil
+}
+
+// responds that the request is unauthorized, with a new nonce. Clients that
+// sent the right credentials with an expired nonce are told that it was stale,
+// so they retry without asking for the password again.
+func (a *Authenticator) challenge(w ResponseWriter, stale bool) {
+	value := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=MD5, qop="auth"`, a.realm, a.newNonce())
+
+	if stale {
+		value += ", stale=TRUE"
+	}
+
+	w.Header().PutGenericLine(HeaderNameWWWAuthenticate, value)
+
+	if a.AllowBasic {
+		w.Header().AddGenericLine(HeaderNameWWWAuthenticate, fmt.Sprintf(`Basic realm="%s"`, a.realm))
+	}
+
+	w.WriteHeader(Unauthorized)
+}
+
+// returns a nonce of the time it expires and its signature, in hex, so that
+// any number of clients can be challenged without the nonces being kept.
+func (a *Authenticator) newNonce() string {
+	expires := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(a.NonceTTL).UnixNano()))
+
+	return hex.EncodeToString(append(expires, a.signNonce(expires)...))
+}
+
+// returns when the nonce expires, if it was issued by the authenticator
+func (a *Authenticator) nonceExpiry(nonce string) (time.Time, bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return time.Time{}, false
+	}
+
+	expires, signature := b[:8], b[8:]
+
+	if !hmac.Equal(signature, a.signNonce(expires)) {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(expires))), true
+}
+
+// records the nonce count (RFC2617-3.2.2) that a valid nonce is used with, and
+// reports whether it is greater than any the nonce was used with before, as
+// it is unless the request is replayed
+func (a *Authenticator) countNonce(nonce, nc string) bool {
+	count, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || count == 0 {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	last, seen := a.counts[nonce]
+	if seen && count <= last {
+		return false
+	}
+
+	// the counts of nonces that expired are let go of as new nonces are used
+	if !seen {
+		for n := range a.counts {
+			if expires, _ := a.nonceExpiry(n); !time.Now().Before(expires) {
+				delete(a.counts, n)
+			}
+		}
+	}
+
+	a.counts[nonce] = count
+	return true
+}
+
+func (a *Authenticator) signNonce(expires []byte) []byte {
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(expires)
+	return mac.Sum(nil)
+}
+
+// parses the comma separated `name=value` parameters of credentials, where
+// values may be quoted strings
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+
+		params[name] = value
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
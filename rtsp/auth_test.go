@@ -0,0 +1,237 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRealm    = "picast"
+	testUser     = "alice"
+	testPassword = "secret"
+)
+
+// returns Digest credentials for a request of the method to the URI, with
+// qop=auth if nc is given
+func testDigest(method RTSPMethod, realm, nonce, uri, password, nc string) string {
+	secret := HashSecret(testUser, realm, password)
+	ha2 := md5Hex(string(method) + ":" + uri)
+
+	value := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, testUser, realm, nonce, uri)
+
+	if nc == "" {
+		return value + fmt.Sprintf(`, response="%s"`, md5Hex(secret+":"+nonce+":"+ha2))
+	}
+
+	response := md5Hex(strings.Join([]string{secret, nonce, nc, "0a4f113b", "auth", ha2}, ":"))
+	return value + fmt.Sprintf(`, qop=auth, nc=%s, cnonce="0a4f113b", response="%s"`, nc, response)
+}
+
+func TestAuthenticator(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	users := DigestUsers{testUser + ":" + testRealm: HashSecret(testUser, testRealm, testPassword)}
+	u, _ := url.Parse("rtsp://example.com/media/abc")
+
+	other := NewAuthenticator(testRealm, users)
+
+	tests := []struct {
+		name          string
+		allowBasic    bool
+		authorize     func(user string, r *Request) bool
+		nonceTTL      time.Duration
+		authorization func(nonce string) string
+		want          RTSPStatus
+		wantStale     bool
+	}{
+		{
+			name: "no credentials",
+			want: Unauthorized,
+		},
+		{
+			name: "digest",
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, u.String(), testPassword, "")
+			},
+			want: OK,
+		},
+		{
+			name: "digest of the path",
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, u.RequestURI(), testPassword, "")
+			},
+			want: OK,
+		},
+		{
+			name: "digest with qop",
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, u.String(), testPassword, "00000001")
+			},
+			want: OK,
+		},
+		{
+			name: "wrong response",
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, u.String(), "guess", "")
+			},
+			want: Unauthorized,
+		},
+		{
+			name: "wrong realm",
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, "elsewhere", nonce, u.String(), testPassword, "")
+			},
+			want: Unauthorized,
+		},
+		{
+			name: "wrong URI",
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, "rtsp://example.com/media/xyz", testPassword, "")
+			},
+			want: Unauthorized,
+		},
+		{
+			name: "wrong method",
+			authorization: func(nonce string) string {
+				return testDigest(TEARDOWN, testRealm, nonce, u.String(), testPassword, "")
+			},
+			want: Unauthorized,
+		},
+		{
+			name:     "expired nonce",
+			nonceTTL: -time.Second,
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, u.String(), testPassword, "")
+			},
+			want:      Unauthorized,
+			wantStale: true,
+		},
+		{
+			name: "nonce of another key",
+			authorization: func(string) string {
+				return testDigest(DESCRIBE, testRealm, other.newNonce(), u.String(), testPassword, "")
+			},
+			want: Unauthorized,
+		},
+		{
+			name: "forged nonce",
+			authorization: func(nonce string) string {
+				// a later expiry, with the signature of the original
+				forged := "ff" + nonce[2:]
+				return testDigest(DESCRIBE, testRealm, forged, u.String(), testPassword, "")
+			},
+			want: Unauthorized,
+		},
+		{
+			name: "basic when disabled",
+			authorization: func(string) string {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(testUser+":"+testPassword))
+			},
+			want: Unauthorized,
+		},
+		{
+			name:       "basic",
+			allowBasic: true,
+			authorization: func(string) string {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(testUser+":"+testPassword))
+			},
+			want: OK,
+		},
+		{
+			name:       "wrong basic",
+			allowBasic: true,
+			authorization: func(string) string {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(testUser+":guess"))
+			},
+			want: Unauthorized,
+		},
+		{
+			name:      "not authorized",
+			authorize: func(user string, r *Request) bool { return user != testUser },
+			authorization: func(nonce string) string {
+				return testDigest(DESCRIBE, testRealm, nonce, u.String(), testPassword, "")
+			},
+			want: Forbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAuthenticator(testRealm, users)
+			a.AllowBasic = tt.allowBasic
+			a.Authorize = tt.authorize
+
+			if tt.nonceTTL != 0 {
+				a.NonceTTL = tt.nonceTTL
+			}
+
+			req := NewRequest(DESCRIBE, u)
+			if tt.authorization != nil {
+				req.Headers.PutGenericLine(HeaderNameAuthorization, tt.authorization(a.newNonce()))
+			}
+
+			w := newResponse(OK)
+			a.ServeRTSP(w, &req)
+
+			if w.StatusCode != tt.want {
+				t.Fatalf("got %v, want %v", w.StatusCode, tt.want)
+			}
+
+			if tt.want == OK && req.User() != testUser {
+				t.Errorf("authenticated as %q, want %q", req.User(), testUser)
+			}
+
+			challenge := strings.Join(w.Headers.Values(HeaderNameWWWAuthenticate), "\n")
+
+			if stale := strings.Contains(challenge, "stale=TRUE"); stale != tt.wantStale {
+				t.Errorf("challenge %q: got stale %v, want %v", challenge, stale, tt.wantStale)
+			}
+
+			if w.StatusCode == Unauthorized && strings.Contains(challenge, "Basic") != tt.allowBasic {
+				t.Errorf("challenge %q offers Basic: %v", challenge, !tt.allowBasic)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorNonceCount(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	users := DigestUsers{testUser + ":" + testRealm: HashSecret(testUser, testRealm, testPassword)}
+	u, _ := url.Parse("rtsp://example.com/media/abc")
+
+	a := NewAuthenticator(testRealm, users)
+	nonce := a.newNonce()
+
+	for _, tt := range []struct {
+		nc   string
+		want RTSPStatus
+	}{
+		{"00000001", OK},
+		{"00000001", Unauthorized}, // replayed
+		{"00000003", OK},
+		{"00000002", Unauthorized},
+		{"00000000", Unauthorized},
+		{"nothex", Unauthorized},
+		{"00000004", OK},
+	} {
+		req := NewRequest(DESCRIBE, u)
+		req.Headers.PutGenericLine(HeaderNameAuthorization, testDigest(DESCRIBE, testRealm, nonce, u.String(), testPassword, tt.nc))
+
+		w := newResponse(OK)
+		a.ServeRTSP(w, &req)
+
+		if w.StatusCode != tt.want {
+			t.Errorf("nc=%s: got %v, want %v", tt.nc, w.StatusCode, tt.want)
+		}
+	}
+}
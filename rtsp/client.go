@@ -0,0 +1,771 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pionsdp "github.com/pion/sdp"
+)
+
+const (
+	// the port of the rtsp scheme
+	DefaultRTSPPort = 554
+
+	// default time to wait for the connection, and for each response.
+	DefaultClientTimeout = 10 * time.Second
+
+	// the session timeout of RFC2326-12.37, when the server gives none
+	defaultSessionTimeout = 60 * time.Second
+
+	// packets received faster than they are read are dropped
+	clientPacketBufferSize = 1024
+)
+
+var (
+	ErrClientClosed   = errors.New("client closed")
+	ErrUnsupportedURL = errors.New("unsupported URL")
+	ErrNoTransport    = errors.New("no transport in response")
+	ErrTimeout        = errors.New("timed out waiting for response")
+)
+
+// StatusError is the error of a request that the server answered with a status
+// other than success.
+type StatusError struct {
+	Method   RTSPMethod
+	Response Response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.Method, string(e.Response.StatusCode), e.Response.StatusText)
+}
+
+// Packet is an RTP or RTCP packet received from the server, on the transport
+// of a track that the client set up.
+type Packet struct {
+	Track    int  // of the track, in the order it was set up
+	RTCP     bool // false for RTP
+	Data     []byte
+	Received time.Time
+}
+
+// Client is the client side of an RTSP connection, which sends one request at
+// a time and receives the media of the tracks it sets up, over UDP or
+// interleaved on the connection. Credentials in the URL are used to answer
+// Digest or Basic challenges.
+type Client struct {
+	// the time to wait for each response.
+	Timeout time.Duration
+
+	// the User-Agent of requests, if set.
+	UserAgent string
+
+	url  *url.URL // without its credentials
+	user *url.Userinfo
+
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+
+	// serializes requests, and guards the state of the conversation
+	doLock         sync.Mutex
+	cseq           int
+	session        SessionUID
+	sessionTimeout time.Duration
+	aggregate      *url.URL
+	challenge      map[string]string // auth-params of the challenge answered, and its scheme
+	nc             int               // of the nonce of the challenge
+
+	responses chan Response
+	redirects chan *url.URL
+
+	lock      sync.Mutex
+	closed    bool
+	err       error
+	done      chan struct{}
+	tracks    int
+	channels  map[uint8]int // track by interleaved RTP channel, and RTCP channel
+	udpConns  []net.PacketConn
+	readers   sync.WaitGroup
+	packets   chan Packet
+	closeOnce sync.Once
+}
+
+// Dial connects to the server of an rtsp or rtsps URL, which is then the URL
+// that requests are made to. The TLS config, nil for the defaults, is used for
+// rtsps.
+func Dial(rawURL string, config *tls.Config) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var port int
+	switch u.Scheme {
+	case "rtsp":
+		port = DefaultRTSPPort
+	case "rtsps":
+		port = DefaultRTSPSPort
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedURL, rawURL)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	}
+
+	dialer := &net.Dialer{Timeout: DefaultClientTimeout}
+
+	var conn net.Conn
+	if u.Scheme == "rtsps" {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		Timeout:   DefaultClientTimeout,
+		user:      u.User,
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		responses: make(chan Response, 1),
+		redirects: make(chan *url.URL, 1),
+		done:      make(chan struct{}),
+		channels:  make(map[uint8]int),
+		packets:   make(chan Packet, clientPacketBufferSize),
+	}
+
+	u.User = nil
+	c.url, c.aggregate = u, u
+
+	c.readers.Add(1)
+	go c.read()
+
+	return c, nil
+}
+
+// URL returns the URL that the client was dialed with, without credentials.
+func (c *Client) URL() *url.URL {
+	return c.url
+}
+
+// Packets returns the packets received on the transports that were set up. It
+// is closed once the client is.
+func (c *Client) Packets() <-chan Packet {
+	return c.packets
+}
+
+// Redirects returns the locations that the server redirects the session to
+// with a REDIRECT request (RFC2326-10.11). The client should then tear the
+// session down, and set it up again at the location.
+func (c *Client) Redirects() <-chan *url.URL {
+	return c.redirects
+}
+
+// Done is closed once the client is closed, by Close or by losing the
+// connection, after which Err returns why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+// SessionTimeout returns the time that the server keeps the session for
+// without a request, which the client should send a keepalive within.
+func (c *Client) SessionTimeout() time.Duration {
+	c.doLock.Lock()
+	defer c.doLock.Unlock()
+
+	if c.sessionTimeout <= 0 {
+		return defaultSessionTimeout
+	}
+
+	return c.sessionTimeout
+}
+
+// Close closes the connection and the UDP transports, without tearing down the
+// session, which the server then does itself.
+func (c *Client) Close() error {
+	c.closeWithError(ErrClientClosed)
+	return nil
+}
+
+func (c *Client) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.closed, c.err = true, err
+		for _, conn := range c.udpConns {
+			conn.Close()
+		}
+		c.lock.Unlock()
+
+		c.conn.Close()
+		close(c.done)
+
+		// the packets are closed once nothing can send on them
+		go func() {
+			c.readers.Wait()
+			close(c.packets)
+		}()
+	})
+}
+
+// reads the responses and interleaved frames of the connection, until it is
+// closed
+func (c *Client) read() {
+	defer c.readers.Done()
+
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+
+		if b[0] == interleavedMagic {
+			channel, payload, err := readInterleavedFrame(c.reader)
+			if err != nil {
+				c.closeWithError(err)
+				return
+			}
+
+			c.lock.Lock()
+			track, ok := c.channels[channel]
+			c.lock.Unlock()
+
+			if ok {
+				c.deliver(Packet{Track: track, RTCP: channel%2 == 1, Data: payload, Received: time.Now()})
+			}
+			continue
+		}
+
+		// the server may send requests too, e.g a REDIRECT
+		if b, err := c.reader.Peek(len("RTSP/")); err == nil && string(b) != "RTSP/" {
+			req, err := ReadRequest(c.reader, DefaultMessageLimits)
+			if err != nil {
+				c.closeWithError(err)
+				return
+			}
+
+			if err := c.answer(req); err != nil {
+				c.closeWithError(err)
+				return
+			}
+			continue
+		}
+
+		response, err := ReadResponse(c.reader, DefaultMessageLimits)
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+
+		// a late response to a request that timed out is dropped
+		select {
+		case c.responses <- response:
+		default:
+		}
+	}
+}
+
+// responds to a request of the server. Only a REDIRECT is understood.
+func (c *Client) answer(req Request) error {
+	response := newResponse(NotImplemented)
+
+	if req.Method == REDIRECT {
+		location, err := url.Parse(req.Headers.GetLineNoFail(HeaderNameLocation).ValueNoError())
+
+		if err != nil || location.Scheme == "" {
+			response = newResponse(BadRequest)
+		} else {
+			response = newResponse(OK)
+
+			select {
+			case c.redirects <- location:
+			default:
+			}
+		}
+	}
+
+	if cseq, ok := req.Headers.GetLine(HeaderNameCSeq); ok {
+		response.Headers.PutLine(cseq)
+	}
+
+	b, err := response.marshal()
+	if err != nil {
+		return err
+	}
+
+	return c.write(b)
+}
+
+func (c *Client) deliver(p Packet) {
+	select {
+	case c.packets <- p:
+	default:
+	}
+}
+
+// reads the packets of a UDP transport until it is closed
+func (c *Client) readUDP(conn net.PacketConn, track int, rtcp bool) {
+	defer c.readers.Done()
+
+	buf := make([]byte, maxInterleavedPayload)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		c.deliver(Packet{Track: track, RTCP: rtcp, Data: append([]byte(nil), buf[:n]...), Received: time.Now()})
+	}
+}
+
+// Do sends the request and returns the response to it, of any status. The
+// CSeq is set, as are the Session, User-Agent and Authorization unless the
+// request has them. A challenge is answered once, if the URL has credentials.
+func (c *Client) Do(req *Request) (Response, error) {
+	c.doLock.Lock()
+	defer c.doLock.Unlock()
+
+	if req.Version == "" {
+		req.Version = RTSP_VERSION_STRING
+	}
+
+	_, hasAuthorization := req.Headers.GetLine(HeaderNameAuthorization)
+
+	response, err := c.do(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if response.StatusCode == Unauthorized && !hasAuthorization && c.user != nil {
+		if !c.answerChallenge(response) {
+			return response, nil
+		}
+
+		req.Headers.Delete(HeaderNameAuthorization)
+		return c.do(req)
+	}
+
+	return response, nil
+}
+
+func (c *Client) do(req *Request) (Response, error) {
+	c.cseq++
+	req.Headers.PutGenericLine(HeaderNameCSeq, strconv.Itoa(c.cseq))
+
+	if _, ok := req.Headers.GetLine(HeaderNameSession); !ok && c.session != "" {
+		req.Headers.PutLine(NewSessionHeaderLine(c.session, 0))
+	}
+
+	if _, ok := req.Headers.GetLine(HeaderNameUserAgent); !ok && c.UserAgent != "" {
+		req.Headers.PutGenericLine(HeaderNameUserAgent, c.UserAgent)
+	}
+
+	if _, ok := req.Headers.GetLine(HeaderNameAuthorization); !ok && c.challenge != nil {
+		req.Headers.PutGenericLine(HeaderNameAuthorization, c.authorization(req))
+	}
+
+	if n := len(req.Body); n > 0 {
+		req.Headers.PutGenericLine(HeaderNameContentLength, strconv.Itoa(n))
+	}
+
+	b, err := req.Marshal()
+	if err != nil {
+		return Response{}, err
+	}
+
+	if err := c.write(b); err != nil {
+		return Response{}, err
+	}
+
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		timer := time.NewTimer(c.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case response := <-c.responses:
+			// responses to requests that timed out come late, if at all
+			if cseq := response.Headers.GetLineNoFail(HeaderNameCSeq).ValueNoError(); cseq != strconv.Itoa(c.cseq) {
+				continue
+			}
+
+			if session, ok := response.Headers.GetLine(HeaderNameSession); ok {
+				if session, ok := session.(SessionHeaderLine); ok {
+					c.session, c.sessionTimeout = session.ID, session.Timeout
+				}
+			}
+
+			return response, nil
+		case <-c.done:
+			return Response{}, c.Err()
+		case <-timeout:
+			return Response{}, fmt.Errorf("%s: %w", req.Method, ErrTimeout)
+		}
+	}
+}
+
+func (c *Client) write(b []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.Timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	}
+
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// remembers the challenge of the response to authenticate the requests from
+// then on, preferring Digest over Basic. Returns false if there is none that
+// the client can answer, or only the one already answered, unless it was
+// stale.
+func (c *Client) answerChallenge(response Response) bool {
+	var basic map[string]string
+
+	for _, value := range response.Headers.Values(HeaderNameWWWAuthenticate) {
+		scheme, params, _ := strings.Cut(value, " ")
+		auth := parseAuthParams(params)
+		auth["scheme"] = strings.ToLower(scheme)
+
+		switch auth["scheme"] {
+		case "digest":
+			if algorithm := auth["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+				continue
+			}
+
+			if c.challenge != nil && c.challenge["scheme"] == "digest" && !strings.EqualFold(auth["stale"], "true") {
+				return false
+			}
+
+			c.challenge, c.nc = auth, 0
+			return true
+		case "basic":
+			basic = auth
+		}
+	}
+
+	if basic == nil || c.challenge != nil {
+		return false
+	}
+
+	c.challenge = basic
+	return true
+}
+
+// the Authorization of the request, answering the challenge (RFC2617-3.2.2)
+func (c *Client) authorization(req *Request) string {
+	username := c.user.Username()
+	password, _ := c.user.Password()
+
+	if c.challenge["scheme"] == "basic" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	realm, nonce, uri := c.challenge["realm"], c.challenge["nonce"], req.URL.String()
+
+	secret := HashSecret(username, realm, password)
+	ha2 := md5Hex(string(req.Method) + ":" + uri)
+
+	value := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+
+	if opaque, ok := c.challenge["opaque"]; ok {
+		value += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+
+	var qops []string
+	for qop := range strings.SplitSeq(c.challenge["qop"], ",") {
+		qops = append(qops, strings.TrimSpace(qop))
+	}
+
+	if !slices.Contains(qops, "auth") {
+		return value + fmt.Sprintf(`, response="%s"`, md5Hex(secret+":"+nonce+":"+ha2))
+	}
+
+	c.nc++
+	nc := fmt.Sprintf("%08x", c.nc)
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+
+	response := md5Hex(strings.Join([]string{secret, nonce, nc, cnonce, "auth", ha2}, ":"))
+
+	return value + fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+}
+
+// sends a request of the method to the URL, and returns the response if it is
+// a success, or else a *StatusError
+func (c *Client) request(method RTSPMethod, u *url.URL, headers ...HeaderLine) (Response, error) {
+	req := NewRequest(method, u)
+	for _, h := range headers {
+		req.Headers.PutLine(h)
+	}
+
+	return c.expectSuccess(&req)
+}
+
+func (c *Client) expectSuccess(req *Request) (Response, error) {
+	response, err := c.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if !strings.HasPrefix(string(response.StatusCode), "2") {
+		return response, &StatusError{Method: req.Method, Response: response}
+	}
+
+	return response, nil
+}
+
+func (c *Client) Options() (Response, error) {
+	return c.request(OPTIONS, c.url)
+}
+
+// Describe returns the session description of the URL, and the base URL that
+// its control URLs are relative to. The base is then the aggregate URL that
+// the session is played with.
+func (c *Client) Describe() (*pionsdp.SessionDescription, *url.URL, error) {
+	response, err := c.request(DESCRIBE, c.url, NewGenericHeaderLine(HeaderNameAccept, ContentTypeSDP))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sd := &pionsdp.SessionDescription{}
+	if err := sd.Unmarshal(string(response.Body)); err != nil {
+		return nil, nil, fmt.Errorf("bad session description: %w", err)
+	}
+
+	// RFC2326-C.1.1
+	base := c.url
+	for _, name := range []string{HeaderNameContentBase, HeaderNameContentLocation} {
+		if h, ok := response.Headers.GetLine(name); ok {
+			if u, err := c.url.Parse(h.ValueNoError()); err == nil {
+				base = u
+				break
+			}
+		}
+	}
+
+	c.doLock.Lock()
+	c.aggregate = base
+	c.doLock.Unlock()
+
+	return sd, base, nil
+}
+
+// TrackURLs returns the control URL of each media of the session description,
+// resolved against the base URL that Describe returned.
+func TrackURLs(sd *pionsdp.SessionDescription, base *url.URL) []*url.URL {
+	tracks := make([]*url.URL, len(sd.MediaDescriptions))
+
+	for i, md := range sd.MediaDescriptions {
+		tracks[i] = base
+
+		control, ok := md.Attribute("control")
+		if !ok || control == "*" {
+			continue
+		}
+
+		// relative to the base as a directory, as the control URLs are
+		// RFC2326-C.1.1
+		dir := *base
+		if !strings.HasSuffix(dir.Path, "/") {
+			dir.Path += "/"
+			dir.RawPath = ""
+		}
+
+		if u, err := dir.Parse(control); err == nil {
+			tracks[i] = u
+		}
+	}
+
+	return tracks
+}
+
+// Setup sets up the track of the URL, to be received over the lower transport,
+// UDP or TCP to interleave it on the connection. Returns the transport that
+// the server chose. The packets of the track are numbered in the order that
+// the tracks were set up.
+func (c *Client) Setup(track *url.URL, lowerTransport string) (TransportInfo, error) {
+	c.lock.Lock()
+	n := c.tracks
+	c.lock.Unlock()
+
+	transport := TransportInfo{
+		Protocol:       "RTP",
+		Profile:        "AVP",
+		LowerTransport: lowerTransport,
+		Mode:           TransportUnicast,
+	}
+
+	var rtpConn, rtcpConn net.PacketConn
+
+	switch lowerTransport {
+	case LowerTransportTCP:
+		transport.InterleavedStart, transport.InterleavedEnd = 2*n, 2*n+1
+	case LowerTransportUDP:
+		var err error
+		if rtpConn, rtcpConn, err = listenUDPPair(); err != nil {
+			return TransportInfo{}, err
+		}
+
+		transport.ClientPortStart = rtpConn.LocalAddr().(*net.UDPAddr).Port
+		transport.ClientPortEnd = transport.ClientPortStart + 1
+	default:
+		return TransportInfo{}, fmt.Errorf("%w: %q", ErrUnsupportedTransport, lowerTransport)
+	}
+
+	closeUDP := func() {
+		if rtpConn != nil {
+			rtpConn.Close()
+			rtcpConn.Close()
+		}
+	}
+
+	response, err := c.request(SETUP, track, NewTransportHeaderLine([]TransportInfo{transport}))
+	if err != nil {
+		closeUDP()
+		return TransportInfo{}, err
+	}
+
+	header, _ := response.Headers.GetLine(HeaderNameTransport)
+	transports, ok := header.(TransportHeaderLine)
+	if !ok || len(transports.Transports) == 0 {
+		closeUDP()
+		return TransportInfo{}, ErrNoTransport
+	}
+
+	chosen := transports.Transports[0]
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		closeUDP()
+		return TransportInfo{}, c.err
+	}
+
+	c.tracks++
+
+	if chosen.IsInterleaved() {
+		closeUDP()
+		c.channels[uint8(chosen.InterleavedStart)] = n
+		c.channels[uint8(chosen.InterleavedStart+1)] = n
+		return chosen, nil
+	}
+
+	c.udpConns = append(c.udpConns, rtpConn, rtcpConn)
+	c.readers.Add(2)
+	go c.readUDP(rtpConn, n, false)
+	go c.readUDP(rtcpConn, n, true)
+
+	return chosen, nil
+}
+
+// listens on an even UDP port for RTP, and the next for RTCP (RFC3550-11)
+func listenUDPPair() (net.PacketConn, net.PacketConn, error) {
+	for range 16 {
+		rtpConn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtpConn.Close()
+			continue
+		}
+
+		rtcpConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port+1))
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+
+		return rtpConn, rtcpConn, nil
+	}
+
+	return nil, nil, errors.New("no free UDP port pair")
+}
+
+// Play plays the session from the start of the range, or from where it was
+// paused if nil.
+func (c *Client) Play(r *NPTRange) (Response, error) {
+	var headers []HeaderLine
+	if r != nil {
+		headers = append(headers, NewRangeHeaderLine(*r))
+	}
+
+	return c.request(PLAY, c.aggregateURL(), headers...)
+}
+
+func (c *Client) Pause() (Response, error) {
+	return c.request(PAUSE, c.aggregateURL())
+}
+
+// Teardown ends the session. The connection stays open for other requests.
+func (c *Client) Teardown() (Response, error) {
+	response, err := c.request(TEARDOWN, c.aggregateURL())
+
+	c.doLock.Lock()
+	c.session, c.sessionTimeout = "", 0
+	c.doLock.Unlock()
+
+	return response, err
+}
+
+// GetParameter returns the response with the values of the parameters, or
+// without any it keeps the session alive (RFC2326-10.8).
+func (c *Client) GetParameter(names ...string) (Response, error) {
+	req := NewRequest(GET_PARAMETER, c.aggregateURL())
+
+	if len(names) > 0 {
+		req.Headers.PutLine(NewContentTypeHeaderLine(ContentTypeParameters, nil))
+		req.Body = []byte(strings.Join(names, "\r\n") + "\r\n")
+	}
+
+	return c.expectSuccess(&req)
+}
+
+func (c *Client) aggregateURL() *url.URL {
+	c.doLock.Lock()
+	defer c.doLock.Unlock()
+
+	return c.aggregate
+}
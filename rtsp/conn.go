@@ -0,0 +1,202 @@
+package rtsp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// default time to wait for the next request on an idle connection.
+	DefaultIdleTimeout = 120 * time.Second
+
+	// default time allowed to read a whole request once its first byte arrives.
+	DefaultReadTimeout = 10 * time.Second
+
+	// default time allowed to write a whole response.
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// a persistent RTSP connection. A client may send any number of (pipelined)
+// requests over one connection, and the sessions set up by those requests live
+// at most as long as the connection that created them.
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// serializes writes so that responses are never interleaved with other data
+	// written to the connection.
+	writeLock sync.Mutex
+
+	writeTimeout time.Duration
+
+	channelsLock sync.Mutex
+	channels     map[uint8]*interleavedReader // readers of interleaved channels
+
+	// only accessed by the goroutine serving the connection
+	lastCSeq int
+	cseq     int       // of the last request that the server sent
+	requests []Request // for the server to send after the current response
+}
+
+func newConn(c net.Conn, writeTimeout time.Duration) *conn {
+	return &conn{
+		Conn:         c,
+		reader:       bufio.NewReader(c),
+		writeTimeout: writeTimeout,
+		channels:     make(map[uint8]*interleavedReader),
+		lastCSeq:     -1,
+	}
+}
+
+// writes b as one unit, and is safe for concurrent use.
+func (c *conn) writeLocked(b []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	_, err := c.Write(b)
+	return err
+}
+
+// returns a writer that frames each write as interleaved binary data on the
+// given channel (RFC2326-10.12). Implements InterleavedConn.
+func (c *conn) ChannelWriter(channel uint8) io.Writer {
+	return interleavedWriter{conn: c, channel: channel}
+}
+
+// returns a reader of the frames received on the given channel. Implements
+// InterleavedConn. A new reader of a channel replaces the last.
+func (c *conn) ChannelReader(channel uint8) io.ReadCloser {
+	r := newInterleavedReader(c, channel)
+
+	c.channelsLock.Lock()
+	defer c.channelsLock.Unlock()
+
+	if last, ok := c.channels[channel]; ok {
+		last.close()
+	}
+	c.channels[channel] = r
+
+	return r
+}
+
+func (c *conn) removeChannelReader(r *interleavedReader) {
+	c.channelsLock.Lock()
+	defer c.channelsLock.Unlock()
+
+	if c.channels[r.channel] == r {
+		delete(c.channels, r.channel)
+	}
+}
+
+// passes a received frame to the reader of its channel, or drops it.
+func (c *conn) deliverFrame(channel uint8, payload []byte) {
+	c.channelsLock.Lock()
+	r, ok := c.channels[channel]
+	c.channelsLock.Unlock()
+
+	if ok {
+		r.deliver(payload)
+	}
+}
+
+// ends the reads of every channel reader, once the connection is done.
+func (c *conn) closeChannelReaders() {
+	c.channelsLock.Lock()
+	defer c.channelsLock.Unlock()
+
+	for channel, r := range c.channels {
+		r.close()
+		delete(c.channels, channel)
+	}
+}
+
+// blocks until the first byte of the next request or interleaved frame is
+// available, or the idle timeout passes. Returns true if the next message is an
+// interleaved frame.
+func (c *conn) awaitMessage(idleTimeout time.Duration) (bool, error) {
+	if idleTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(idleTimeout))
+	}
+
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	return b[0] == interleavedMagic, nil
+}
+
+// reports whether the next message is a response, of the client to a request
+// that the server sent. It must follow awaitMessage.
+func (c *conn) isResponseNext() bool {
+	b, err := c.reader.Peek(len("RTSP/"))
+	return err == nil && string(b) == "RTSP/"
+}
+
+// queues a request for the server to send the client after the response to
+// the request being served, e.g a REDIRECT (RFC2326-10.11).
+func (c *conn) sendAfterResponse(req Request) {
+	c.requests = append(c.requests, req)
+}
+
+// sends the queued requests, each with the next CSeq of the server.
+func (c *conn) sendRequests() error {
+	requests := c.requests
+	c.requests = nil
+
+	for _, req := range requests {
+		c.cseq++
+		req.Headers.PutGenericLine(HeaderNameCSeq, strconv.Itoa(c.cseq))
+
+		b, err := req.Marshal()
+		if err != nil {
+			return err
+		}
+
+		if err := c.writeLocked(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type connSet struct {
+	sync.Mutex
+	conns map[*conn]struct{}
+}
+
+func newConnSet() connSet {
+	return connSet{conns: make(map[*conn]struct{})}
+}
+
+func (s *connSet) add(c *conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.conns[c] = struct{}{}
+}
+
+func (s *connSet) delete(c *conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.conns, c)
+}
+
+func (s *connSet) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
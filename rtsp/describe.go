@@ -0,0 +1,177 @@
+package rtsp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pionsdp "github.com/pion/sdp"
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/sdp"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+const (
+	ContentTypeSDP string = "application/sdp"
+
+	// all media is normalized to MPEG-TS, so every track is described as RFC2250 MP2T.
+	mp2tPayloadType string = "33"
+	mp2tRTPMap      string = mp2tPayloadType + " MP2T/90000"
+)
+
+// reports whether the media ranges of Accept headers (RFC2326-12.1) include
+// the media type, e.g `application/*` or `*/*`. The most specific range that
+// matches decides, and one with q=0 refuses the type.
+func accepts(accept []string, mediaType string) bool {
+	want, wantSub, _ := strings.Cut(mediaType, "/")
+
+	// -1 until a range matches, then 0 for */*, 1 for type/* and 2 for type/sub
+	specificity := -1
+	var accepted bool
+
+	for _, value := range accept {
+		for _, mediaRange := range splitUnquoted(value, ',') {
+			params := strings.Split(mediaRange, ";")
+			typ, sub, _ := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+
+			var matched int
+			switch {
+			case typ == want && sub == wantSub:
+				matched = 2
+			case typ == want && sub == "*":
+				matched = 1
+			case typ == "*" && sub == "*":
+				matched = 0
+			default:
+				continue
+			}
+
+			if matched < specificity {
+				continue
+			}
+
+			quality := 1.0
+			for _, param := range params[1:] {
+				name, q, _ := strings.Cut(param, "=")
+				if strings.EqualFold(strings.TrimSpace(name), "q") {
+					if v, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil {
+						quality = v
+					}
+				}
+			}
+
+			specificity, accepted = matched, quality > 0
+		}
+	}
+
+	return accepted
+}
+
+// returns the relative control URL of a track, resolved against the Content-Base
+// of the media.
+func trackControl(index int) string {
+	return "trackID=" + strconv.Itoa(index)
+}
+
+// maps an ffprobe codec type to an SDP media type (RFC4566-5.14)
+func sdpMediaType(s *ffprobe.Stream) string {
+	switch ffprobe.StreamType(s.CodecType) {
+	case ffprobe.StreamVideo:
+		return "video"
+	case ffprobe.StreamAudio:
+		return "audio"
+	default:
+		return "application"
+	}
+}
+
+// the URL that relative control URLs of a media description are resolved against,
+// e.g rtsp://host:port/media/{uid}/
+func newContentBase(requestURL *url.URL, uid media.UID) *url.URL {
+	return &url.URL{
+		Scheme: requestURL.Scheme,
+		User:   requestURL.User,
+		Host:   requestURL.Host,
+		Path:   "/media/" + string(uid) + "/",
+	}
+}
+
+// Builds the session description returned in response to DESCRIBE.
+//   - session-level attributes are taken from the `sdp` tags of the metadata.
+//   - one media description is created per track in the metadata structure, each
+//     with a control URL relative to the Content-Base.
+func newSessionDescription(metadata media.Metadata, contentBase *url.URL) (*pionsdp.SessionDescription, error) {
+	attributes, err := sdp.NewAttributesFromStruct(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe media %s: %w", metadata.UID, err)
+	}
+
+	// unset metadata fields are not described
+	attributes = slices.DeleteFunc(attributes, func(a pionsdp.Attribute) bool {
+		return a.Value == ""
+	})
+
+	// a live stream has no end yet
+	playRange := "npt=0-"
+	if metadata.Duration > 0 {
+		playRange = fmt.Sprintf("npt=0-%.3f", metadata.Duration)
+	}
+
+	attributes = append(attributes,
+		pionsdp.NewAttribute("control", "*"),
+		pionsdp.NewAttribute("range", playRange),
+	)
+
+	sessionID := uint64(time.Now().Unix())
+
+	desc := &pionsdp.SessionDescription{
+		Version: 0,
+		Origin: pionsdp.Origin{
+			Username:       "-",
+			SessionID:      sessionID,
+			SessionVersion: sessionID,
+			NetworkType:    "IN",
+			AddressType:    "IP4",
+			UnicastAddress: contentBase.Hostname(),
+		},
+		SessionName: pionsdp.SessionName(metadata.Title),
+		ConnectionInformation: &pionsdp.ConnectionInformation{
+			NetworkType: "IN",
+			AddressType: "IP4",
+			Address:     &pionsdp.Address{IP: net.IPv4zero},
+		},
+		TimeDescriptions: []pionsdp.TimeDescription{
+			{Timing: pionsdp.Timing{StartTime: 0, StopTime: 0}},
+		},
+		Attributes: attributes,
+	}
+
+	if desc.SessionName == "" {
+		desc.SessionName = pionsdp.SessionName(metadata.UID)
+	}
+
+	for _, stream := range metadata.Structure.Streams {
+		if stream == nil {
+			continue
+		}
+
+		desc.MediaDescriptions = append(desc.MediaDescriptions, &pionsdp.MediaDescription{
+			MediaName: pionsdp.MediaName{
+				Media:   sdpMediaType(stream),
+				Port:    pionsdp.RangedPort{Value: 0},
+				Protos:  []string{"RTP", "AVP"},
+				Formats: []string{mp2tPayloadType},
+			},
+			Attributes: []pionsdp.Attribute{
+				pionsdp.NewAttribute("rtpmap", mp2tRTPMap),
+				pionsdp.NewAttribute("control", trackControl(stream.Index)),
+			},
+		})
+	}
+
+	return desc, nil
+}
@@ -0,0 +1,29 @@
+package rtsp
+
+import "testing"
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   bool
+	}{
+		{[]string{"application/sdp"}, true},
+		{[]string{"Application/SDP"}, true},
+		{[]string{"application/rtsl, application/sdp;level=2"}, true},
+		{[]string{"application/*"}, true},
+		{[]string{"*/*"}, true},
+		{[]string{"text/html", "*/*;q=0.1"}, true},
+		{[]string{"text/html"}, false},
+		{[]string{"application/mheg"}, false},
+		{[]string{"application/sdpx"}, false},
+		{[]string{"application/sdp;q=0"}, false},
+		{[]string{"*/*, application/sdp;q=0"}, false},
+		{[]string{"application/*;q=0, application/sdp"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := accepts(tt.accept, ContentTypeSDP); got != tt.want {
+			t.Errorf("accepts(%q): got %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
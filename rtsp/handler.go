@@ -0,0 +1,230 @@
+package rtsp
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// A Handler responds to an RTSP request. The response is sent once the
+// handler returns, so handlers and middleware may change what was written
+// until then.
+type Handler interface {
+	ServeRTSP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc type is an adapter to allow the use of
+// ordinary functions as RTSP handlers. If f is a function
+// with the appropriate signature, HandlerFunc(f) is a
+// Handler that calls f.
+type HandlerFunc func(ResponseWriter, *Request)
+
+// ServeRTSP calls f(w, r) to implement Handler.
+func (f HandlerFunc) ServeRTSP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// A ResponseWriter builds the response to a request. The status is 200 OK
+// unless written.
+type ResponseWriter interface {
+	// Header returns the headers of the response.
+	Header() *Headers
+
+	// WriteHeader sets the status of the response.
+	WriteHeader(status RTSPStatus)
+
+	// Write appends to the body of the response. The Content-Length is set
+	// when the response is sent.
+	Write(b []byte) (int, error)
+
+	// Status returns the status of the response so far.
+	Status() RTSPStatus
+}
+
+// Middleware serves a request with its handler first, e.g to check or to
+// annotate it, and then with the next handler unless the first responded with
+// an error status.
+type Middleware struct {
+	handler     Handler
+	nextHandler Handler
+}
+
+// NewMiddleware returns middleware that runs `handler` ahead of `next`.
+func NewMiddleware(handler Handler, next Handler) Middleware {
+	return Middleware{handler: handler, nextHandler: next}
+}
+
+func (m Middleware) ServeRTSP(w ResponseWriter, r *Request) {
+	m.handler.ServeRTSP(w, r)
+
+	if w.Status() == OK {
+		m.nextHandler.ServeRTSP(w, r)
+	}
+}
+
+// DeferredMiddleware runs its handler after the next handler, regardless of
+// the response status. Useful for finalizing or logging a response.
+type DeferredMiddleware struct {
+	handler     Handler
+	nextHandler Handler
+}
+
+// NewDeferredMiddleware returns middleware that runs `handler` after `next`.
+func NewDeferredMiddleware(handler Handler, next Handler) DeferredMiddleware {
+	return DeferredMiddleware{handler: handler, nextHandler: next}
+}
+
+func (m DeferredMiddleware) ServeRTSP(w ResponseWriter, r *Request) {
+	m.nextHandler.ServeRTSP(w, r)
+	m.handler.ServeRTSP(w, r)
+}
+
+// ServeMux routes requests by method and URL path. A pattern ending in a
+// slash, like `/media/`, matches every path beneath it, while any other
+// pattern matches its path exactly. Of the patterns that match a path, the
+// longest with a handler for the method wins. A request for `*`, the server as
+// a whole, is routed as the root path.
+type ServeMux struct {
+	lock   sync.RWMutex
+	routes map[string]map[RTSPMethod]Handler // by pattern, then method
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		routes: make(map[string]map[RTSPMethod]Handler),
+	}
+}
+
+// Handle registers the handler of a method for the pattern. It panics if the
+// pattern is not a path, or the method already has a handler for it.
+func (m *ServeMux) Handle(method RTSPMethod, pattern string, handler Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("rtsp: pattern is not a path: %q", pattern))
+	}
+
+	if handler == nil {
+		panic("rtsp: nil handler")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.routes[pattern][method]; ok {
+		panic(fmt.Sprintf("rtsp: multiple registrations of %s %s", method, pattern))
+	}
+
+	if m.routes[pattern] == nil {
+		m.routes[pattern] = make(map[RTSPMethod]Handler)
+	}
+
+	m.routes[pattern][method] = handler
+}
+
+// HandleFunc registers the handler function of a method for the pattern.
+func (m *ServeMux) HandleFunc(method RTSPMethod, pattern string, handler func(ResponseWriter, *Request)) {
+	m.Handle(method, pattern, HandlerFunc(handler))
+}
+
+// Handler returns the handler of the request, and the methods allowed on its
+// path. The handler is nil if none matches, in which case no methods means
+// that nothing was found at the path.
+func (m *ServeMux) Handler(r *Request) (Handler, []RTSPMethod) {
+	path := requestPath(r)
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var handler Handler
+	var longest int
+	allowed := make(map[RTSPMethod]bool)
+
+	for pattern, methods := range m.routes {
+		if !matchesPattern(pattern, path) {
+			continue
+		}
+
+		for method := range methods {
+			allowed[method] = true
+		}
+
+		if h, ok := methods[r.Method]; ok && len(pattern) > longest {
+			handler, longest = h, len(pattern)
+		}
+	}
+
+	return handler, slices.Sorted(maps.Keys(allowed))
+}
+
+// ServeRTSP routes the request to its handler. A path that nothing is
+// registered for is not found, and an extension method that is registered for
+// no path is not implemented. Otherwise a method that is not registered for its
+// path is not allowed, and answered with the methods that are.
+func (m *ServeMux) ServeRTSP(w ResponseWriter, r *Request) {
+	handler, allowed := m.Handler(r)
+
+	if handler != nil {
+		handler.ServeRTSP(w, r)
+		return
+	}
+
+	if len(allowed) == 0 {
+		w.WriteHeader(NotFound)
+		return
+	}
+
+	if !IsValidRTSPMethod(string(r.Method)) && !m.handlesMethod(r.Method) {
+		w.WriteHeader(NotImplemented)
+		return
+	}
+
+	w.Header().PutGenericLine(HeaderNameAllow, joinMethods(allowed))
+	w.WriteHeader(MethodNotAllowed)
+}
+
+// Methods returns the methods that have a handler for any pattern.
+func (m *ServeMux) Methods() []RTSPMethod {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	methods := make(map[RTSPMethod]bool)
+	for _, handlers := range m.routes {
+		for method := range handlers {
+			methods[method] = true
+		}
+	}
+
+	return slices.Sorted(maps.Keys(methods))
+}
+
+// whether the method has a handler for any pattern
+func (m *ServeMux) handlesMethod(method RTSPMethod) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, methods := range m.routes {
+		if _, ok := methods[method]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the path a request is routed by
+func requestPath(r *Request) string {
+	if r.URL == nil || r.URL.Path == "" || r.URL.Path == "*" {
+		return "/"
+	}
+
+	return r.URL.Path
+}
+
+func matchesPattern(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(path, pattern) || path+"/" == pattern
+	}
+
+	return path == pattern
+}
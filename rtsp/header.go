@@ -3,6 +3,8 @@ package rtsp
 import (
 	"errors"
 	"fmt"
+	"net/textproto"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -31,6 +33,7 @@ const (
 	HeaderNameFrom              string = "From"
 	HeaderNameIfModifiedSince   string = "If-Modified-Since"
 	HeaderNameLastModified      string = "Last-Modified"
+	HeaderNameLocation          string = "Location"
 	HeaderNameProxyAuthenticate string = "Proxy-Authenticate"
 	HeaderNameProxyRequire      string = "Proxy-Require"
 	HeaderNamePublic            string = "Public"
@@ -96,10 +99,51 @@ func (h GenericHeaderLine) Marshal() ([]byte, error) {
 	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), h.ValueNoError()), nil
 }
 
-type Headers map[string]HeaderLine
+// Headers are the header fields of a message, in the order they were added.
+// Names are case-insensitive (RFC2326-4.2), and a field may be repeated. The
+// zero value has no fields.
+type Headers struct {
+	lines []HeaderLine
+}
+
+// the names of the header fields of RFC2326, by their lower case
+var canonicalHeaderNames = func() map[string]string {
+	names := make(map[string]string)
+
+	for _, name := range []string{
+		HeaderNameTransport, HeaderNameAccept, HeaderNameAcceptEncoding,
+		HeaderNameAcceptLanguage, HeaderNameAllow, HeaderNameAuthorization,
+		HeaderNameBandwidth, HeaderNameBlocksize, HeaderNameCacheControl,
+		HeaderNameConference, HeaderNameConnection, HeaderNameContentBase,
+		HeaderNameContentEncoding, HeaderNameContentLanguage,
+		HeaderNameContentLength, HeaderNameContentLocation,
+		HeaderNameContentType, HeaderNameCSeq, HeaderNameDate,
+		HeaderNameExpires, HeaderNameFrom, HeaderNameIfModifiedSince,
+		HeaderNameLastModified, HeaderNameLocation, HeaderNameProxyAuthenticate,
+		HeaderNameProxyRequire, HeaderNamePublic, HeaderNameRange,
+		HeaderNameReferer, HeaderNameRequire, HeaderNameRetryAfter,
+		HeaderNameRTPInfo, HeaderNameScale, HeaderNameSession,
+		HeaderNameServer, HeaderNameSpeed, HeaderNameUnsupported,
+		HeaderNameUserAgent, HeaderNameVia, HeaderNameWWWAuthenticate,
+	} {
+		names[strings.ToLower(name)] = name
+	}
+
+	return names
+}()
+
+// CanonicalHeaderName returns the name as RFC2326 spells it, e.g `cseq` as
+// CSeq. Other names are capitalized like MIME headers, e.g `x-foo` as X-Foo.
+func CanonicalHeaderName(name string) string {
+	if canonical, ok := canonicalHeaderNames[strings.ToLower(name)]; ok {
+		return canonical
+	}
+
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
 
 func NewHeadersFromString(s string) (Headers, error) {
-	headers := make(Headers)
+	var headers Headers
 
 	s = strings.Trim(s, "\r\n")
 
@@ -107,20 +151,36 @@ func NewHeadersFromString(s string) (Headers, error) {
 		hl, err := ParseHeaderLine(line)
 
 		if err != nil {
-			return nil, err
+			return Headers{}, err
 		}
 
-		headers[hl.Name()] = hl
+		headers.AddLine(hl)
 	}
 
 	return headers, nil
 }
 
-func (h Headers) Marshal() ([]byte, error) {
+// writes the fields in the order they were added, except for CSeq, which is
+// written first
+func (h *Headers) Marshal() ([]byte, error) {
 	head := make([]byte, 0)
 
+	lines := slices.Clone(h.lines)
+	slices.SortStableFunc(lines, func(a, b HeaderLine) int {
+		aIsCSeq, bIsCSeq := a.Name() == HeaderNameCSeq, b.Name() == HeaderNameCSeq
+
+		switch {
+		case aIsCSeq && !bIsCSeq:
+			return -1
+		case bIsCSeq && !aIsCSeq:
+			return 1
+		default:
+			return 0
+		}
+	})
+
 	// write each header field
-	for _, headerLine := range h {
+	for _, headerLine := range lines {
 		line, err := headerLine.Marshal()
 		if err != nil {
 			return nil, err
@@ -132,21 +192,58 @@ func (h Headers) Marshal() ([]byte, error) {
 	return head, nil
 }
 
-func (h Headers) PutLine(hl HeaderLine) {
-	h[hl.Name()] = hl
+// PutLine sets the field, replacing any others of its name. It takes the place
+// of the first of those.
+func (h *Headers) PutLine(hl HeaderLine) {
+	hl = canonicalLine(hl)
+
+	i := slices.IndexFunc(h.lines, func(line HeaderLine) bool {
+		return line.Name() == hl.Name()
+	})
+
+	if i < 0 {
+		h.lines = append(h.lines, hl)
+		return
+	}
+
+	rest := slices.DeleteFunc(h.lines[i+1:], func(line HeaderLine) bool {
+		return line.Name() == hl.Name()
+	})
+
+	h.lines[i] = hl
+	h.lines = h.lines[:i+1+len(rest)]
 }
 
-func (h Headers) PutGenericLine(name string, value string) {
-	h[name] = GenericHeaderLine{name: name, rawValue: value}
+// PutGenericLine sets the field, replacing any others of its name.
+func (h *Headers) PutGenericLine(name string, value string) {
+	h.PutLine(GenericHeaderLine{name: name, rawValue: value})
 }
 
-func (h Headers) GetLine(name string) (HeaderLine, bool) {
-	hl, ok := h[name]
-	return hl, ok
+// AddLine adds the field after any others of its name.
+func (h *Headers) AddLine(hl HeaderLine) {
+	h.lines = append(h.lines, canonicalLine(hl))
+}
+
+// AddGenericLine adds the field after any others of its name.
+func (h *Headers) AddGenericLine(name string, value string) {
+	h.AddLine(GenericHeaderLine{name: name, rawValue: value})
+}
+
+// GetLine returns the first field of the name.
+func (h *Headers) GetLine(name string) (HeaderLine, bool) {
+	name = CanonicalHeaderName(name)
+
+	for _, hl := range h.lines {
+		if hl.Name() == name {
+			return hl, true
+		}
+	}
+
+	return nil, false
 }
 
 // returns an empty HeaderLine if the field name doesn't exist in the headers
-func (h Headers) GetLineNoFail(name string) HeaderLine {
+func (h *Headers) GetLineNoFail(name string) HeaderLine {
 	if hl, ok := h.GetLine(name); ok {
 		return hl
 	}
@@ -154,18 +251,158 @@ func (h Headers) GetLineNoFail(name string) HeaderLine {
 	return GenericHeaderLine{}
 }
 
-func (h Headers) Delete(name string) bool {
-	_, ok := h[name]
-	delete(h, name)
-	return ok
+// Lines returns every field of the name, in order.
+func (h *Headers) Lines(name string) []HeaderLine {
+	name = CanonicalHeaderName(name)
+
+	var lines []HeaderLine
+	for _, hl := range h.lines {
+		if hl.Name() == name {
+			lines = append(lines, hl)
+		}
+	}
+
+	return lines
 }
 
+// Values returns the values of every field of the name, in order.
+func (h *Headers) Values(name string) []string {
+	lines := h.Lines(name)
+
+	values := make([]string, len(lines))
+	for i, hl := range lines {
+		values[i] = hl.ValueNoError()
+	}
+
+	return values
+}
+
+// Len returns the number of fields.
+func (h *Headers) Len() int {
+	return len(h.lines)
+}
+
+// Delete removes every field of the name, and returns whether there were any.
+func (h *Headers) Delete(name string) bool {
+	name = CanonicalHeaderName(name)
+	n := len(h.lines)
+
+	h.lines = slices.DeleteFunc(h.lines, func(hl HeaderLine) bool {
+		return hl.Name() == name
+	})
+
+	return len(h.lines) < n
+}
+
+// returns the line with its name canonical. Typed lines are already.
+func canonicalLine(hl HeaderLine) HeaderLine {
+	if generic, ok := hl.(GenericHeaderLine); ok {
+		generic.name = CanonicalHeaderName(generic.name)
+		return generic
+	}
+
+	return hl
+}
+
+const (
+	LowerTransportUDP string = "UDP"
+	LowerTransportTCP string = "TCP"
+
+	TransportUnicast   string = "unicast"
+	TransportMulticast string = "multicast"
+)
+
+var ErrInvalidTransport = errors.New("invalid transport")
+
+// One transport spec of a Transport header (RFC2326-12.39). Port and channel
+// ranges are inclusive, and a zero port means the parameter is absent.
 type TransportInfo struct {
-	Protocol        string // RTP
-	Profile         string // AVP
-	Mode            string // "unicast"
-	ClientPortStart int    // start of the [...) port range
-	ClientPortEnd   int    // end of the [...) port range
+	Protocol         string       // RTP
+	Profile          string       // AVP
+	LowerTransport   string       // UDP (default) or TCP
+	Mode             string       // "unicast" or "multicast"
+	Destination      string       // address to stream to, if not the client
+	Source           string       // address the stream is sent from
+	ClientPortStart  int          // start of the client RTP/RTCP port range
+	ClientPortEnd    int          // end of the client RTP/RTCP port range
+	ServerPortStart  int          // start of the server RTP/RTCP port range
+	ServerPortEnd    int          // end of the server RTP/RTCP port range
+	PortStart        int          // start of the multicast port range
+	PortEnd          int          // end of the multicast port range
+	InterleavedStart int          // first channel of the interleaved range, for TCP
+	InterleavedEnd   int          // last channel of the interleaved range, for TCP
+	TTL              int          // multicast time-to-live, zero if absent
+	SSRC             uint32       // synchronization source of the stream
+	HasSSRC          bool         // true iff SSRC is set
+	Methods          []RTSPMethod // mode="PLAY", the methods the transport is for
+	Append           bool         // for RECORD, append to an existing resource
+}
+
+// true iff the transport is carried as interleaved frames on the RTSP connection
+func (t TransportInfo) IsInterleaved() bool {
+	return t.LowerTransport == LowerTransportTCP
+}
+
+// formats the transport spec, e.g `RTP/AVP;unicast;client_port=4588-4589`
+func (t TransportInfo) String() string {
+	var b strings.Builder
+
+	b.WriteString(t.Protocol + "/" + t.Profile)
+
+	if t.LowerTransport != "" && t.LowerTransport != LowerTransportUDP {
+		b.WriteString("/" + t.LowerTransport)
+	}
+
+	if t.Mode != "" {
+		b.WriteString(";" + t.Mode)
+	}
+
+	if t.Destination != "" {
+		b.WriteString(";destination=" + t.Destination)
+	}
+
+	if t.Source != "" {
+		b.WriteString(";source=" + t.Source)
+	}
+
+	if t.IsInterleaved() {
+		fmt.Fprintf(&b, ";interleaved=%s", formatRange(t.InterleavedStart, t.InterleavedEnd))
+	}
+
+	if t.Append {
+		b.WriteString(";append")
+	}
+
+	if t.TTL > 0 {
+		fmt.Fprintf(&b, ";ttl=%d", t.TTL)
+	}
+
+	if t.PortStart > 0 {
+		fmt.Fprintf(&b, ";port=%s", formatRange(t.PortStart, t.PortEnd))
+	}
+
+	if t.ClientPortStart > 0 {
+		fmt.Fprintf(&b, ";client_port=%s", formatRange(t.ClientPortStart, t.ClientPortEnd))
+	}
+
+	if t.ServerPortStart > 0 {
+		fmt.Fprintf(&b, ";server_port=%s", formatRange(t.ServerPortStart, t.ServerPortEnd))
+	}
+
+	if t.HasSSRC {
+		fmt.Fprintf(&b, ";ssrc=%08X", t.SSRC)
+	}
+
+	if len(t.Methods) > 0 {
+		methods := make([]string, len(t.Methods))
+		for i, m := range t.Methods {
+			methods[i] = string(m)
+		}
+
+		fmt.Fprintf(&b, ";mode=\"%s\"", strings.Join(methods, ","))
+	}
+
+	return b.String()
 }
 
 type TransportHeaderLine struct {
@@ -175,97 +412,289 @@ type TransportHeaderLine struct {
 
 func NewTransportHeaderLine(transports []TransportInfo) TransportHeaderLine {
 	return TransportHeaderLine{
-		GenericHeaderLine: NewGenericHeaderLine("Transport", ""),
-		Transports:        make([]TransportInfo, 0),
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameTransport, ""),
+		Transports:        transports,
+	}
+}
+
+func formatRange(start, end int) string {
+	if start == end {
+		return strconv.Itoa(start)
+	}
+
+	return strconv.Itoa(start) + "-" + strconv.Itoa(end)
+}
+
+// parses a "a-b" range, or a single "a" as the range a-a
+func parseRange(s string) (int, int, error) {
+	first, last, found := strings.Cut(s, "-")
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("%w: bad range: %q", ErrInvalidTransport, s)
 	}
+
+	if !found {
+		return start, start, nil
+	}
+
+	end, err := strconv.Atoi(last)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("%w: bad range: %q", ErrInvalidTransport, s)
+	}
+
+	return start, end, nil
 }
 
-func ParseTransportHeaderLine(ln string) TransportHeaderLine {
+// returns the end of a port or channel range, the one after the start if the
+// range is a single value
+func completePair(start, end int) int {
+	if end == start {
+		return start + 1
+	}
+	return end
+}
+
+// splits s at every sep that is not inside a double-quoted string.
+func splitUnquoted(s string, sep rune) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// parses a single transport spec like `RTP/AVP/TCP;unicast;interleaved=0-1`.
+// Parameters may come in any order, and unknown parameters are ignored.
+func parseTransportInfo(spec string) (TransportInfo, error) {
+	params := splitUnquoted(strings.TrimSpace(spec), ';')
+
+	// transport-protocol/profile[/lower-transport]
+	protoParts := strings.Split(strings.TrimSpace(params[0]), "/")
+
+	if len(protoParts) < 2 || len(protoParts) > 3 || protoParts[0] == "" || protoParts[1] == "" {
+		return TransportInfo{}, fmt.Errorf("%w: bad transport specifier: %q", ErrInvalidTransport, params[0])
+	}
+
+	t := TransportInfo{
+		Protocol:       protoParts[0],
+		Profile:        protoParts[1],
+		LowerTransport: LowerTransportUDP,
+	}
+
+	if len(protoParts) == 3 {
+		switch lower := strings.ToUpper(protoParts[2]); lower {
+		case LowerTransportUDP, LowerTransportTCP:
+			t.LowerTransport = lower
+		default:
+			return TransportInfo{}, fmt.Errorf("%w: bad lower transport: %q", ErrInvalidTransport, protoParts[2])
+		}
+	}
+
+	var hasInterleaved bool
+	var err error
+
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(name) {
+		case "":
+			continue
+		case TransportUnicast, TransportMulticast:
+			t.Mode = strings.ToLower(name)
+		case "destination":
+			t.Destination = value
+		case "source":
+			t.Source = value
+		case "append":
+			t.Append = true
+		case "interleaved":
+			t.InterleavedStart, t.InterleavedEnd, err = parseRange(value)
+			hasInterleaved = true
+		case "client_port":
+			t.ClientPortStart, t.ClientPortEnd, err = parseRange(value)
+		case "server_port":
+			t.ServerPortStart, t.ServerPortEnd, err = parseRange(value)
+		case "port":
+			t.PortStart, t.PortEnd, err = parseRange(value)
+		case "ttl":
+			t.TTL, err = strconv.Atoi(value)
+			if err != nil || t.TTL < 0 || t.TTL > 255 {
+				err = fmt.Errorf("%w: bad ttl: %q", ErrInvalidTransport, value)
+			}
+		case "ssrc":
+			var ssrc uint64
+			ssrc, err = strconv.ParseUint(value, 16, 32)
+			if err != nil {
+				err = fmt.Errorf("%w: bad ssrc: %q", ErrInvalidTransport, value)
+			}
+			t.SSRC, t.HasSSRC = uint32(ssrc), true
+		case "mode":
+			for m := range strings.SplitSeq(strings.Trim(value, `"`), ",") {
+				method := RTSPMethod(strings.ToUpper(strings.TrimSpace(m)))
+				if !IsValidRTSPMethod(string(method)) {
+					return TransportInfo{}, fmt.Errorf("%w: bad mode: %q", ErrInvalidTransport, value)
+				}
+				t.Methods = append(t.Methods, method)
+			}
+		}
+
+		if err != nil {
+			return TransportInfo{}, err
+		}
+	}
+
+	if hasInterleaved && !t.IsInterleaved() {
+		return TransportInfo{}, fmt.Errorf("%w: interleaved requires TCP", ErrInvalidTransport)
+	}
+
+	// interleaved channels default to 0-1 if the client does not pick them
+	if t.IsInterleaved() && !hasInterleaved {
+		t.InterleavedStart, t.InterleavedEnd = 0, 1
+	}
+
+	// a single RTP port or channel is paired with the one after it, for RTCP
+	if t.ClientPortStart > 0 {
+		t.ClientPortEnd = completePair(t.ClientPortStart, t.ClientPortEnd)
+	}
+
+	if t.ServerPortStart > 0 {
+		t.ServerPortEnd = completePair(t.ServerPortStart, t.ServerPortEnd)
+	}
+
+	if t.IsInterleaved() {
+		t.InterleavedEnd = completePair(t.InterleavedStart, t.InterleavedEnd)
+	}
+
+	return t, nil
+}
+
+// Parses a Transport header line, or just its value, into the transport specs
+// listed in order of client preference.
+func ParseTransportHeaderLine(ln string) (TransportHeaderLine, error) {
 	// Remove "Transport: " prefix
-	valueStr := strings.TrimPrefix(ln, "Transport: ")
+	valueStr := strings.TrimPrefix(ln, HeaderNameTransport+":")
 	valueStr = strings.Trim(valueStr, " \r\n")
 
+	if valueStr == "" {
+		return TransportHeaderLine{}, fmt.Errorf("%w: empty transport header", ErrInvalidTransport)
+	}
+
 	// Split multiple transport specs
-	transportSpecs := strings.Split(valueStr, ",")
+	transportSpecs := splitUnquoted(valueStr, ',')
 	transports := make([]TransportInfo, 0, len(transportSpecs))
 
 	for _, spec := range transportSpecs {
-		spec = strings.TrimSpace(spec)
-		parts := strings.Split(spec, ";")
-
-		// Parse protocol/profile (first part)
-		protoParts := strings.Split(parts[0], "/")
-		protocol := protoParts[0]
-		profile := protoParts[1]
-
-		// Parse mode (second part)
-		mode := parts[1]
-
-		// Parse client ports (third part)
-		portRange := strings.TrimPrefix(parts[2], "client_port=")
-		ports := strings.Split(portRange, "-")
-		portStart, _ := strconv.Atoi(ports[0])
-		portEnd, _ := strconv.Atoi(ports[1])
+		transport, err := parseTransportInfo(spec)
+		if err != nil {
+			return TransportHeaderLine{}, err
+		}
 
-		transports = append(transports, TransportInfo{
-			Protocol:        protocol,
-			Profile:         profile,
-			Mode:            mode,
-			ClientPortStart: portStart,
-			ClientPortEnd:   portEnd,
-		})
+		transports = append(transports, transport)
 	}
 
 	return TransportHeaderLine{
 		GenericHeaderLine: NewGenericHeaderLine(HeaderNameTransport, valueStr),
 		Transports:        transports,
+	}, nil
+}
+
+func (h TransportHeaderLine) Value() (string, error) {
+	if len(h.Transports) == 0 {
+		return "", fmt.Errorf("%w: no transports", ErrInvalidTransport)
+	}
+
+	specs := make([]string, len(h.Transports))
+
+	for i, t := range h.Transports {
+		if t.Protocol == "" || t.Profile == "" {
+			return "", fmt.Errorf("%w: missing protocol or profile", ErrInvalidTransport)
+		}
+
+		specs[i] = t.String()
 	}
+
+	return strings.Join(specs, ","), nil
+}
+
+func (h TransportHeaderLine) ValueNoError() string {
+	v, err := h.Value()
+
+	if err != nil {
+		return ""
+	}
+
+	return v
 }
 
-// TODO this function doesnt check for errors in the formatting
 func (h TransportHeaderLine) Marshal() ([]byte, error) {
-	line := fmt.Append(nil, string(h.name)+": ")
-
-	for i, trspt := range h.Transports {
-		line = fmt.Appendf(line, "%s/%s;%s;client_port=%d-%d",
-			trspt.Protocol,
-			trspt.Profile,
-			trspt.Mode,
-			trspt.ClientPortStart,
-			trspt.ClientPortEnd,
-		)
-
-		if i+1 < len(h.Transports) {
-			line = append(line, ',')
-		}
+	v, err := h.Value()
+	if err != nil {
+		return nil, err
 	}
 
-	return append(line, "\r\n"...), nil
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), v), nil
 }
 
+// ParseHeaderLine parses a header line, into the typed HeaderLine of its name
+// if it has one, or else into a GenericHeaderLine.
 func ParseHeaderLine(line string) (HeaderLine, error) {
+	generic, err := parseGenericHeaderLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	parse, ok := headerLineParsers[generic.name]
+	if !ok {
+		return generic, nil
+	}
+
+	return parse(generic.rawValue)
+}
+
+// the parsers of the values of typed header lines, by name
+var headerLineParsers = map[string]func(value string) (HeaderLine, error){
+	HeaderNameTransport: func(v string) (HeaderLine, error) { return ParseTransportHeaderLine(v) },
+	HeaderNameSession:   func(v string) (HeaderLine, error) { return ParseSessionHeaderLine(v) },
+	HeaderNameRange:     func(v string) (HeaderLine, error) { return ParseRangeHeaderLine(v) },
+	HeaderNameRTPInfo:   func(v string) (HeaderLine, error) { return ParseRTPInfoHeaderLine(v) },
+	HeaderNameScale:     func(v string) (HeaderLine, error) { return ParseScaleHeaderLine(v) },
+	HeaderNameSpeed:     func(v string) (HeaderLine, error) { return ParseSpeedHeaderLine(v) },
+	HeaderNameContentType: func(v string) (HeaderLine, error) {
+		return ParseContentTypeHeaderLine(v)
+	},
+}
+
+// parses a header line as a GenericHeaderLine, whatever its name
+func parseGenericHeaderLine(line string) (GenericHeaderLine, error) {
 	line = strings.Trim(line, "\r\n ")
 
-	// validate "k: v" format
-	if !strings.Contains(line, ": ") {
-		return nil, errors.New("header line not in 'k: v' format")
+	// validate "k: v" format, where the space is optional (RFC2326-4.2)
+	name, val, ok := strings.Cut(line, ":")
+	if !ok {
+		return GenericHeaderLine{}, errors.New("header line not in 'k: v' format")
 	}
 
-	// split name and val
-	sp := strings.SplitN(line, ": ", 2)
-	name := sp[0]
-	val := sp[1]
+	name = strings.TrimSpace(name)
+	val = strings.TrimSpace(val)
 
 	// name or val cannot be empty
 	if len(name) == 0 || len(val) == 0 {
-		return nil, errors.New("empty name or value in header line")
+		return GenericHeaderLine{}, errors.New("empty name or value in header line")
 	}
 
-	// handle structured header fields first, the rest can be GenericHeaderLine by default.
-	switch name {
-	case HeaderNameTransport:
-		return ParseTransportHeaderLine(line), nil
-	default:
-		return GenericHeaderLine{name: name, rawValue: val}, nil
-	}
+	return GenericHeaderLine{name: CanonicalHeaderName(name), rawValue: val}, nil
 }
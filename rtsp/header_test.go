@@ -0,0 +1,309 @@
+package rtsp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseTransportInfo(t *testing.T) {
+	tests := []struct {
+		spec string
+		want TransportInfo
+	}{
+		{
+			spec: "RTP/AVP;unicast;client_port=5000-5001",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+				ClientPortStart: 5000, ClientPortEnd: 5001,
+			},
+		},
+		{
+			spec: "RTP/AVP/UDP;unicast;client_port=5000-5001;server_port=6000-6001;ssrc=0000ABCD",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+				ClientPortStart: 5000, ClientPortEnd: 5001, ServerPortStart: 6000, ServerPortEnd: 6001,
+				SSRC: 0xABCD, HasSSRC: true,
+			},
+		},
+		{
+			spec: "RTP/AVP/TCP;unicast;interleaved=2-3",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP, Mode: TransportUnicast,
+				InterleavedStart: 2, InterleavedEnd: 3,
+			},
+		},
+		{
+			spec: "RTP/AVP/TCP",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP,
+				InterleavedStart: 0, InterleavedEnd: 1,
+			},
+		},
+		{
+			spec: `RTP/AVP/TCP;unicast;interleaved=0-1;mode="RECORD"`,
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP, Mode: TransportUnicast,
+				InterleavedStart: 0, InterleavedEnd: 1, Methods: []RTSPMethod{RECORD},
+			},
+		},
+		{
+			spec: `RTP/AVP;unicast;client_port=5000-5001;mode=record;append`,
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+				ClientPortStart: 5000, ClientPortEnd: 5001, Methods: []RTSPMethod{RECORD}, Append: true,
+			},
+		},
+		{
+			spec: "RTP/AVP;multicast;destination=224.2.0.1;ttl=16;port=3456-3457",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportMulticast,
+				Destination: "224.2.0.1", TTL: 16, PortStart: 3456, PortEnd: 3457,
+			},
+		},
+		{
+			spec: "RTP/AVP;unicast;destination=192.168.1.20;client_port=5000-5001",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+				Destination: "192.168.1.20", ClientPortStart: 5000, ClientPortEnd: 5001,
+			},
+		},
+		{
+			// parameters in any order, and a single port paired for RTCP
+			spec: "RTP/AVP;client_port=5000;unicast",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+				ClientPortStart: 5000, ClientPortEnd: 5001,
+			},
+		},
+		{
+			spec: "RTP/AVP/TCP;interleaved=4",
+			want: TransportInfo{
+				Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP,
+				InterleavedStart: 4, InterleavedEnd: 5,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseTransportInfo(tt.spec)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTransportInfoErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"RTP",
+		"RTP/",
+		"RTP/AVP/SCTP",
+		"RTP/AVP/UDP/TCP",
+		"RTP/AVP;interleaved=0-1",
+		"RTP/AVP;client_port=x",
+		"RTP/AVP;client_port=5001-5000",
+		"RTP/AVP;client_port=-1",
+		"RTP/AVP;ttl=256",
+		"RTP/AVP;ssrc=nothex",
+		"RTP/AVP;mode=SING",
+		"client_port=5000;RTP/AVP",
+	} {
+		if got, err := parseTransportInfo(spec); !errors.Is(err, ErrInvalidTransport) {
+			t.Errorf("%q: got %+v, %v, want ErrInvalidTransport", spec, got, err)
+		}
+	}
+}
+
+func TestTransportInfoRoundTrip(t *testing.T) {
+	for _, transport := range []TransportInfo{
+		{
+			Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+			ClientPortStart: 5000, ClientPortEnd: 5001,
+		},
+		{
+			Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+			ClientPortStart: 5000, ClientPortEnd: 5001, ServerPortStart: 6000, ServerPortEnd: 6001,
+			SSRC: 0xDEADBEEF, HasSSRC: true,
+		},
+		{
+			Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP, Mode: TransportUnicast,
+			InterleavedStart: 0, InterleavedEnd: 1,
+		},
+		{
+			Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP, Mode: TransportUnicast,
+			InterleavedStart: 2, InterleavedEnd: 3, Methods: []RTSPMethod{RECORD}, Append: true,
+		},
+		{
+			Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportUnicast,
+			Destination: "192.168.1.20", Source: "192.168.1.10",
+			ClientPortStart: 5000, ClientPortEnd: 5001, Methods: []RTSPMethod{PLAY},
+		},
+		{
+			Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportUDP, Mode: TransportMulticast,
+			Destination: "224.2.0.1", TTL: 127, PortStart: 3456, PortEnd: 3457,
+		},
+	} {
+		spec := transport.String()
+
+		t.Run(spec, func(t *testing.T) {
+			got, err := parseTransportInfo(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, transport) {
+				t.Fatalf("got %+v, want %+v", got, transport)
+			}
+		})
+	}
+}
+
+func TestTransportHeaderLineRoundTrip(t *testing.T) {
+	value := "RTP/AVP/TCP;unicast;interleaved=0-1,RTP/AVP;unicast;client_port=5000-5001"
+
+	header, err := ParseTransportHeaderLine(HeaderNameTransport + ": " + value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(header.Transports) != 2 {
+		t.Fatalf("got %d transports, want 2", len(header.Transports))
+	}
+
+	got, err := NewTransportHeaderLine(header.Transports).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != value {
+		t.Fatalf("got %q, want %q", got, value)
+	}
+}
+
+func TestCanonicalHeaderName(t *testing.T) {
+	for name, want := range map[string]string{
+		"cseq":             "CSeq",
+		"CSEQ":             "CSeq",
+		"www-authenticate": "WWW-Authenticate",
+		"rtp-info":         "RTP-Info",
+		"content-type":     "Content-Type",
+		"x-custom-field":   "X-Custom-Field",
+		"X-CUSTOM":         "X-Custom",
+	} {
+		if got := CanonicalHeaderName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var h Headers
+
+	h.AddGenericLine("x-field", "1")
+	h.AddGenericLine("Accept", "application/sdp")
+	h.AddGenericLine("X-FIELD", "2")
+
+	// names are case-insensitive, and canonical once added
+	if got := h.Values("X-Field"); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("got values %q, want both fields in order", got)
+	}
+
+	if hl, ok := h.GetLine("x-field"); !ok || hl.Name() != "X-Field" || hl.ValueNoError() != "1" {
+		t.Fatalf("got %v, %v, want the first field", hl, ok)
+	}
+
+	// a put replaces every field of the name, in place of the first
+	h.PutGenericLine("x-Field", "3")
+
+	if got := h.Values("x-field"); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Fatalf("got values %q after put, want only the new one", got)
+	}
+
+	if h.Len() != 2 {
+		t.Fatalf("got %d fields, want 2", h.Len())
+	}
+
+	if b, _ := h.Marshal(); string(b) != "X-Field: 3\r\nAccept: application/sdp\r\n" {
+		t.Fatalf("got %q, want the put field in place of the first", b)
+	}
+
+	if !h.Delete("X-FIELD") || h.Delete("x-field") {
+		t.Fatal("delete does not report whether there were fields of the name")
+	}
+
+	if _, ok := h.GetLine("x-field"); ok || len(h.Values("x-field")) != 0 {
+		t.Fatal("fields are left after delete")
+	}
+
+	if hl := h.GetLineNoFail("x-field"); hl.ValueNoError() != "" {
+		t.Fatalf("got %v of no field", hl)
+	}
+}
+
+func TestHeadersReplaceTypedLine(t *testing.T) {
+	h, err := NewHeadersFromString("Session: abc;timeout=30\r\nTransport: RTP/AVP;unicast;client_port=5000-5001\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := h.GetLineNoFail(HeaderNameTransport).(TransportHeaderLine); !ok {
+		t.Fatalf("got %T, want the Transport line typed", h.GetLineNoFail(HeaderNameTransport))
+	}
+
+	// replaced by a line of the same type
+	h.PutLine(NewTransportHeaderLine([]TransportInfo{{
+		Protocol: "RTP", Profile: "AVP", LowerTransport: LowerTransportTCP, Mode: TransportUnicast,
+		InterleavedStart: 0, InterleavedEnd: 1,
+	}}))
+
+	transport, ok := h.GetLineNoFail(HeaderNameTransport).(TransportHeaderLine)
+	if !ok || len(transport.Transports) != 1 || !transport.Transports[0].IsInterleaved() {
+		t.Fatalf("got %v, want the interleaved transport", h.GetLineNoFail(HeaderNameTransport))
+	}
+
+	// and by a generic line of the name in any case
+	h.PutGenericLine("session", "xyz")
+
+	if lines := h.Lines(HeaderNameSession); len(lines) != 1 || lines[0].ValueNoError() != "xyz" {
+		t.Fatalf("got %v, want only the generic Session line", lines)
+	}
+
+	if h.Len() != 2 {
+		t.Fatalf("got %d fields, want 2", h.Len())
+	}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "Session: xyz\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n"; string(b) != want {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+}
+
+func TestHeadersMarshalCSeqFirst(t *testing.T) {
+	var h Headers
+
+	h.PutLine(NewSessionHeaderLine("abc", 0))
+	h.AddGenericLine("x-first", "1")
+	h.PutGenericLine("cseq", "7")
+	h.AddGenericLine("x-second", "2")
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "CSeq: 7\r\nSession: abc\r\nX-First: 1\r\nX-Second: 2\r\n"; string(b) != want {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+}
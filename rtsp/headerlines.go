@@ -0,0 +1,332 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Typed header lines, which hold the parsed value of their field. Like the
+// TransportHeaderLine, each is parsed from the value alone, and marshals the
+// value it holds.
+
+var ErrInvalidHeader = errors.New("invalid header value")
+
+// the Session header (RFC2326-12.37), e.g `QmFzZTY0;timeout=60`
+type SessionHeaderLine struct {
+	GenericHeaderLine
+	ID      SessionUID
+	Timeout time.Duration // zero if not given, which means the default of 60s
+}
+
+func NewSessionHeaderLine(id SessionUID, timeout time.Duration) SessionHeaderLine {
+	return SessionHeaderLine{
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameSession, ""),
+		ID:                id,
+		Timeout:           timeout,
+	}
+}
+
+func ParseSessionHeaderLine(value string) (SessionHeaderLine, error) {
+	id, params, _ := strings.Cut(value, ";")
+
+	h := NewSessionHeaderLine(SessionUID(strings.TrimSpace(id)), 0)
+	if h.ID == "" {
+		return SessionHeaderLine{}, fmt.Errorf("%w: empty session id", ErrInvalidHeader)
+	}
+
+	for param := range strings.SplitSeq(params, ";") {
+		name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+		if strings.EqualFold(name, "timeout") {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return SessionHeaderLine{}, fmt.Errorf("%w: bad session timeout: %q", ErrInvalidHeader, value)
+			}
+			h.Timeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return h, nil
+}
+
+func (h SessionHeaderLine) Value() (string, error) {
+	if h.Timeout <= 0 {
+		return string(h.ID), nil
+	}
+
+	return fmt.Sprintf("%s;timeout=%d", h.ID, int(h.Timeout.Seconds())), nil
+}
+
+func (h SessionHeaderLine) ValueNoError() string {
+	v, _ := h.Value()
+	return v
+}
+
+func (h SessionHeaderLine) Marshal() ([]byte, error) {
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), h.ValueNoError()), nil
+}
+
+// the Range header (RFC2326-12.29), in normal play time
+type RangeHeaderLine struct {
+	GenericHeaderLine
+	Range NPTRange
+}
+
+func NewRangeHeaderLine(r NPTRange) RangeHeaderLine {
+	return RangeHeaderLine{
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameRange, ""),
+		Range:             r,
+	}
+}
+
+func ParseRangeHeaderLine(value string) (RangeHeaderLine, error) {
+	r, err := ParseNPTRange(value)
+	if err != nil {
+		return RangeHeaderLine{}, err
+	}
+
+	return NewRangeHeaderLine(r), nil
+}
+
+func (h RangeHeaderLine) Value() (string, error) {
+	return h.Range.String(), nil
+}
+
+func (h RangeHeaderLine) ValueNoError() string {
+	return h.Range.String()
+}
+
+func (h RangeHeaderLine) Marshal() ([]byte, error) {
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), h.ValueNoError()), nil
+}
+
+// the position that a stream of the RTP-Info header begins playing from
+type RTPInfo struct {
+	URL        string
+	Seq        uint16 // of the first packet
+	HasSeq     bool
+	RTPTime    uint32 // of the first packet
+	HasRTPTime bool
+}
+
+func (i RTPInfo) String() string {
+	var b strings.Builder
+
+	b.WriteString("url=" + i.URL)
+
+	if i.HasSeq {
+		fmt.Fprintf(&b, ";seq=%d", i.Seq)
+	}
+
+	if i.HasRTPTime {
+		fmt.Fprintf(&b, ";rtptime=%d", i.RTPTime)
+	}
+
+	return b.String()
+}
+
+// the RTP-Info header (RFC2326-12.33), with a stream for each track played
+type RTPInfoHeaderLine struct {
+	GenericHeaderLine
+	Streams []RTPInfo
+}
+
+func NewRTPInfoHeaderLine(streams []RTPInfo) RTPInfoHeaderLine {
+	return RTPInfoHeaderLine{
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameRTPInfo, ""),
+		Streams:           streams,
+	}
+}
+
+func ParseRTPInfoHeaderLine(value string) (RTPInfoHeaderLine, error) {
+	var streams []RTPInfo
+
+	for stream := range strings.SplitSeq(value, ",") {
+		var info RTPInfo
+
+		for param := range strings.SplitSeq(strings.TrimSpace(stream), ";") {
+			name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+			switch name {
+			case "url":
+				info.URL = v
+			case "seq":
+				seq, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					return RTPInfoHeaderLine{}, fmt.Errorf("%w: bad RTP-Info seq: %q", ErrInvalidHeader, v)
+				}
+				info.Seq, info.HasSeq = uint16(seq), true
+			case "rtptime":
+				rtptime, err := strconv.ParseUint(v, 10, 32)
+				if err != nil {
+					return RTPInfoHeaderLine{}, fmt.Errorf("%w: bad RTP-Info rtptime: %q", ErrInvalidHeader, v)
+				}
+				info.RTPTime, info.HasRTPTime = uint32(rtptime), true
+			}
+		}
+
+		if info.URL == "" {
+			return RTPInfoHeaderLine{}, fmt.Errorf("%w: RTP-Info without a url: %q", ErrInvalidHeader, value)
+		}
+
+		streams = append(streams, info)
+	}
+
+	return NewRTPInfoHeaderLine(streams), nil
+}
+
+func (h RTPInfoHeaderLine) Value() (string, error) {
+	if len(h.Streams) == 0 {
+		return "", fmt.Errorf("%w: no RTP-Info streams", ErrInvalidHeader)
+	}
+
+	streams := make([]string, len(h.Streams))
+	for i, info := range h.Streams {
+		streams[i] = info.String()
+	}
+
+	return strings.Join(streams, ","), nil
+}
+
+func (h RTPInfoHeaderLine) ValueNoError() string {
+	v, err := h.Value()
+
+	if err != nil {
+		return ""
+	}
+
+	return v
+}
+
+func (h RTPInfoHeaderLine) Marshal() ([]byte, error) {
+	v, err := h.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), v), nil
+}
+
+// the Scale header (RFC2326-12.34)
+type ScaleHeaderLine struct {
+	GenericHeaderLine
+	Scale float64
+}
+
+func NewScaleHeaderLine(scale float64) ScaleHeaderLine {
+	return ScaleHeaderLine{
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameScale, ""),
+		Scale:             scale,
+	}
+}
+
+func ParseScaleHeaderLine(value string) (ScaleHeaderLine, error) {
+	scale, err := ParseScale(value)
+	if err != nil {
+		return ScaleHeaderLine{}, err
+	}
+
+	return NewScaleHeaderLine(scale), nil
+}
+
+func (h ScaleHeaderLine) Value() (string, error) {
+	return formatRate(h.Scale), nil
+}
+
+func (h ScaleHeaderLine) ValueNoError() string {
+	return formatRate(h.Scale)
+}
+
+func (h ScaleHeaderLine) Marshal() ([]byte, error) {
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), h.ValueNoError()), nil
+}
+
+// the Speed header (RFC2326-12.35)
+type SpeedHeaderLine struct {
+	GenericHeaderLine
+	Speed float64
+}
+
+func NewSpeedHeaderLine(speed float64) SpeedHeaderLine {
+	return SpeedHeaderLine{
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameSpeed, ""),
+		Speed:             speed,
+	}
+}
+
+func ParseSpeedHeaderLine(value string) (SpeedHeaderLine, error) {
+	speed, err := ParseSpeed(value)
+	if err != nil {
+		return SpeedHeaderLine{}, err
+	}
+
+	return NewSpeedHeaderLine(speed), nil
+}
+
+func (h SpeedHeaderLine) Value() (string, error) {
+	return formatRate(h.Speed), nil
+}
+
+func (h SpeedHeaderLine) ValueNoError() string {
+	return formatRate(h.Speed)
+}
+
+func (h SpeedHeaderLine) Marshal() ([]byte, error) {
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), h.ValueNoError()), nil
+}
+
+// the Content-Type header (RFC2326-12.16), e.g `application/sdp`
+type ContentTypeHeaderLine struct {
+	GenericHeaderLine
+	MediaType string // lower case
+	Params    map[string]string
+}
+
+func NewContentTypeHeaderLine(mediaType string, params map[string]string) ContentTypeHeaderLine {
+	return ContentTypeHeaderLine{
+		GenericHeaderLine: NewGenericHeaderLine(HeaderNameContentType, ""),
+		MediaType:         strings.ToLower(mediaType),
+		Params:            params,
+	}
+}
+
+func ParseContentTypeHeaderLine(value string) (ContentTypeHeaderLine, error) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ContentTypeHeaderLine{}, fmt.Errorf("%w: bad Content-Type: %q", ErrInvalidHeader, value)
+	}
+
+	return NewContentTypeHeaderLine(mediaType, params), nil
+}
+
+func (h ContentTypeHeaderLine) Value() (string, error) {
+	v := mime.FormatMediaType(h.MediaType, h.Params)
+	if v == "" {
+		return "", fmt.Errorf("%w: bad Content-Type: %q", ErrInvalidHeader, h.MediaType)
+	}
+
+	return v, nil
+}
+
+func (h ContentTypeHeaderLine) ValueNoError() string {
+	v, err := h.Value()
+
+	if err != nil {
+		return ""
+	}
+
+	return v
+}
+
+func (h ContentTypeHeaderLine) Marshal() ([]byte, error) {
+	v, err := h.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return fmt.Appendf(nil, "%s: %s\r\n", h.Name(), v), nil
+}
@@ -0,0 +1,222 @@
+package rtsp_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtp"
+	"github.com/rebeljah/picast/rtsp"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+func TestMain(m *testing.M) {
+	// the servers log every request
+	log.SetOutput(io.Discard)
+
+	os.Exit(m.Run())
+}
+
+const (
+	testVideoPID = 0x100
+
+	// TS packets of the test media per second, and between its PCRs
+	testPacketRate = 1000
+	testPCRSpacing = 10
+)
+
+// returns a TS packet of the PID, with a PCR if pcr is not negative
+func testTSPacket(pid uint16, pcr int64) []byte {
+	p := make([]byte, media.TSPacketSize)
+	p[0] = 0x47
+	p[1] = byte(pid >> 8)
+	p[2] = byte(pid)
+	p[3] = 0x10
+
+	if pcr >= 0 {
+		base := uint64(pcr)
+		p[3] = 0x30
+		p[4] = 7
+		p[5] = 0x10
+		p[6] = byte(base >> 25)
+		p[7] = byte(base >> 17)
+		p[8] = byte(base >> 9)
+		p[9] = byte(base >> 1)
+		p[10] = byte(base<<7) | 0x7E
+	}
+
+	return p
+}
+
+// writes a video of the duration, which plays in real time, and returns its
+// metadata
+func newTestMedia(t *testing.T, uid media.UID, duration time.Duration) media.Metadata {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), string(uid)+".ts")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	packets := int(duration.Seconds() * testPacketRate)
+	ticksPerPCR := int64(media.TSClockRate * testPCRSpacing / testPacketRate)
+
+	for i := range packets {
+		pcr := int64(-1)
+		if i%testPCRSpacing == 0 {
+			pcr = int64(i/testPCRSpacing) * ticksPerPCR
+		}
+
+		if _, err := f.Write(testTSPacket(testVideoPID, pcr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return media.Metadata{
+		Title:    string(uid),
+		UID:      uid,
+		Path:     path,
+		Duration: duration.Seconds(),
+		Structure: ffprobe.ProbeData{Streams: []*ffprobe.Stream{
+			{Index: 0, ID: "0x100", CodecType: "video"},
+		}},
+	}
+}
+
+// serves the RTSP server on a loopback port until the test ends, and returns
+// its address
+func serveTest(t *testing.T, s *rtsp.RTSPServer) string {
+	t.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.ServeConn(conn)
+		}
+	}()
+
+	t.Cleanup(func() {
+		ls.Close()
+		s.Interrupt(nil)
+	})
+
+	return ls.Addr().String()
+}
+
+// returns a server of the media, on the RTP server
+func newTestServer(t *testing.T, metadata ...media.Metadata) *rtsp.RTSPServer {
+	manifest := media.NewFileManifest()
+	for _, m := range metadata {
+		manifest.Put(m)
+	}
+
+	rtpServer := rtp.NewServer()
+	t.Cleanup(func() { rtpServer.Interrupt(nil) })
+
+	return rtsp.NewRTSPServer(rtpServer, manifest)
+}
+
+// counts the requests that a server handles, by method
+type methodCounter struct {
+	sync.Mutex
+	counts map[rtsp.RTSPMethod]int
+}
+
+// counts the requests of the server, before it handles them
+func countRequests(s *rtsp.RTSPServer) *methodCounter {
+	c := &methodCounter{counts: make(map[rtsp.RTSPMethod]int)}
+
+	s.Handler = rtsp.NewMiddleware(rtsp.HandlerFunc(func(w rtsp.ResponseWriter, r *rtsp.Request) {
+		c.Lock()
+		c.counts[r.Method]++
+		c.Unlock()
+	}), s.Handler)
+
+	return c
+}
+
+func (c *methodCounter) count(method rtsp.RTSPMethod) int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.counts[method]
+}
+
+// waits until the condition holds, or fails the test after the timeout
+func eventually(t *testing.T, timeout time.Duration, condition func() bool, format string, args ...any) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// plays every track of the media at the URL, and returns the client
+func playTest(t *testing.T, rawURL string, lowerTransport string) *rtsp.Client {
+	t.Helper()
+
+	client, err := rtsp.Dial(rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	sd, base, err := client.Describe()
+	if err != nil {
+		t.Fatalf("DESCRIBE %s: %v", rawURL, err)
+	}
+
+	for _, track := range rtsp.TrackURLs(sd, base) {
+		if _, err := client.Setup(track, lowerTransport); err != nil {
+			t.Fatalf("SETUP %s: %v", track, err)
+		}
+	}
+
+	if _, err := client.Play(nil); err != nil {
+		t.Fatalf("PLAY %s: %v", rawURL, err)
+	}
+
+	return client
+}
+
+// waits for the client to receive an RTP packet
+func awaitPacket(t *testing.T, client *rtsp.Client) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p, ok := <-client.Packets():
+			if !ok {
+				t.Fatalf("client closed before receiving a packet: %v", client.Err())
+			}
+			if !p.RTCP {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a packet")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// marks the start of an interleaved binary frame on an RTSP connection.
+const interleavedMagic byte = '$'
+
+// the largest payload that fits the 16 bit length of an interleaved frame.
+const maxInterleavedPayload = 0xFFFF
+
+// frames received on a channel faster than they are read are dropped. Enough
+// are buffered for the bursts of a recording client.
+const channelReaderBufferSize = 256
+
+var ErrInterleavedFrameTooLarge = errors.New("interleaved frame payload too large")
+
+// InterleavedConn lets the RTP server send data over the RTSP connection of a
+// session, multiplexed with RTSP messages (RFC2326-10.12).
+type InterleavedConn interface {
+	// returns a writer that sends each write as one frame on the given channel.
+	ChannelWriter(channel uint8) io.Writer
+
+	// returns a reader of the frames received on the given channel, one frame
+	// per read. Reads return io.EOF once the reader or the connection is closed.
+	ChannelReader(channel uint8) io.ReadCloser
+}
+
+// implements io.Writer by framing each write as `$` + channel + length + payload.
+type interleavedWriter struct {
+	conn    *conn
+	channel uint8
+}
+
+func (w interleavedWriter) Write(p []byte) (int, error) {
+	if len(p) > maxInterleavedPayload {
+		return 0, ErrInterleavedFrameTooLarge
+	}
+
+	frame := make([]byte, 4+len(p))
+	frame[0] = interleavedMagic
+	frame[1] = w.channel
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(p)))
+	copy(frame[4:], p)
+
+	// the whole frame is written under the connection write lock so that it can
+	// never be split by an RTSP response.
+	if err := w.conn.writeLocked(frame); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// implements io.ReadCloser over the frames the connection receives on a channel.
+type interleavedReader struct {
+	conn      *conn
+	channel   uint8
+	frames    chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newInterleavedReader(c *conn, channel uint8) *interleavedReader {
+	return &interleavedReader{
+		conn:    c,
+		channel: channel,
+		frames:  make(chan []byte, channelReaderBufferSize),
+		closed:  make(chan struct{}),
+	}
+}
+
+// reads the next frame into p. A frame larger than p is truncated.
+func (r *interleavedReader) Read(p []byte) (int, error) {
+	select {
+	case frame := <-r.frames:
+		return copy(p, frame), nil
+	case <-r.closed:
+		return 0, io.EOF
+	}
+}
+
+func (r *interleavedReader) Close() error {
+	r.conn.removeChannelReader(r)
+	r.close()
+	return nil
+}
+
+func (r *interleavedReader) close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+}
+
+// hands a received frame to the reader without blocking the connection.
+func (r *interleavedReader) deliver(payload []byte) {
+	select {
+	case r.frames <- payload:
+	default:
+	}
+}
+
+// reads one interleaved frame from r. The `$` must be the next byte.
+func readInterleavedFrame(r io.Reader) (uint8, []byte, error) {
+	var head [4]byte
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	if head[0] != interleavedMagic {
+		return 0, nil, ErrInvalidFormat
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(head[2:4]))
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return head[1], payload, nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -72,12 +73,41 @@ type RequestLine struct {
 type Request struct {
 	RequestLine
 	Message
+
+	// the client that sent a request to the server
+	RemoteAddr net.Addr
+
+	conn    *conn
+	session *Session
+	user    string
+}
+
+// Session returns the session that a request to the server was made in, or
+// nil before the session is looked up and for requests outside of one.
+func (r *Request) Session() *Session {
+	return r.session
+}
+
+// Conn returns the connection that a request to the server was received on,
+// for the interleaved transports of the streams it sets up, or nil for a
+// request that was not received by the server.
+func (r *Request) Conn() InterleavedConn {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn
+}
+
+// User returns the name of the user that a request to the server was
+// authenticated as, or "" if it was not.
+func (r *Request) User() string {
+	return r.user
 }
 
 func (r Request) Marshal() ([]byte, error) {
 	buf := make([]byte, 0)
 
-	fmt.Appendf(buf, "%s %s %s\r\n", string(r.Method), r.URL.String(), r.Version)
+	buf = fmt.Appendf(buf, "%s %s %s\r\n", string(r.Method), r.URL.String(), r.Version)
 
 	msg, err := r.Message.Marshal()
 
@@ -98,61 +128,6 @@ func NewRequest(method RTSPMethod, url *url.URL) Request {
 	}
 }
 
-func newRequestFromString(s string) (Request, error) {
-	messageDelineatorPosition := strings.Index(s, "\r\n")
-	headerStart := messageDelineatorPosition + 2
-	requestLineParts := strings.SplitN(s[0:messageDelineatorPosition], " ", 3)
-
-	// note that requests must never be malformed as long as
-	// this project remains for secured-LAN-only use.
-	// malformed requests are treated as serious security concerns, so panic.
-
-	method := RTSPMethod(requestLineParts[0])
-
-	if !IsValidRTSPMethod(requestLineParts[0]) {
-		return Request{}, ErrBadRequest
-	}
-
-	url, err := url.Parse(requestLineParts[1])
-
-	if err != nil {
-		return Request{}, ErrBadRequest
-	}
-
-	version := requestLineParts[2]
-
-	if version != RTSP_VERSION_STRING {
-		return Request{}, ErrBadRequest
-	}
-
-	request := NewRequest(method, url)
-
-	if headerStart < len(s) {
-		request.Message, err = NewMessageFromString(s[headerStart:])
-		if err != nil {
-			return Request{}, err
-		}
-	}
-
-	return request, nil
-}
-
-type requestContext struct {
-	raddr    net.Addr
-	request  *Request
-	response *Response
-	session  *Session
-}
-
-func newRequestContext(raddr net.Addr, req *Request, resp *Response, session *Session) *requestContext {
-	return &requestContext{
-		raddr:    raddr,
-		request:  req,
-		response: resp,
-		session:  session,
-	}
-}
-
 type ResponseLine struct {
 	Version    string
 	StatusCode RTSPStatus
@@ -175,26 +150,42 @@ func newResponse(statusCode RTSPStatus) *Response {
 }
 
 func (r *Response) marshal() ([]byte, error) {
+	if n := len(r.Body); n == 0 {
+		r.Headers.Delete(HeaderNameContentLength)
+	} else {
+		r.Headers.PutGenericLine(HeaderNameContentLength, strconv.Itoa(n))
+	}
+
 	msgbuf, err := r.Message.Marshal()
 	if err != nil {
 		return nil, err
 	}
 
-	return fmt.Appendf(nil, "%s %s %s\r\n%s", r.Version, r.StatusCode, r.StatusText, msgbuf), nil
+	return fmt.Appendf(nil, "%s %s %s\r\n%s", r.Version, string(r.StatusCode), r.StatusText, msgbuf), nil
 }
 
-func (r *Response) writeHeader(c RTSPStatus) {
+// Header, WriteHeader, Write and Status make the response the ResponseWriter
+// of the server, which sends it once the request is handled.
+func (r *Response) Header() *Headers {
+	return &r.Headers
+}
+
+func (r *Response) WriteHeader(c RTSPStatus) {
 	r.StatusCode = c
 	r.StatusText = r.StatusCode.String()
 }
 
-func (r *Response) writeBody(b []byte) {
-	r.Body = make([]byte, len(b))
-	copy(r.Body, b)
+func (r *Response) Write(b []byte) (int, error) {
+	r.Body = append(r.Body, b...)
+	return len(b), nil
+}
+
+func (r *Response) Status() RTSPStatus {
+	return r.StatusCode
 }
 
-// calls WriteHeader with the given status and sets the message body to the error text
-func (r *Response) writeError(c RTSPStatus, err error) {
-	r.writeHeader(c)
-	r.writeBody([]byte(err.Error()))
+// writes the status, with the error text as the body
+func writeError(w ResponseWriter, c RTSPStatus, err error) {
+	w.WriteHeader(c)
+	w.Write([]byte(err.Error()))
 }
@@ -1,5 +1,7 @@
 package rtsp
 
+import "strings"
+
 // RFC2326-10
 type RTSPMethod string
 
@@ -35,3 +37,29 @@ func IsValidRTSPMethod(method string) bool {
 	_, exists := validRTSPMethods[method]
 	return exists
 }
+
+// whether the method is a token (RFC2326-15.1), which lets handlers serve
+// extension methods besides those of RFC2326
+func isExtensionMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+
+	for _, c := range []byte(method) {
+		if c <= ' ' || c >= 0x7F || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// the methods as the value of a Public or Allow header
+func joinMethods(methods []RTSPMethod) string {
+	names := make([]string, len(methods))
+	for i, method := range methods {
+		names[i] = string(method)
+	}
+
+	return strings.Join(names, ", ")
+}
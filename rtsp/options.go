@@ -0,0 +1,37 @@
+package rtsp
+
+import (
+	"slices"
+	"strings"
+)
+
+// Version is the version of picast, reported in the Server header of each
+// response. It is set when building a release, e.g with
+// -ldflags "-X github.com/rebeljah/picast/rtsp.Version=1.0.0"
+var Version = "dev"
+
+// refuses requests that require options the server does not support
+// (RFC2326-12.32), and responds with those options
+func (s *RTSPServer) handleRequiredOptions(w ResponseWriter, r *Request) {
+	var unsupported []string
+
+	for _, name := range []string{HeaderNameRequire, HeaderNameProxyRequire} {
+		header, ok := r.Headers.GetLine(name)
+		if !ok {
+			continue
+		}
+
+		for tag := range strings.SplitSeq(header.ValueNoError(), ",") {
+			tag = strings.TrimSpace(tag)
+
+			if tag != "" && !slices.Contains(s.Options, tag) && !slices.Contains(unsupported, tag) {
+				unsupported = append(unsupported, tag)
+			}
+		}
+	}
+
+	if len(unsupported) > 0 {
+		w.Header().PutGenericLine(HeaderNameUnsupported, strings.Join(unsupported, ", "))
+		w.WriteHeader(OptionNotSupported)
+	}
+}
@@ -0,0 +1,337 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+const ContentTypeParameters string = "text/parameters"
+
+// parameters of a session, reported by GET_PARAMETER
+const (
+	ParameterPosition    = "position"     // normal play time, in seconds
+	ParameterBitrate     = "bitrate"      // measured send rate, in bits per second
+	ParameterPacketsSent = "packets_sent" // RTP packets sent
+	ParameterRTCPLoss    = "rtcp_loss"    // fraction of packets lost, from the latest receiver reports
+)
+
+// parameters of a session, changed by SET_PARAMETER
+const (
+	ParameterAudioLanguage = "audio_language" // ISO 639 code of the audio to stream
+	ParameterBitrateCap    = "bitrate_cap"    // max send rate in bits per second, 0 for none
+)
+
+// the lowest bitrate cap, a byte per second, as streams are limited in bytes
+const MinBitrateCap = 8
+
+var readableParameters = []string{
+	ParameterPosition,
+	ParameterBitrate,
+	ParameterPacketsSent,
+	ParameterRTCPLoss,
+}
+
+var writableParameters = []string{
+	ParameterAudioLanguage,
+	ParameterBitrateCap,
+}
+
+// one `name: value` line of a text/parameters body. GET_PARAMETER bodies list
+// names only.
+type parameter struct {
+	name  string
+	value string
+}
+
+func parseParameters(body []byte) []parameter {
+	var params []parameter
+
+	for line := range strings.Lines(string(body)) {
+		name, value, _ := strings.Cut(line, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if name == "" {
+			continue
+		}
+
+		params = append(params, parameter{name: name, value: strings.TrimSpace(value)})
+	}
+
+	return params
+}
+
+func marshalParameters(params []parameter) []byte {
+	var b strings.Builder
+
+	for _, p := range params {
+		if p.value == "" {
+			fmt.Fprintf(&b, "%s\r\n", p.name)
+		} else {
+			fmt.Fprintf(&b, "%s: %s\r\n", p.name, p.value)
+		}
+	}
+
+	return []byte(b.String())
+}
+
+// responds 451 and lists the parameters that were not understood
+func writeUnknownParameters(w ResponseWriter, names []string) {
+	params := make([]parameter, len(names))
+	for i, name := range names {
+		params[i] = parameter{name: name}
+	}
+
+	w.WriteHeader(InvalidParameter)
+	w.Header().PutLine(NewContentTypeHeaderLine(ContentTypeParameters, nil))
+	w.Write(marshalParameters(params))
+}
+
+// GET_PARAMETER without a body is a keepalive, the session was already
+// refreshed on its way here. Otherwise the listed parameters are reported over
+// the streams the request URL controls.
+func (s *RTSPServer) handleGetParameter(w ResponseWriter, r *Request) {
+	session := r.Session()
+
+	params := parseParameters(r.Body)
+
+	if len(params) == 0 {
+		return
+	}
+
+	if session == nil {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	var unknown []string
+	for _, p := range params {
+		if !slices.Contains(readableParameters, p.name) {
+			unknown = append(unknown, p.name)
+		}
+	}
+
+	if len(unknown) > 0 {
+		writeUnknownParameters(w, unknown)
+		return
+	}
+
+	path, status := s.resolveMediaPath(r.URL)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	session.RLock()
+	defer session.RUnlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	tracks, status := session.controlledTracks(path, GET_PARAMETER)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	stats := make([]StreamStats, len(tracks))
+
+	for i, track := range tracks {
+		var err error
+		if stats[i], err = s.rtpServer.StreamStats(session.Streams[track].StreamUID); err != nil {
+			writeError(w, InternalServerError, err)
+			return
+		}
+	}
+
+	for i, p := range params {
+		params[i].value = parameterValue(p.name, stats)
+	}
+
+	w.Header().PutLine(NewContentTypeHeaderLine(ContentTypeParameters, nil))
+	w.Write(marshalParameters(params))
+}
+
+// reports a parameter over the stats of every stream of a request. Counts and
+// rates are summed, while the loss is that of the worst stream.
+func parameterValue(name string, stats []StreamStats) string {
+	switch name {
+	case ParameterPosition:
+		return strconv.FormatFloat(stats[0].Position, 'f', 3, 64)
+	case ParameterBitrate:
+		var bitrate float64
+		for _, st := range stats {
+			bitrate += st.Bitrate
+		}
+		return strconv.FormatFloat(bitrate, 'f', 0, 64)
+	case ParameterPacketsSent:
+		var sent uint64
+		for _, st := range stats {
+			sent += uint64(st.PacketsSent)
+		}
+		return strconv.FormatUint(sent, 10)
+	case ParameterRTCPLoss:
+		var loss float64
+		for _, st := range stats {
+			loss = max(loss, st.FractionLost)
+		}
+		return strconv.FormatFloat(loss, 'f', 4, 64)
+	default:
+		return ""
+	}
+}
+
+// SET_PARAMETER changes the listed parameters of every stream the request URL
+// controls. Nothing is changed unless every parameter is understood and its
+// value can be applied.
+func (s *RTSPServer) handleSetParameter(w ResponseWriter, r *Request) {
+	session := r.Session()
+
+	params := parseParameters(r.Body)
+
+	if len(params) == 0 {
+		w.WriteHeader(BadRequest)
+		return
+	}
+
+	var unknown []string
+	for _, p := range params {
+		if slices.Contains(readableParameters, p.name) {
+			w.WriteHeader(ParameterIsReadOnly)
+			return
+		}
+
+		if !slices.Contains(writableParameters, p.name) {
+			unknown = append(unknown, p.name)
+		}
+	}
+
+	if len(unknown) > 0 {
+		writeUnknownParameters(w, unknown)
+		return
+	}
+
+	path, status := s.resolveMediaPath(r.URL)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	tracks, status := session.controlledTracks(path, SET_PARAMETER)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	// every value is checked before any is applied, so that a request changes
+	// all of its parameters or none of them
+	var invalid []string
+	for _, p := range params {
+		if err := s.checkParameter(path, tracks, p); err != nil {
+			log.Printf("RTSP SET_PARAMETER %s rejected for session %v: %v", p.name, session.UID, err)
+			invalid = append(invalid, p.name)
+		}
+	}
+
+	if len(invalid) > 0 {
+		writeUnknownParameters(w, invalid)
+		return
+	}
+
+	for _, p := range params {
+		for _, track := range tracks {
+			uid := session.Streams[track].StreamUID
+
+			if err := s.setParameter(uid, p); err != nil {
+				log.Printf("RTSP SET_PARAMETER %s failed for stream %v: %v", p.name, uid, err)
+				writeError(w, InternalServerError, err)
+				return
+			}
+		}
+	}
+}
+
+var errBadParameterValue = errors.New("bad parameter value")
+
+// parses a bitrate cap in bits per second, 0 for none
+func parseBitrateCap(value string) (int, error) {
+	bitsPerSecond, err := strconv.Atoi(value)
+	if err != nil || bitsPerSecond < 0 || (bitsPerSecond > 0 && bitsPerSecond < MinBitrateCap) {
+		return 0, fmt.Errorf("%w: %q", errBadParameterValue, value)
+	}
+	return bitsPerSecond, nil
+}
+
+// checks that the streams of the tracks of the media can take the value of
+// the parameter. Only streams of a media in the library can be changed, and
+// only a stream of the whole media can change its audio.
+func (s *RTSPServer) checkParameter(path mediaPath, tracks []TrackID, p parameter) error {
+	metadata, _, ok := s.lookupMedia(path.UID)
+	if !ok || path.Live != "" || metadata.IsRelay() {
+		return fmt.Errorf("%w: %s of a live or relayed stream", errBadParameterValue, p.name)
+	}
+
+	switch p.name {
+	case ParameterAudioLanguage:
+		if !slices.Equal(tracks, []TrackID{WholeMedia}) {
+			return fmt.Errorf("%w: streams are of single tracks", ErrNoSuchLanguage)
+		}
+		if !hasAudioLanguage(metadata.Structure, p.value) {
+			return fmt.Errorf("%w: %q", ErrNoSuchLanguage, p.value)
+		}
+		return nil
+	case ParameterBitrateCap:
+		_, err := parseBitrateCap(p.value)
+		return err
+	default:
+		return fmt.Errorf("%w: %s", errBadParameterValue, p.name)
+	}
+}
+
+// reports whether the media has audio tagged with the language, an ISO 639 code
+func hasAudioLanguage(structure ffprobe.ProbeData, language string) bool {
+	for _, st := range structure.Streams {
+		if st == nil || ffprobe.StreamType(st.CodecType) != ffprobe.StreamAudio {
+			continue
+		}
+
+		if lang, _ := st.TagList.GetString("language"); strings.EqualFold(lang, language) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *RTSPServer) setParameter(uid StreamUID, p parameter) error {
+	switch p.name {
+	case ParameterAudioLanguage:
+		return s.rtpServer.SelectAudioLanguage(uid, p.value)
+	case ParameterBitrateCap:
+		bitsPerSecond, err := parseBitrateCap(p.value)
+		if err != nil {
+			return err
+		}
+		return s.rtpServer.SetBitrateCap(uid, bitsPerSecond)
+	default:
+		return fmt.Errorf("%w: %s", errBadParameterValue, p.name)
+	}
+}
@@ -0,0 +1,302 @@
+package rtsp_test
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtp"
+	"github.com/rebeljah/picast/rtsp"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// returns the value of each parameter in a GET_PARAMETER response body
+func parseParameterBody(body []byte) map[string]string {
+	params := make(map[string]string)
+
+	for line := range strings.SplitSeq(string(body), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok {
+			params[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	return params
+}
+
+// sets up the first track of the media at the URL over UDP, to RTP and RTCP
+// ports of the test, and plays it. Returns the client, the transport of the
+// track, and the RTCP port, from which reports reach the server.
+func setupAndPlayUDP(t *testing.T, mediaURL string) (*rtsp.Client, rtsp.TransportInfo, *net.UDPConn) {
+	t.Helper()
+
+	client, err := rtsp.Dial(mediaURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	sd, base, err := client.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns [2]*net.UDPConn
+	for i := range conns {
+		if conns[i], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conns[i].Close() })
+	}
+
+	// the lower port is for RTP
+	if conns[0].LocalAddr().(*net.UDPAddr).Port > conns[1].LocalAddr().(*net.UDPAddr).Port {
+		conns[0], conns[1] = conns[1], conns[0]
+	}
+
+	req := rtsp.NewRequest(rtsp.SETUP, rtsp.TrackURLs(sd, base)[0])
+	req.Headers.PutGenericLine(rtsp.HeaderNameTransport, fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d",
+		conns[0].LocalAddr().(*net.UDPAddr).Port, conns[1].LocalAddr().(*net.UDPAddr).Port))
+
+	response, err := client.Do(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, ok := response.Headers.GetLine(rtsp.HeaderNameTransport)
+	transport, isTransport := header.(rtsp.TransportHeaderLine)
+	if response.StatusCode != rtsp.OK || !ok || !isTransport || len(transport.Transports) != 1 {
+		t.Fatalf("SETUP: got %v, %v", response.StatusCode, header)
+	}
+
+	if _, err := client.Play(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server sends media
+	conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conns[0].ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatalf("no RTP packet: %v", err)
+	}
+
+	return client, transport.Transports[0], conns[1]
+}
+
+func TestRTCPLossParameter(t *testing.T) {
+	metadata := newTestMedia(t, "abc", 30*time.Second)
+	mediaURL := "rtsp://" + serveTest(t, newTestServer(t, metadata)) + "/media/abc"
+
+	client, transport, rtcpConn := setupAndPlayUDP(t, mediaURL)
+
+	if !transport.HasSSRC {
+		t.Fatal("no SSRC in the transport of the stream")
+	}
+
+	// a receiver report of a quarter of the packets lost
+	report, err := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{
+		SSRC:    1,
+		Reports: []rtcp.ReceptionReport{{SSRC: transport.SSRC, FractionLost: 64, TotalLost: 10}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: transport.ServerPortEnd}
+
+	eventually(t, 5*time.Second, func() bool {
+		if _, err := rtcpConn.WriteTo(report, server); err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := client.GetParameter(rtsp.ParameterRTCPLoss)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parseParameterBody(response.Body)[rtsp.ParameterRTCPLoss] == "0.2500"
+	}, "rtcp_loss is not the reported 0.2500")
+}
+
+// an RTP server that records the parameters that are set on its streams
+type parameterRecorder struct {
+	rtsp.RTPServer
+
+	lock sync.Mutex
+	set  []string // `name: value`, in the order they were set
+}
+
+func (r *parameterRecorder) SetBitrateCap(uid rtsp.StreamUID, bitsPerSecond int) error {
+	r.record(fmt.Sprintf("%s: %d", rtsp.ParameterBitrateCap, bitsPerSecond))
+	return r.RTPServer.SetBitrateCap(uid, bitsPerSecond)
+}
+
+// the test media has no audio to select, only the tag of one
+func (r *parameterRecorder) SelectAudioLanguage(uid rtsp.StreamUID, language string) error {
+	r.record(fmt.Sprintf("%s: %s", rtsp.ParameterAudioLanguage, language))
+	return nil
+}
+
+func (r *parameterRecorder) record(parameter string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.set = append(r.set, parameter)
+}
+
+// returns the parameters set since the last call
+func (r *parameterRecorder) take() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	set := r.set
+	r.set = nil
+	return set
+}
+
+func TestParameters(t *testing.T) {
+	metadata := newTestMedia(t, "abc", 30*time.Second)
+	metadata.Structure.Streams = append(metadata.Structure.Streams, &ffprobe.Stream{
+		Index: 1, ID: "0x101", CodecType: "audio", TagList: ffprobe.Tags{"language": "eng"},
+	})
+
+	manifest := media.NewFileManifest()
+	manifest.Put(metadata)
+
+	rtpServer := rtp.NewServer()
+	t.Cleanup(func() { rtpServer.Interrupt(nil) })
+
+	recorder := &parameterRecorder{RTPServer: rtpServer}
+	mediaURL := "rtsp://" + serveTest(t, rtsp.NewRTSPServer(recorder, manifest)) + "/media/abc"
+
+	aggregate, _ := url.Parse(mediaURL)
+
+	// the whole media is streamed, so that its audio can be selected
+	client, err := rtsp.Dial(mediaURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if _, err := client.Setup(aggregate, rtsp.LowerTransportTCP); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Play(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method rtsp.RTSPMethod
+		body   string
+		want   rtsp.RTSPStatus
+		// the parameters of the response body, or set on the stream
+		wantBody []string
+		wantSet  []string
+	}{
+		{name: "keepalive", method: rtsp.GET_PARAMETER, want: rtsp.OK},
+		{
+			name:     "get",
+			method:   rtsp.GET_PARAMETER,
+			body:     "packets_sent\r\nrtcp_loss\r\nPosition\r\n",
+			want:     rtsp.OK,
+			wantBody: []string{"packets_sent", "rtcp_loss", "position"},
+		},
+		{
+			name:     "get unknown",
+			method:   rtsp.GET_PARAMETER,
+			body:     "position\r\nvolume\r\n",
+			want:     rtsp.InvalidParameter,
+			wantBody: []string{"volume"},
+		},
+		{
+			name:    "set",
+			method:  rtsp.SET_PARAMETER,
+			body:    "bitrate_cap: 64000\r\naudio_language: ENG\r\n",
+			want:    rtsp.OK,
+			wantSet: []string{"bitrate_cap: 64000", "audio_language: ENG"},
+		},
+		{
+			name:    "set no cap",
+			method:  rtsp.SET_PARAMETER,
+			body:    "bitrate_cap: 0\r\n",
+			want:    rtsp.OK,
+			wantSet: []string{"bitrate_cap: 0"},
+		},
+		{
+			name:     "set a cap below the lowest",
+			method:   rtsp.SET_PARAMETER,
+			body:     fmt.Sprintf("bitrate_cap: %d\r\n", rtsp.MinBitrateCap-1),
+			want:     rtsp.InvalidParameter,
+			wantBody: []string{"bitrate_cap"},
+		},
+		{
+			name:     "set with one bad value",
+			method:   rtsp.SET_PARAMETER,
+			body:     "bitrate_cap: 64000\r\naudio_language: fra\r\n",
+			want:     rtsp.InvalidParameter,
+			wantBody: []string{"audio_language"},
+		},
+		{
+			name:     "set with one bad value last",
+			method:   rtsp.SET_PARAMETER,
+			body:     "audio_language: eng\r\nbitrate_cap: fast\r\n",
+			want:     rtsp.InvalidParameter,
+			wantBody: []string{"bitrate_cap"},
+		},
+		{
+			name:     "set unknown",
+			method:   rtsp.SET_PARAMETER,
+			body:     "bitrate_cap: 64000\r\nvolume: 11\r\n",
+			want:     rtsp.InvalidParameter,
+			wantBody: []string{"volume"},
+		},
+		{
+			name:   "set read only",
+			method: rtsp.SET_PARAMETER,
+			body:   "bitrate_cap: 64000\r\nposition: 10\r\n",
+			want:   rtsp.ParameterIsReadOnly,
+		},
+		{name: "set nothing", method: rtsp.SET_PARAMETER, want: rtsp.BadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := rtsp.NewRequest(tt.method, aggregate)
+			if tt.body != "" {
+				req.Headers.PutGenericLine(rtsp.HeaderNameContentType, rtsp.ContentTypeParameters)
+				req.Body = []byte(tt.body)
+			}
+
+			response, err := client.Do(&req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != tt.want {
+				t.Fatalf("got %v %s, want %v", response.StatusCode, response.Body, tt.want)
+			}
+
+			var names []string
+			for line := range strings.Lines(string(response.Body)) {
+				name, _, _ := strings.Cut(line, ":")
+				names = append(names, strings.TrimSpace(name))
+			}
+
+			if !slices.Equal(names, tt.wantBody) {
+				t.Errorf("got parameters %q in the response, want %q", names, tt.wantBody)
+			}
+
+			// a request changes every parameter or none
+			if set := recorder.take(); !slices.Equal(set, tt.wantSet) {
+				t.Errorf("set %q, want %q", set, tt.wantSet)
+			}
+		})
+	}
+}
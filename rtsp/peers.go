@@ -0,0 +1,317 @@
+package rtsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Load sharing: nodes that serve the same library tell their peers their load
+// with heartbeats, UDP datagrams of JSON sent every HeartbeatInterval. A node
+// that is over its Budget sends a client that sets up a new session to the
+// least loaded peer that has room, either with a 302 response that has the
+// Location of the peer (RFC2326-11.3.3), or by setting the session up and then
+// sending the client a REDIRECT request (RFC2326-10.11). Without a peer that
+// has room, a new session is refused with 503 Service Unavailable. Live
+// streams are only on the node that records them, and are never redirected.
+
+// the default time between heartbeats
+const DefaultHeartbeatInterval = 2 * time.Second
+
+const (
+	// a peer that sends no heartbeat for this many intervals is taken to be down
+	peerMissedHeartbeats = 3
+
+	maxHeartbeatSize = 1024
+)
+
+// LoadBudget bounds the load of a node. A zero field is no limit.
+type LoadBudget struct {
+	MaxSessions int
+	MaxBitrate  float64 // bits per second of the media sent
+}
+
+// RedirectMode is how a node that is over its budget sends a client to a peer.
+type RedirectMode int
+
+const (
+	// responds to the SETUP that begins a session with 302 Moved Temporarily
+	RedirectWithStatus RedirectMode = iota
+
+	// sets the session up, and then sends the client a REDIRECT request in it
+	RedirectInSession
+)
+
+// ParseRedirectMode parses `status` or `session`.
+func ParseRedirectMode(s string) (RedirectMode, error) {
+	switch s {
+	case "status":
+		return RedirectWithStatus, nil
+	case "session":
+		return RedirectInSession, nil
+	default:
+		return 0, fmt.Errorf("unknown redirect mode: %q", s)
+	}
+}
+
+// Load is the load of a node, as its heartbeats tell its peers.
+type Load struct {
+	URL      string  `json:"url"` // that clients are redirected to, e.g rtsp://pi2.local:8554
+	Sessions int     `json:"sessions"`
+	Bitrate  float64 `json:"bitrate"` // bits per second of the media sent
+	Full     bool    `json:"full"`    // over its budget
+}
+
+type peerLoad struct {
+	Load
+	seenAt time.Time
+}
+
+// the latest load of each peer, by its heartbeat address
+type peerLoads struct {
+	sync.Mutex
+	byAddr map[string]peerLoad
+}
+
+func newPeerLoads() peerLoads {
+	return peerLoads{byAddr: make(map[string]peerLoad)}
+}
+
+func (p *peerLoads) put(addr string, load Load) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.byAddr[addr] = peerLoad{Load: load, seenAt: time.Now()}
+}
+
+// returns the least loaded of the peers that were heard from since the time
+// and have room, if any
+func (p *peerLoads) leastLoaded(since time.Time) (Load, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	var best Load
+	var found bool
+
+	for _, peer := range p.byAddr {
+		if peer.Full || peer.seenAt.Before(since) {
+			continue
+		}
+
+		if !found || peer.Sessions < best.Sessions || (peer.Sessions == best.Sessions && peer.Bitrate < best.Bitrate) {
+			best, found = peer.Load, true
+		}
+	}
+
+	return best, found
+}
+
+func (s *RTSPServer) heartbeatInterval() time.Duration {
+	if s.HeartbeatInterval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+
+	return s.HeartbeatInterval
+}
+
+// returns the load of the server now. Only sessions with a stream set up are
+// counted.
+func (s *RTSPServer) load() Load {
+	load := Load{URL: s.AdvertisedURL}
+
+	for _, session := range s.sessions.all() {
+		session.Lock()
+		if len(session.Streams) > 0 {
+			load.Sessions++
+		}
+
+		for _, st := range session.Streams {
+			if stats, err := s.rtpServer.StreamStats(st.StreamUID); err == nil {
+				load.Bitrate += stats.Bitrate
+			}
+		}
+		session.Unlock()
+	}
+
+	budget := s.Budget
+	load.Full = (budget.MaxSessions > 0 && load.Sessions >= budget.MaxSessions) ||
+		(budget.MaxBitrate > 0 && load.Bitrate >= budget.MaxBitrate)
+
+	return load
+}
+
+// returns the peer to send a new session to, if the server is over its budget.
+// The peer is nil if none has room.
+func (s *RTSPServer) redirectTarget() (peer *url.URL, overBudget bool) {
+	if s.Budget == (LoadBudget{}) || !s.load().Full {
+		return nil, false
+	}
+
+	since := time.Now().Add(-peerMissedHeartbeats * s.heartbeatInterval())
+
+	load, ok := s.peers.leastLoaded(since)
+	if !ok {
+		return nil, true
+	}
+
+	peer, err := url.Parse(load.URL)
+	if err != nil {
+		return nil, true
+	}
+
+	return peer, true
+}
+
+// returns the URL at the peer, of the same path
+func peerURL(peer *url.URL, u *url.URL) *url.URL {
+	return &url.URL{
+		Scheme: peer.Scheme,
+		Host:   peer.Host,
+		Path:   u.Path,
+	}
+}
+
+// responds to a SETUP that would begin a session on a server that is over its
+// budget, unless the client is to be redirected once the session is set up.
+// Returns the peer to redirect the client to in the session, if so, and
+// whether the request was responded to.
+func (s *RTSPServer) handleOverBudget(w ResponseWriter, r *Request) (*url.URL, bool) {
+	peer, overBudget := s.redirectTarget()
+
+	if !overBudget {
+		return nil, false
+	}
+
+	if peer == nil {
+		log.Printf("RTSP server over its budget, with no peer to redirect %v to", r.RemoteAddr)
+
+		w.Header().PutGenericLine(HeaderNameRetryAfter, strconv.Itoa(int(s.heartbeatInterval().Seconds())+1))
+		w.WriteHeader(ServiceUnavailable)
+		return nil, true
+	}
+
+	log.Printf("RTSP server over its budget, redirecting %v to: %v", r.RemoteAddr, peer)
+
+	if s.RedirectMode == RedirectInSession {
+		return peer, false
+	}
+
+	w.Header().PutGenericLine(HeaderNameLocation, peerURL(peer, r.URL).String())
+	w.WriteHeader(MovedTemporarily)
+	return nil, true
+}
+
+// sends the client of the session a REDIRECT from the media to the media at
+// the peer, after the response to the current request.
+func (s *RTSPServer) redirectSession(r *Request, mediaURL, peer *url.URL) {
+	redirect := NewRequest(REDIRECT, mediaURL)
+	redirect.Headers.PutLine(NewSessionHeaderLine(r.Session().UID, 0))
+	redirect.Headers.PutGenericLine(HeaderNameLocation, peerURL(peer, mediaURL).String())
+
+	r.conn.sendAfterResponse(redirect)
+}
+
+// ListenAndServeHeartbeats receives the heartbeats of the Peers on the UDP
+// address, and sends them the heartbeats of the server from it, until the
+// server is interrupted. Heartbeats are only sent if the AdvertisedURL is set,
+// and only received from the Peers.
+func (s *RTSPServer) ListenAndServeHeartbeats(addr string) error {
+	log.Println("exchanging heartbeats with RTSP peers on " + addr)
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-s.stop
+		conn.Close()
+	}()
+
+	go s.sendHeartbeats(conn)
+
+	buf := make([]byte, maxHeartbeatSize)
+
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			continue
+		}
+
+		if !s.isPeer(raddr) {
+			continue
+		}
+
+		var load Load
+		if err := json.Unmarshal(buf[:n], &load); err != nil {
+			log.Printf("invalid heartbeat from RTSP peer %v: %v", raddr, err)
+			continue
+		}
+
+		s.peers.put(raddr.String(), load)
+	}
+}
+
+// sends the load of the server to the Peers every interval, until the
+// connection is closed
+func (s *RTSPServer) sendHeartbeats(conn net.PacketConn) {
+	if s.AdvertisedURL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(s.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		heartbeat, err := json.Marshal(s.load())
+		if err != nil {
+			return
+		}
+
+		// peers are resolved each time, as their addresses may change
+		for _, peer := range s.Peers {
+			raddr, err := net.ResolveUDPAddr("udp", peer)
+			if err != nil {
+				log.Printf("cannot resolve RTSP peer %v: %v", peer, err)
+				continue
+			}
+
+			if _, err := conn.WriteTo(heartbeat, raddr); errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reports whether the address is that of one of the Peers
+func (s *RTSPServer) isPeer(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, peer := range s.Peers {
+		raddr, err := net.ResolveUDPAddr("udp", peer)
+		if err == nil && raddr.IP.Equal(udpAddr.IP) && raddr.Port == udpAddr.Port {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,138 @@
+package rtsp_test
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/picast/rtsp"
+)
+
+const testHeartbeatInterval = 50 * time.Millisecond
+
+// returns a free loopback UDP address
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+// serves two nodes of the same media that exchange heartbeats, the first of
+// which has room for a single session, and returns their URLs
+func servePeers(t *testing.T, mode rtsp.RedirectMode) (full, peer *url.URL) {
+	t.Helper()
+
+	metadata := newTestMedia(t, "abc", 30*time.Second)
+
+	nodes := []*rtsp.RTSPServer{newTestServer(t, metadata), newTestServer(t, metadata)}
+	heartbeatAddrs := []string{freeUDPAddr(t), freeUDPAddr(t)}
+	urls := make([]*url.URL, len(nodes))
+
+	for i, node := range nodes {
+		urls[i] = &url.URL{Scheme: "rtsp", Host: serveTest(t, node)}
+
+		node.AdvertisedURL = urls[i].String()
+		node.Peers = []string{heartbeatAddrs[1-i]}
+		node.HeartbeatInterval = testHeartbeatInterval
+		node.RedirectMode = mode
+	}
+
+	nodes[0].Budget = rtsp.LoadBudget{MaxSessions: 1}
+
+	for i, node := range nodes {
+		go node.ListenAndServeHeartbeats(heartbeatAddrs[i])
+	}
+
+	return urls[0], urls[1]
+}
+
+// sets up the first track of the media at the URL once the server has room or
+// has a peer to redirect to, and returns the result of the last SETUP
+func setupOverBudget(t *testing.T, client *rtsp.Client, rawURL string) error {
+	t.Helper()
+
+	sd, base, err := client.Describe()
+	if err != nil {
+		t.Fatalf("DESCRIBE %s: %v", rawURL, err)
+	}
+	track := rtsp.TrackURLs(sd, base)[0]
+
+	// the server refuses new sessions until it hears from its peer
+	var setupErr error
+	eventually(t, 5*time.Second, func() bool {
+		_, setupErr = client.Setup(track, rtsp.LowerTransportTCP)
+
+		var statusErr *rtsp.StatusError
+		return !errors.As(setupErr, &statusErr) || statusErr.Response.StatusCode != rtsp.ServiceUnavailable
+	}, "SETUP over budget was refused, the peer was not heard from")
+
+	return setupErr
+}
+
+func TestRedirectWithStatus(t *testing.T) {
+	full, peer := servePeers(t, rtsp.RedirectWithStatus)
+	mediaURL := full.JoinPath("media", "abc").String()
+
+	playTest(t, mediaURL, rtsp.LowerTransportTCP)
+
+	client, err := rtsp.Dial(mediaURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = setupOverBudget(t, client, mediaURL)
+
+	var statusErr *rtsp.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Response.StatusCode != rtsp.MovedTemporarily {
+		t.Fatalf("SETUP over budget: got %v, want 302", err)
+	}
+
+	location, err := url.Parse(statusErr.Response.Headers.GetLineNoFail(rtsp.HeaderNameLocation).ValueNoError())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the track that was set up, at the peer
+	if location.Host != peer.Host || !strings.HasPrefix(location.Path, "/media/abc/") {
+		t.Fatalf("redirected to %v, want the track at %v", location, peer)
+	}
+
+	// the media can be played at the peer
+	awaitPacket(t, playTest(t, peer.JoinPath("media", "abc").String(), rtsp.LowerTransportTCP))
+}
+
+func TestRedirectInSession(t *testing.T) {
+	full, peer := servePeers(t, rtsp.RedirectInSession)
+	mediaURL := full.JoinPath("media", "abc").String()
+
+	playTest(t, mediaURL, rtsp.LowerTransportTCP)
+
+	client, err := rtsp.Dial(mediaURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := setupOverBudget(t, client, mediaURL); err != nil {
+		t.Fatalf("SETUP over budget: %v", err)
+	}
+
+	select {
+	case location := <-client.Redirects():
+		if location.Host != peer.Host || !strings.HasPrefix(location.Path, "/media/abc") {
+			t.Fatalf("redirected to %v, want the media at %v", location, peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no REDIRECT for the session over budget")
+	}
+}
@@ -0,0 +1,99 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidRange = errors.New("invalid range")
+
+// A normal play time range (RFC2326-3.6), in seconds from the start of the media.
+type NPTRange struct {
+	Start  float64
+	End    float64
+	HasEnd bool
+	IsNow  bool // the start is `now`, i.e the current live position
+}
+
+// parses a Range value like `npt=123.4-`, `npt=10-20` or `npt=now-`. Other
+// time formats (smpte, clock) are not supported.
+func ParseNPTRange(value string) (NPTRange, error) {
+	// a time parameter may follow the range, e.g `npt=10-;time=19970123T143720Z`
+	value, _, _ = strings.Cut(strings.TrimSpace(value), ";")
+
+	spec, ok := strings.CutPrefix(value, "npt=")
+	if !ok {
+		return NPTRange{}, fmt.Errorf("%w: unsupported format: %q", ErrInvalidRange, value)
+	}
+
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return NPTRange{}, fmt.Errorf("%w: %q", ErrInvalidRange, value)
+	}
+
+	var r NPTRange
+	var err error
+
+	switch first {
+	case "now":
+		r.IsNow = true
+	case "":
+		// `npt=-20` plays from the start
+	default:
+		if r.Start, err = parseNPTTime(first); err != nil {
+			return NPTRange{}, err
+		}
+	}
+
+	if last != "" {
+		if r.End, err = parseNPTTime(last); err != nil {
+			return NPTRange{}, err
+		}
+
+		if r.End < r.Start {
+			return NPTRange{}, fmt.Errorf("%w: end before start: %q", ErrInvalidRange, value)
+		}
+
+		r.HasEnd = true
+	}
+
+	return r, nil
+}
+
+// parses npt-sec (`123.45`) or npt-hhmmss (`1:02:03.45`)
+func parseNPTTime(s string) (float64, error) {
+	var seconds float64
+
+	for part := range strings.SplitSeq(s, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("%w: bad npt time: %q", ErrInvalidRange, s)
+		}
+
+		seconds = seconds*60 + v
+	}
+
+	return seconds, nil
+}
+
+func (r NPTRange) String() string {
+	var b strings.Builder
+
+	b.WriteString("npt=")
+
+	if r.IsNow {
+		b.WriteString("now")
+	} else {
+		b.WriteString(strconv.FormatFloat(r.Start, 'f', 3, 64))
+	}
+
+	b.WriteString("-")
+
+	if r.HasEnd {
+		b.WriteString(strconv.FormatFloat(r.End, 'f', 3, 64))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,267 @@
+package rtsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrLineTooLong        = errors.New("line too long")
+	ErrTooManyHeaders     = errors.New("too many header fields")
+	ErrBodyTooLarge       = errors.New("body too large")
+	ErrTooManyBlankLines  = errors.New("too many blank lines")
+	ErrUnsupportedVersion = errors.New("unsupported RTSP version")
+)
+
+// MessageLimits bounds the messages that are read, so that a client can't
+// make the server buffer without end. A limit of zero means no limit.
+type MessageLimits struct {
+	MaxLineLength int // bytes of the request line, or of a header line
+	MaxHeaders    int
+	MaxBodySize   int // bytes
+	MaxBlankLines int // skipped ahead of a request line
+}
+
+var DefaultMessageLimits = MessageLimits{
+	MaxLineLength: 8 << 10,
+	MaxHeaders:    64,
+	MaxBodySize:   1 << 20,
+	MaxBlankLines: 16,
+}
+
+// RequestError is the error of a request that could not be read, and the
+// status to respond to it with.
+type RequestError struct {
+	Status RTSPStatus
+	Err    error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Status, e.Status.String(), e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func requestError(status RTSPStatus, err error) *RequestError {
+	return &RequestError{Status: status, Err: err}
+}
+
+// ReadRequest reads a request from the reader, which keeps any bytes read past
+// its end, e.g of a pipelined request, for the next read. A request that is
+// malformed or exceeds the limits is a *RequestError. Other errors are those
+// of the reader.
+func ReadRequest(r *bufio.Reader, limits MessageLimits) (Request, error) {
+	// blank lines, e.g those that end a keepalive, are skipped
+	var line string
+	for blank := 0; line == ""; blank++ {
+		if limits.MaxBlankLines > 0 && blank > limits.MaxBlankLines {
+			return Request{}, requestError(BadRequest, ErrTooManyBlankLines)
+		}
+
+		var err error
+		if line, err = readLine(r, limits.MaxLineLength); err != nil {
+			if errors.Is(err, ErrLineTooLong) {
+				return Request{}, requestError(RequestURITooLong, err)
+			}
+			return Request{}, err
+		}
+	}
+
+	requestLine, err := parseRequestLine(line)
+	if err != nil {
+		return Request{}, err
+	}
+
+	request := Request{RequestLine: requestLine}
+
+	if request.Message, err = readMessage(r, limits); err != nil {
+		return Request{}, err
+	}
+
+	return request, nil
+}
+
+// RFC2326-6.1
+func parseRequestLine(line string) (RequestLine, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[1] == "" {
+		return RequestLine{}, requestError(BadRequest, fmt.Errorf("%w: malformed request line: %q", ErrBadRequest, line))
+	}
+
+	method, rawURL, version := parts[0], parts[1], parts[2]
+
+	if !isExtensionMethod(method) {
+		return RequestLine{}, requestError(BadRequest, fmt.Errorf("%w: bad method: %q", ErrBadRequest, method))
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return RequestLine{}, requestError(BadRequest, fmt.Errorf("%w: bad URL: %q", ErrBadRequest, rawURL))
+	}
+
+	if version != RTSP_VERSION_STRING {
+		if strings.HasPrefix(version, "RTSP/") {
+			return RequestLine{}, requestError(RTSPVersionNotSupported, fmt.Errorf("%w: %q", ErrUnsupportedVersion, version))
+		}
+		return RequestLine{}, requestError(BadRequest, fmt.Errorf("%w: bad version: %q", ErrBadRequest, version))
+	}
+
+	return RequestLine{Method: RTSPMethod(method), URL: u, Version: version}, nil
+}
+
+// ReadResponse reads a response from the reader, as ReadRequest reads a
+// request. A response that is malformed or exceeds the limits is an error
+// wrapping ErrInvalidFormat, or a *RequestError of the status the client would
+// have refused it with.
+func ReadResponse(r *bufio.Reader, limits MessageLimits) (Response, error) {
+	line, err := readLine(r, limits.MaxLineLength)
+	if err != nil {
+		return Response{}, err
+	}
+
+	responseLine, err := parseResponseLine(line)
+	if err != nil {
+		return Response{}, err
+	}
+
+	response := Response{ResponseLine: responseLine}
+
+	if response.Message, err = readMessage(r, limits); err != nil {
+		return Response{}, err
+	}
+
+	return response, nil
+}
+
+// RFC2326-7.1
+func parseResponseLine(line string) (ResponseLine, error) {
+	version, rest, _ := strings.Cut(line, " ")
+	code, text, _ := strings.Cut(rest, " ")
+
+	if !strings.HasPrefix(version, "RTSP/") {
+		return ResponseLine{}, fmt.Errorf("%w: malformed status line: %q", ErrInvalidFormat, line)
+	}
+
+	if n, err := strconv.Atoi(code); err != nil || len(code) != 3 || n < 100 {
+		return ResponseLine{}, fmt.Errorf("%w: bad status code: %q", ErrInvalidFormat, code)
+	}
+
+	return ResponseLine{Version: version, StatusCode: RTSPStatus(code), StatusText: text}, nil
+}
+
+// reads the header lines of a message up to the blank line that ends them, and
+// then the body of the length they give
+func readMessage(r *bufio.Reader, limits MessageLimits) (Message, error) {
+	var lines []string
+
+	for {
+		line, err := readLine(r, limits.MaxLineLength)
+		if err != nil {
+			if errors.Is(err, ErrLineTooLong) {
+				return Message{}, requestError(BadRequest, err)
+			}
+			return Message{}, err
+		}
+
+		if line == "" {
+			break
+		}
+
+		// a line that begins with whitespace continues the last (RFC2326-4.2)
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(lines) == 0 {
+				return Message{}, requestError(BadRequest, fmt.Errorf("%w: continuation of no header", ErrBadRequest))
+			}
+
+			lines[len(lines)-1] += " " + strings.TrimLeft(line, " \t")
+
+			if limits.MaxLineLength > 0 && len(lines[len(lines)-1]) > limits.MaxLineLength {
+				return Message{}, requestError(BadRequest, ErrLineTooLong)
+			}
+			continue
+		}
+
+		if limits.MaxHeaders > 0 && len(lines) == limits.MaxHeaders {
+			return Message{}, requestError(BadRequest, ErrTooManyHeaders)
+		}
+
+		lines = append(lines, line)
+	}
+
+	var message Message
+
+	for _, line := range lines {
+		header, err := ParseHeaderLine(line)
+
+		// a field of a typed header line with a bad value is kept as sent,
+		// for its handler to refuse with the status that it calls for
+		if err != nil {
+			if header, err = parseGenericHeaderLine(line); err != nil {
+				return Message{}, requestError(BadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+			}
+		}
+
+		message.Headers.AddLine(header)
+	}
+
+	contentLength, ok := message.Headers.GetLine(HeaderNameContentLength)
+	if !ok {
+		return message, nil
+	}
+
+	n, err := strconv.Atoi(contentLength.ValueNoError())
+	if err != nil || n < 0 {
+		return Message{}, requestError(BadRequest, fmt.Errorf("%w: bad Content-Length: %q", ErrBadRequest, contentLength.ValueNoError()))
+	}
+
+	if limits.MaxBodySize > 0 && n > limits.MaxBodySize {
+		return Message{}, requestError(RequestEntityTooLarge, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, n))
+	}
+
+	message.Body = make([]byte, n)
+	if _, err := io.ReadFull(r, message.Body); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// reads a line, without its line ending. Lines may end in a bare LF.
+func readLine(r *bufio.Reader, maxLength int) (string, error) {
+	var line []byte
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		// the line ending is not counted
+		if maxLength > 0 && len(strings.TrimRight(string(line), "\r\n")) > maxLength {
+			return "", ErrLineTooLong
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+
+		return string(line), nil
+	}
+}
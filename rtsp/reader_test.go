@@ -0,0 +1,143 @@
+package rtsp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzParseHeaderLine(f *testing.F) {
+	for _, line := range []string{
+		"CSeq: 1",
+		"Transport: RTP/AVP;unicast;client_port=5000-5001",
+		"Transport: RTP/AVP/TCP;interleaved=0-1,RTP/AVP;unicast;client_port=5000",
+		"Session: QmFzZTY0;timeout=60",
+		"Range: npt=10.5-",
+		"RTP-Info: url=rtsp://host/media/abc/trackID=0;seq=1;rtptime=2",
+		"Scale: -2",
+		"Speed: 1.5",
+		"Content-Type: application/sdp",
+		"X-Custom:",
+		": no name",
+		"no colon",
+	} {
+		f.Add(line)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		header, err := ParseHeaderLine(line)
+		if err != nil {
+			return
+		}
+
+		// a header line that was parsed can be written again
+		if _, err := header.Marshal(); err != nil {
+			t.Errorf("%q parsed but does not marshal: %v", line, err)
+		}
+	})
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	limits := MessageLimits{MaxLineLength: 64, MaxHeaders: 4, MaxBodySize: 16, MaxBlankLines: 2}
+	long := strings.Repeat("a", limits.MaxLineLength)
+
+	tests := []struct {
+		name    string
+		request string
+		want    RTSPStatus // or OK if the request is read
+	}{
+		{"within the limits", "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\nContent-Length: 16\r\n\r\n" + strings.Repeat("b", 16), OK},
+		{"request line too long", "OPTIONS rtsp://host/" + long + " RTSP/1.0\r\nCSeq: 1\r\n\r\n", RequestURITooLong},
+		{"header line too long", "OPTIONS * RTSP/1.0\r\nX-Long: " + long + "\r\n\r\n", BadRequest},
+		{"folded header line too long", "OPTIONS * RTSP/1.0\r\nX-Long: a\r\n " + long[5:] + "\r\n\r\n", BadRequest},
+		{"as many headers as allowed", "OPTIONS * RTSP/1.0\r\n" + strings.Repeat("X-Header: v\r\n", 4) + "\r\n", OK},
+		{"too many headers", "OPTIONS * RTSP/1.0\r\n" + strings.Repeat("X-Header: v\r\n", 5) + "\r\n", BadRequest},
+		{"body too large", "ANNOUNCE rtsp://host/live/x RTSP/1.0\r\nCSeq: 1\r\nContent-Length: 17\r\n\r\n" + strings.Repeat("b", 17), RequestEntityTooLarge},
+		{"bad Content-Length", "OPTIONS * RTSP/1.0\r\nContent-Length: -1\r\n\r\n", BadRequest},
+		{"unsupported version", "OPTIONS * RTSP/2.0\r\nCSeq: 1\r\n\r\n", RTSPVersionNotSupported},
+		{"not a version", "OPTIONS * HTTP/1.1\r\nCSeq: 1\r\n\r\n", BadRequest},
+		{"malformed request line", "OPTIONS *\r\nCSeq: 1\r\n\r\n", BadRequest},
+		{"blank lines ahead", "\r\n\r\nOPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n", OK},
+		{"too many blank lines ahead", "\r\n\r\n\r\nOPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n", BadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadRequest(bufio.NewReader(strings.NewReader(tt.request)), limits)
+
+			if tt.want == OK {
+				if err != nil {
+					t.Fatalf("got %v, want the request", err)
+				}
+				return
+			}
+
+			var reqErr *RequestError
+			if !errors.As(err, &reqErr) {
+				t.Fatalf("got %v, want a RequestError of %v", err, tt.want)
+			}
+
+			if reqErr.Status != tt.want {
+				t.Fatalf("got %v, want %v", reqErr, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzReadRequest(f *testing.F) {
+	long := strings.Repeat("a", DefaultMessageLimits.MaxLineLength+1)
+
+	var manyHeaders strings.Builder
+	for i := 0; i <= DefaultMessageLimits.MaxHeaders; i++ {
+		manyHeaders.WriteString("X-Header: value\r\n")
+	}
+
+	for _, request := range []string{
+		// valid
+		"OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n",
+		"DESCRIBE rtsp://host/media/abc RTSP/1.0\r\nCSeq: 2\r\nAccept: application/sdp\r\n\r\n",
+		"SETUP rtsp://host/media/abc/trackID=0 RTSP/1.0\r\nCSeq: 3\r\nTransport: RTP/AVP;unicast;client_port=5000-5001\r\n\r\n",
+		"SET_PARAMETER rtsp://host/media/abc RTSP/1.0\r\nCSeq: 4\r\nContent-Length: 12\r\n\r\nbitrate_cap: 8",
+		"PLAY rtsp://host/media/abc RTSP/1.0\nCSeq: 5\nRange: npt=0-\n\n",
+		"GET_PARAMETER rtsp://host/media/abc RTSP/1.0\r\nCSeq: 6\r\nX-Folded: a\r\n  b\r\n\r\n",
+
+		// pipelined
+		"OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\nOPTIONS * RTSP/1.0\r\nCSeq: 2\r\n\r\n",
+
+		// beyond the limits
+		"OPTIONS rtsp://host/" + long + " RTSP/1.0\r\nCSeq: 1\r\n\r\n",
+		"OPTIONS * RTSP/1.0\r\nCSeq: 1\r\nX-Long: " + long + "\r\n\r\n",
+		"OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n" + manyHeaders.String() + "\r\n",
+		"ANNOUNCE rtsp://host/live/x RTSP/1.0\r\nCSeq: 1\r\nContent-Length: 2000000\r\n\r\n",
+
+		// malformed
+		"OPTIONS * RTSP/2.0\r\nCSeq: 1\r\n\r\n",
+		"OPTIONS *\r\n\r\n",
+		"OPTIONS * RTSP/1.0\r\nContent-Length: -1\r\n\r\n",
+		"OPTIONS * RTSP/1.0\r\n continuation\r\n\r\n",
+		"",
+	} {
+		f.Add([]byte(request))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(strings.NewReader(string(data)))
+
+		// every request that follows is read, as a connection would
+		for {
+			_, err := ReadRequest(r, DefaultMessageLimits)
+			if err == nil {
+				continue
+			}
+
+			var reqErr *RequestError
+			if !errors.As(err, &reqErr) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+
+			return
+		}
+	})
+}
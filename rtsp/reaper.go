@@ -0,0 +1,107 @@
+package rtsp
+
+import (
+	"log"
+	"time"
+)
+
+// Sessions time out unless the client keeps them alive (RFC2326-12.37). Any
+// request in a session refreshes it, as do RTCP receiver reports for any of
+// its streams, and the media of any stream that it records.
+
+// the default time a session lives after the client was last seen.
+const DefaultSessionTimeout = 60 * time.Second
+
+// returns the Session header of responses in a session, which advertises the
+// timeout, e.g `QmFzZTY0;timeout=60`.
+func (s *RTSPServer) sessionHeaderLine(uid SessionUID) SessionHeaderLine {
+	return NewSessionHeaderLine(uid, max(s.SessionTimeout, 0))
+}
+
+// returns when the client of a session was last seen, either making a request,
+// reporting on one of the session's streams, or sending one that it records.
+// The caller must hold the session lock.
+func (s *RTSPServer) sessionLastSeen(session *Session) time.Time {
+	lastSeen := session.LastSeen()
+
+	for _, st := range session.Streams {
+		stats, err := s.rtpServer.StreamStats(st.StreamUID)
+		if err != nil {
+			continue
+		}
+
+		if stats.HasReceiverReport && stats.ReportedAt.After(lastSeen) {
+			lastSeen = stats.ReportedAt
+		}
+
+		if stats.ReceivedAt.After(lastSeen) {
+			lastSeen = stats.ReceivedAt
+		}
+	}
+
+	return lastSeen
+}
+
+// starts reaping sessions, once, when the server first listens or serves a
+// connection, whichever is first
+func (s *RTSPServer) startReaper() {
+	s.reaperOnce.Do(func() {
+		go s.reapSessions()
+	})
+}
+
+// tears down sessions that have outlived the timeout, checking a few times per
+// timeout, until the server is interrupted.
+func (s *RTSPServer) reapSessions() {
+	if s.SessionTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(max(s.SessionTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			for _, session := range s.sessions.all() {
+				// called without the session lock, so that it may take it
+				if s.reapSession(session, now) && s.OnSessionTimeout != nil {
+					s.OnSessionTimeout(session.UID)
+				}
+			}
+
+			s.expireAnnouncements(now)
+		}
+	}
+}
+
+// tears down the session if it has outlived the timeout, and reports whether
+// it did
+func (s *RTSPServer) reapSession(session *Session, now time.Time) bool {
+	session.Lock()
+	defer session.Unlock()
+
+	// torn down by its client while the reaper waited for the lock
+	if session.ended {
+		return false
+	}
+
+	idle := now.Sub(s.sessionLastSeen(session))
+	if idle < s.SessionTimeout {
+		return false
+	}
+
+	for track, st := range session.Streams {
+		s.teardownStream(st)
+		st.OnTeardown()
+		delete(session.Streams, track)
+	}
+
+	s.endSession(session)
+
+	log.Printf("RTSP session %v timed out after %v idle", session.UID, idle.Round(time.Second))
+
+	return true
+}
@@ -0,0 +1,599 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pionsdp "github.com/pion/sdp"
+	"github.com/rebeljah/picast/media"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// Recording (RFC2326-10.11): a client ANNOUNCEs a live stream at `live/{name}`
+// with an SDP description of its tracks, sets up each track with a Transport
+// in mode=record, and RECORDs. The tracks are muxed into an MPEG-TS recording,
+// which other clients can watch while it grows, by DESCRIBEing the live stream
+// like any media. Once the recording client tears down, the recording is added
+// to the library.
+
+var ErrUnsupportedAnnouncement = errors.New("unsupported announcement")
+
+// the RTP encodings that can be recorded, by the stream type and codec name
+// that they are muxed as
+var recordableEncodings = map[string]struct {
+	streamType byte
+	codecName  string
+}{
+	"H264":          {media.StreamTypeH264, "h264"},
+	"MPEG4-GENERIC": {media.StreamTypeAAC, "aac"},
+}
+
+// a live stream that a client announced, and records once it has set up
+type liveStream struct {
+	Name        string
+	Metadata    media.Metadata   // of the recording, as it is added to the library
+	Media       []AnnouncedMedia // the tracks of the stream, in the order of the announcement
+	Recording   *media.Recording
+	Publisher   SessionUID // the session that records the stream, empty until it sets up
+	AnnouncedAt time.Time
+}
+
+// returns the track of the stream that a control URL from the announcement
+// addresses, or a `trackID=N` control as the tracks are described to watchers.
+func (ls *liveStream) track(control string) (TrackID, bool) {
+	for i, m := range ls.Media {
+		if lastSegment(m.Control) == control {
+			return TrackID(i), true
+		}
+	}
+
+	if track, ok := parseTrackControl(control); ok && int(track) < len(ls.Media) {
+		return track, true
+	}
+
+	return 0, false
+}
+
+func lastSegment(control string) string {
+	return control[strings.LastIndex(control, "/")+1:]
+}
+
+// the live streams announced to the server, by name
+type liveStreams struct {
+	sync.RWMutex
+	streams map[string]*liveStream
+}
+
+func newLiveStreams() liveStreams {
+	return liveStreams{
+		streams: make(map[string]*liveStream),
+	}
+}
+
+func (l *liveStreams) get(name string) (*liveStream, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	ls, ok := l.streams[name]
+	return ls, ok
+}
+
+func (l *liveStreams) byUID(uid media.UID) (*liveStream, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, ls := range l.streams {
+		if ls.Metadata.UID == uid {
+			return ls, true
+		}
+	}
+
+	return nil, false
+}
+
+// returns the live stream that the session records, if any
+func (l *liveStreams) publishedBy(uid SessionUID) (*liveStream, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, ls := range l.streams {
+		if ls.Publisher == uid {
+			return ls, true
+		}
+	}
+
+	return nil, false
+}
+
+// adds an announced stream, replacing an announcement of the same name that
+// was never set up, which is returned. Returns false if the name is being
+// recorded.
+func (l *liveStreams) announce(ls *liveStream) (*liveStream, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	replaced, ok := l.streams[ls.Name]
+	if ok && replaced.Publisher != "" {
+		return nil, false
+	}
+
+	l.streams[ls.Name] = ls
+	return replaced, true
+}
+
+// makes the session the publisher of the stream, unless another session is
+func (l *liveStreams) publish(ls *liveStream, uid SessionUID) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if ls.Publisher != "" && ls.Publisher != uid {
+		return false
+	}
+
+	ls.Publisher = uid
+	return true
+}
+
+// undoes publish, for a session that failed to set up its first track
+func (l *liveStreams) unpublish(ls *liveStream) {
+	l.Lock()
+	defer l.Unlock()
+
+	ls.Publisher = ""
+}
+
+func (l *liveStreams) remove(ls *liveStream) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.streams[ls.Name] == ls {
+		delete(l.streams, ls.Name)
+	}
+}
+
+// removes the announcements that were not set up within the timeout, and
+// returns them.
+func (l *liveStreams) expire(now time.Time, timeout time.Duration) []*liveStream {
+	l.Lock()
+	defer l.Unlock()
+
+	var expired []*liveStream
+
+	for name, ls := range l.streams {
+		if ls.Publisher == "" && now.Sub(ls.AnnouncedAt) >= timeout {
+			expired = append(expired, ls)
+			delete(l.streams, name)
+		}
+	}
+
+	return expired
+}
+
+// returns the metadata of a media in the library or a live stream, along with
+// the recording of a live stream.
+func (s *RTSPServer) lookupMedia(uid media.UID) (media.Metadata, *media.Recording, bool) {
+	if ls, ok := s.live.byUID(uid); ok {
+		return ls.Metadata, ls.Recording, true
+	}
+
+	metadata, ok := s.mediaManifest.Get(uid)
+	return metadata, nil, ok
+}
+
+// parses the request path like parseMediaPath, and resolves the path of a live
+// stream to the media it is recorded as, and its control URL to a track.
+func (s *RTSPServer) resolveMediaPath(u *url.URL) (mediaPath, RTSPStatus) {
+	path, status := parseMediaPath(u)
+
+	if status != OK || path.Live == "" {
+		return path, status
+	}
+
+	ls, ok := s.live.get(path.Live)
+	if !ok {
+		return mediaPath{}, NotFound
+	}
+
+	path.UID = ls.Metadata.UID
+
+	if path.control != "" {
+		if path.Track, ok = ls.track(path.control); !ok {
+			return mediaPath{}, NotFound
+		}
+	}
+
+	return path, OK
+}
+
+// parses the SDP of an ANNOUNCE into its session name and its tracks
+func parseAnnouncement(body []byte) (string, []AnnouncedMedia, error) {
+	var desc pionsdp.SessionDescription
+
+	if err := desc.Unmarshal(string(body)); err != nil {
+		return "", nil, err
+	}
+
+	var tracks []AnnouncedMedia
+
+	for _, md := range desc.MediaDescriptions {
+		if len(md.MediaName.Formats) == 0 {
+			return "", nil, fmt.Errorf("media %q has no format", md.MediaName.Media)
+		}
+
+		payloadType, err := strconv.ParseUint(md.MediaName.Formats[0], 10, 7)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad payload type: %q", md.MediaName.Formats[0])
+		}
+
+		m := AnnouncedMedia{
+			Type:        md.MediaName.Media,
+			PayloadType: uint8(payloadType),
+			Format:      make(map[string]string),
+		}
+
+		m.Control, _ = md.Attribute("control")
+
+		for _, a := range md.Attributes {
+			format, value, _ := strings.Cut(a.Value, " ")
+			if format != md.MediaName.Formats[0] {
+				continue
+			}
+
+			switch a.Key {
+			case "rtpmap":
+				parseRTPMap(&m, value)
+			case "fmtp":
+				for param := range strings.SplitSeq(value, ";") {
+					name, value, _ := strings.Cut(param, "=")
+					if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+						m.Format[name] = strings.TrimSpace(value)
+					}
+				}
+			}
+		}
+
+		tracks = append(tracks, m)
+	}
+
+	if len(tracks) == 0 {
+		return "", nil, errors.New("no media announced")
+	}
+
+	return string(desc.SessionName), tracks, nil
+}
+
+// parses `encoding/clock rate[/channels]` of an rtpmap attribute
+func parseRTPMap(m *AnnouncedMedia, value string) {
+	parts := strings.Split(strings.TrimSpace(value), "/")
+
+	m.Encoding = strings.ToUpper(parts[0])
+
+	if len(parts) > 1 {
+		if rate, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+			m.ClockRate = uint32(rate)
+		}
+	}
+
+	if len(parts) > 2 {
+		m.Channels, _ = strconv.Atoi(parts[2])
+	}
+}
+
+// describes the recording of the announced tracks as it will be added to the
+// library, with each track as an elementary stream of the MPEG-TS.
+func newLiveMetadata(uid media.UID, title string, tracks []AnnouncedMedia, recording *media.Recording) media.Metadata {
+	metadata := media.Metadata{
+		Title: title,
+		UID:   uid,
+		Path:  recording.Path,
+	}
+
+	var hasVideo, hasAudio bool
+
+	for i, m := range tracks {
+		codecType := string(ffprobe.StreamAudio)
+		if m.Type == "video" {
+			codecType = string(ffprobe.StreamVideo)
+		}
+
+		hasVideo = hasVideo || m.Type == "video"
+		hasAudio = hasAudio || m.Type == "audio"
+
+		metadata.Structure.Streams = append(metadata.Structure.Streams, &ffprobe.Stream{
+			Index:     i,
+			ID:        fmt.Sprintf("0x%x", recording.PID(i)),
+			CodecName: recordableEncodings[m.Encoding].codecName,
+			CodecType: codecType,
+		})
+	}
+
+	switch {
+	case hasVideo && hasAudio:
+		metadata.MediaType = media.AudioVideo
+	case hasVideo:
+		metadata.MediaType = media.StandaloneVideo
+	case hasAudio:
+		metadata.MediaType = media.StandaloneAudio
+	}
+
+	return metadata
+}
+
+// ANNOUNCE of a live stream creates its recording. The tracks are set up and
+// recorded in a session of their own.
+func (s *RTSPServer) handleAnnounce(w ResponseWriter, r *Request) {
+	path, status := parseMediaPath(r.URL)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	// only live streams are announced, as a whole, and only if they can be
+	// recorded
+	if path.Live == "" || path.control != "" || s.RecordingDir == "" {
+		w.WriteHeader(MethodNotAllowed)
+		return
+	}
+
+	contentType, _ := r.Headers.GetLine(HeaderNameContentType)
+	if contentType, ok := contentType.(ContentTypeHeaderLine); !ok || contentType.MediaType != ContentTypeSDP {
+		w.WriteHeader(UnsupportedMediaType)
+		return
+	}
+
+	title, tracks, err := parseAnnouncement(r.Body)
+
+	if err != nil {
+		log.Printf("RTSP ANNOUNCE of %q has a bad description: %v", path.Live, err)
+		w.WriteHeader(BadRequest)
+		return
+	}
+
+	streamTypes := make([]byte, len(tracks))
+
+	for i, m := range tracks {
+		encoding, ok := recordableEncodings[m.Encoding]
+		if !ok {
+			log.Printf("RTSP ANNOUNCE of %q: %v: %s", path.Live, ErrUnsupportedAnnouncement, m.Encoding)
+			w.WriteHeader(UnsupportedMediaType)
+			return
+		}
+
+		streamTypes[i] = encoding.streamType
+	}
+
+	uid, err := media.NewUID()
+
+	if err != nil {
+		writeError(w, InternalServerError, err)
+		return
+	}
+
+	recording, err := media.CreateRecording(filepath.Join(s.RecordingDir, string(uid)+".ts"), streamTypes...)
+
+	if err != nil {
+		writeError(w, InternalServerError, err)
+		return
+	}
+
+	if title == "" || title == "-" {
+		title = path.Live
+	}
+
+	ls := &liveStream{
+		Name:        path.Live,
+		Metadata:    newLiveMetadata(uid, title, tracks, recording),
+		Media:       tracks,
+		Recording:   recording,
+		AnnouncedAt: time.Now(),
+	}
+
+	replaced, ok := s.live.announce(ls)
+
+	if !ok {
+		discardRecording(recording)
+		w.WriteHeader(MethodNotValidInThisState)
+		return
+	}
+
+	if replaced != nil {
+		discardRecording(replaced.Recording)
+	}
+
+	log.Printf("RTSP live stream %q announced as media %v with %d tracks", ls.Name, uid, len(tracks))
+}
+
+// closes a recording and deletes it, along with any seek index
+func discardRecording(recording *media.Recording) {
+	recording.Close()
+	os.Remove(recording.Path)
+	os.Remove(media.SeekIndexPath(recording.Path))
+}
+
+// true iff the client asks to record over one of the transports
+func isRecordTransport(transports []TransportInfo) bool {
+	for _, t := range transports {
+		if slices.Contains(t.Methods, RECORD) {
+			return true
+		}
+	}
+	return false
+}
+
+// sets up the receiving of one track of an announced live stream. The caller
+// holds the session lock.
+func (s *RTSPServer) handleSetupRecord(w ResponseWriter, r *Request, path mediaPath, transports []TransportInfo) {
+	session := r.Session()
+
+	ls, ok := s.live.byUID(path.UID)
+
+	if !ok {
+		w.WriteHeader(MethodNotAllowed)
+		return
+	}
+
+	// every track is recorded into a stream of its own
+	if path.Track == WholeMedia {
+		w.WriteHeader(AggregateOperationNotAllowed)
+		return
+	}
+
+	if !s.live.publish(ls, session.UID) {
+		w.WriteHeader(MethodNotValidInThisState)
+		return
+	}
+
+	st := NewStreamState()
+
+	args := IngestArguments{
+		StreamID:             st.StreamUID,
+		RAddr:                r.RemoteAddr,
+		Conn:                 r.Conn(),
+		AcceptableTransports: transports,
+		Media:                ls.Media[path.Track],
+		Recording:            ls.Recording,
+		Stream:               int(path.Track),
+	}
+
+	transport, err := s.rtpServer.SetupIngest(args)
+
+	if err != nil {
+		log.Printf("RTSP SETUP for recording failed for live stream %q: %v", ls.Name, err)
+
+		if len(session.Streams) == 0 {
+			s.live.unpublish(ls)
+		}
+
+		if errors.Is(err, ErrUnsupportedTransport) {
+			w.WriteHeader(UnsupportedTransport)
+		} else {
+			w.WriteHeader(InternalServerError)
+		}
+		return
+	}
+
+	w.Header().PutLine(s.sessionHeaderLine(session.UID))
+
+	w.Header().PutLine(
+		NewTransportHeaderLine([]TransportInfo{transport}),
+	)
+
+	if transport.IsInterleaved() {
+		st.conn = r.conn
+	}
+
+	session.ContentID = path.UID
+	session.Streams[path.Track] = st
+	st.OnSetup()
+}
+
+// RECORD begins, or resumes, recording every track of the live stream that
+// the session set up.
+func (s *RTSPServer) handleRecord(w ResponseWriter, r *Request) {
+	session := r.Session()
+
+	path, status := s.resolveMediaPath(r.URL)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	tracks, status := session.controlledTracks(path, RECORD)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	if ls, ok := s.live.publishedBy(session.UID); !ok || ls.Metadata.UID != path.UID {
+		w.WriteHeader(MethodNotValidInThisState)
+		return
+	}
+
+	// make sure every stream can actually be recorded in its current state
+	for _, track := range tracks {
+		if session.Streams[track].StateNow.After(RECORD) == ErrorState {
+			w.WriteHeader(MethodNotValidInThisState)
+			return
+		}
+	}
+
+	for _, track := range tracks {
+		st := session.Streams[track]
+
+		if err := s.rtpServer.RecordStream(st.StreamUID); err != nil {
+			log.Printf("RTSP RECORD failed for stream %v: %v", st.StreamUID, err)
+			w.WriteHeader(InternalServerError)
+			return
+		}
+	}
+
+	for _, track := range tracks {
+		session.Streams[track].OnRecord()
+	}
+}
+
+// forgets a session once its streams are torn down. A live stream that the
+// session recorded is finished. The caller must hold the session lock.
+func (s *RTSPServer) endSession(session *Session) {
+	session.ended = true
+	s.sessions.delete(session.UID)
+
+	if ls, ok := s.live.publishedBy(session.UID); ok {
+		ls.Recording.Close()
+		go s.finishLive(ls)
+	}
+}
+
+// indexes the recording of a live stream and adds it to the library. Watchers
+// of the stream play on to the end of the recording.
+func (s *RTSPServer) finishLive(ls *liveStream) {
+	defer s.live.remove(ls)
+
+	index, err := media.BuildSeekIndexFile(ls.Recording.Path)
+
+	if err == nil && len(index.Points) == 0 {
+		err = errors.New("nothing was recorded")
+	}
+
+	if err != nil {
+		log.Printf("RTSP live stream %q was not recorded: %v", ls.Name, err)
+		discardRecording(ls.Recording)
+		return
+	}
+
+	metadata := ls.Metadata
+	metadata.Duration = index.Duration()
+
+	s.mediaManifest.Put(metadata)
+
+	log.Printf("RTSP live stream %q recorded as media %v (%.1fs)", ls.Name, metadata.UID, metadata.Duration)
+}
+
+// discards the announcements that were never set up within the session
+// timeout.
+func (s *RTSPServer) expireAnnouncements(now time.Time) {
+	for _, ls := range s.live.expire(now, s.SessionTimeout) {
+		discardRecording(ls.Recording)
+		log.Printf("RTSP live stream %q expired before it was recorded", ls.Name)
+	}
+}
@@ -0,0 +1,560 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	pionsdp "github.com/pion/sdp"
+	"github.com/rebeljah/picast/media"
+)
+
+// Relaying (pull): a media of the manifest with an Upstream URL is the stream
+// of another RTSP server, e.g an IP camera. It is described as the upstream
+// describes it, and each of its tracks is set up on its own. The first viewer
+// to PLAY connects the relay upstream, which then fans the RTP and RTCP of each
+// track out to every viewer of the track, until the last viewer is torn down.
+// Like a live stream, a relay plays on from where it is.
+
+const (
+	// time to wait before connecting upstream again, once the connection is
+	// lost while there are viewers
+	relayRetryDelay = 5 * time.Second
+
+	// packets that a viewer is not sent as fast as they come are dropped
+	relayViewerBufferSize = 256
+)
+
+var ErrUpstreamUnavailable = errors.New("upstream unavailable")
+
+// a viewer of one track of a relay
+type relayViewer struct {
+	track   TrackID
+	packets chan Packet
+}
+
+// where the next RTP packet of a track begins, as far as it is known
+type relayPosition struct {
+	seq     uint16
+	rtpTime uint32
+	known   bool
+}
+
+// relays the stream of an upstream server to its viewers
+type relay struct {
+	uid      media.UID
+	upstream string
+
+	lock        sync.Mutex
+	description *pionsdp.SessionDescription // of the upstream, as last described
+	controls    []*url.URL                  // upstream control URL of each track
+	client      *Client                     // connected while any viewer plays
+	stop        chan struct{}               // closed when the last viewer leaves
+	connecting  chan struct{}               // closed once a viewer that plays is done connecting
+	viewers     map[StreamUID]*relayViewer
+	positions   []relayPosition // of each track
+}
+
+// the relays of the manifest, by the UID of their media
+type relays struct {
+	sync.Mutex
+	byUID map[media.UID]*relay
+}
+
+func newRelays() relays {
+	return relays{byUID: make(map[media.UID]*relay)}
+}
+
+// returns the relay of the media, which is created the first time. A relay
+// whose upstream was edited in the manifest is replaced once it has no viewers.
+func (r *relays) relay(metadata media.Metadata) *relay {
+	r.Lock()
+	defer r.Unlock()
+
+	rl, ok := r.byUID[metadata.UID]
+	if !ok || (rl.upstream != metadata.Upstream && !rl.hasViewers()) {
+		rl = &relay{
+			uid:      metadata.UID,
+			upstream: metadata.Upstream,
+			viewers:  make(map[StreamUID]*relayViewer),
+		}
+		r.byUID[metadata.UID] = rl
+	}
+
+	return rl
+}
+
+func (r *relays) get(uid media.UID) (*relay, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	rl, ok := r.byUID[uid]
+	return rl, ok
+}
+
+func (rl *relay) hasViewers() bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	return len(rl.viewers) > 0
+}
+
+// stops relaying to the stream, if it views a relay
+func (r *relays) unsubscribe(uid StreamUID) {
+	r.Lock()
+	all := make([]*relay, 0, len(r.byUID))
+	for _, rl := range r.byUID {
+		all = append(all, rl)
+	}
+	r.Unlock()
+
+	for _, rl := range all {
+		rl.unsubscribe(uid)
+	}
+}
+
+// the description of an upstream, and the position of each of its tracks as
+// it begins playing
+type upstreamState struct {
+	description *pionsdp.SessionDescription
+	controls    []*url.URL
+	positions   []relayPosition
+}
+
+// swaps in the state of the upstream. The caller must hold the lock.
+func (rl *relay) setUpstreamLocked(state upstreamState) {
+	rl.description, rl.controls = state.description, state.controls
+
+	if state.positions != nil {
+		rl.positions = state.positions
+	} else if len(rl.positions) != len(rl.controls) {
+		rl.positions = make([]relayPosition, len(rl.controls))
+	}
+}
+
+func dialUpstream(upstream string) (*Client, error) {
+	client, err := Dial(upstream, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+	}
+
+	client.UserAgent = "picast/" + Version
+
+	return client, nil
+}
+
+func describeUpstream(client *Client) (upstreamState, error) {
+	sd, base, err := client.Describe()
+	if err != nil {
+		return upstreamState{}, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+	}
+
+	if len(sd.MediaDescriptions) == 0 {
+		return upstreamState{}, fmt.Errorf("%w: no media described", ErrUpstreamUnavailable)
+	}
+
+	return upstreamState{description: sd, controls: TrackURLs(sd, base)}, nil
+}
+
+// returns the session description of the upstream, which is described once,
+// and again on every connection upstream. The upstream is described without
+// the lock, so that viewers are not held up by it.
+func (rl *relay) describe() (*pionsdp.SessionDescription, error) {
+	rl.lock.Lock()
+	description := rl.description
+	rl.lock.Unlock()
+
+	if description != nil {
+		return description, nil
+	}
+
+	client, err := dialUpstream(rl.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	state, err := describeUpstream(client)
+	if err != nil {
+		return nil, err
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	// a description of a connection made meanwhile is kept
+	if rl.description == nil {
+		rl.setUpstreamLocked(state)
+	}
+
+	return rl.description, nil
+}
+
+// adds a viewer of the track, and returns the packets to send it
+func (rl *relay) subscribe(uid StreamUID, track TrackID) (<-chan Packet, error) {
+	if _, err := rl.describe(); err != nil {
+		return nil, err
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if track < 0 || int(track) >= len(rl.controls) {
+		return nil, fmt.Errorf("no such track: %d", track)
+	}
+
+	viewer := &relayViewer{track: track, packets: make(chan Packet, relayViewerBufferSize)}
+	rl.viewers[uid] = viewer
+
+	return viewer.packets, nil
+}
+
+// removes the viewer, and disconnects from upstream once none are left
+func (rl *relay) unsubscribe(uid StreamUID) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if _, ok := rl.viewers[uid]; !ok {
+		return
+	}
+
+	delete(rl.viewers, uid)
+
+	if len(rl.viewers) == 0 && rl.stop != nil {
+		close(rl.stop)
+		go closeUpstream(rl.client)
+		rl.client, rl.stop = nil, nil
+
+		log.Printf("RTSP relay of media %v disconnected from upstream, after its last viewer left", rl.uid)
+	}
+}
+
+func closeUpstream(client *Client) {
+	client.Teardown()
+	client.Close()
+}
+
+// connects upstream, unless connected already, for a viewer to play. One
+// viewer connects while any others that play meanwhile wait for it.
+func (rl *relay) play() error {
+	rl.lock.Lock()
+
+	for rl.client == nil && rl.connecting != nil {
+		connecting := rl.connecting
+		rl.lock.Unlock()
+		<-connecting
+		rl.lock.Lock()
+	}
+
+	if rl.client != nil {
+		rl.lock.Unlock()
+		return nil
+	}
+
+	connecting := make(chan struct{})
+	rl.connecting = connecting
+	rl.lock.Unlock()
+
+	client, state, err := connectUpstream(rl.upstream)
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	rl.connecting = nil
+	close(connecting)
+
+	if err != nil {
+		return err
+	}
+
+	// the viewers may have left while connecting
+	if len(rl.viewers) == 0 {
+		go closeUpstream(client)
+		return nil
+	}
+
+	log.Printf("RTSP relay of media %v connected to upstream", rl.uid)
+
+	rl.setUpstreamLocked(state)
+	rl.client, rl.stop = client, make(chan struct{})
+
+	go rl.run(client, rl.stop)
+
+	return nil
+}
+
+// connects to the upstream, describes it again, and sets up and plays every
+// track of it, interleaved on the connection.
+func connectUpstream(upstream string) (*Client, upstreamState, error) {
+	client, err := dialUpstream(upstream)
+	if err != nil {
+		return nil, upstreamState{}, err
+	}
+
+	state, err := playUpstream(client)
+	if err != nil {
+		client.Close()
+		return nil, upstreamState{}, err
+	}
+
+	return client, state, nil
+}
+
+func playUpstream(client *Client) (upstreamState, error) {
+	state, err := describeUpstream(client)
+	if err != nil {
+		return upstreamState{}, err
+	}
+
+	for _, control := range state.controls {
+		if _, err := client.Setup(control, LowerTransportTCP); err != nil {
+			return upstreamState{}, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+		}
+	}
+
+	response, err := client.Play(nil)
+	if err != nil {
+		return upstreamState{}, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+	}
+
+	// the first packets are where the upstream says it plays from
+	state.positions = make([]relayPosition, len(state.controls))
+
+	if line, ok := response.Headers.GetLine(HeaderNameRTPInfo); ok {
+		if info, ok := line.(RTPInfoHeaderLine); ok {
+			for _, stream := range info.Streams {
+				for i, control := range state.controls {
+					if stream.URL == control.String() && stream.HasSeq && stream.HasRTPTime {
+						state.positions[i] = relayPosition{seq: stream.Seq, rtpTime: stream.RTPTime, known: true}
+					}
+				}
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// forwards the packets of the upstream, and keeps its session alive, until
+// stopped. A lost connection is made again, after a delay, for as long as
+// there are viewers.
+func (rl *relay) run(client *Client, stop chan struct{}) {
+	for {
+		rl.forward(client, stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		log.Printf("RTSP relay of media %v lost upstream: %v", rl.uid, client.Err())
+		client.Close()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(relayRetryDelay):
+			}
+
+			reconnected, state, err := connectUpstream(rl.upstream)
+			if err != nil {
+				log.Printf("RTSP relay of media %v failed to reconnect: %v", rl.uid, err)
+				continue
+			}
+
+			rl.lock.Lock()
+			stopped := rl.stop != stop
+			if !stopped {
+				rl.setUpstreamLocked(state)
+				rl.client = reconnected
+			}
+			rl.lock.Unlock()
+
+			if stopped {
+				go closeUpstream(reconnected)
+				return
+			}
+
+			client = reconnected
+			break
+		}
+	}
+}
+
+// fans the packets of the client out to the viewers, until the client is
+// closed
+func (rl *relay) forward(client *Client, stop chan struct{}) {
+	keepalive := time.NewTicker(client.SessionTimeout() / 2)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-keepalive.C:
+			go client.GetParameter()
+		case p, ok := <-client.Packets():
+			if !ok {
+				return
+			}
+
+			rl.fanOut(p)
+		}
+	}
+}
+
+func (rl *relay) fanOut(p Packet) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if !p.RTCP && len(p.Data) >= 12 && p.Track < len(rl.positions) {
+		rl.positions[p.Track] = relayPosition{
+			seq:     binary.BigEndian.Uint16(p.Data[2:4]) + 1,
+			rtpTime: binary.BigEndian.Uint32(p.Data[4:8]),
+			known:   true,
+		}
+	}
+
+	for _, viewer := range rl.viewers {
+		if int(viewer.track) != p.Track {
+			continue
+		}
+
+		select {
+		case viewer.packets <- p:
+		default:
+		}
+	}
+}
+
+// returns the RTP-Info of the track at the URL, with where its next packet
+// begins if that is known
+func (rl *relay) rtpInfo(track TrackID, url string) RTPInfo {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	info := RTPInfo{URL: url}
+
+	if int(track) < len(rl.positions) && rl.positions[track].known {
+		position := rl.positions[track]
+		info.Seq, info.HasSeq = position.seq, true
+		info.RTPTime, info.HasRTPTime = position.rtpTime, true
+	}
+
+	return info
+}
+
+// describes a relay as the upstream describes its media, with the session
+// level of a media of the library and the tracks controlled as `trackID=N`.
+func newRelaySessionDescription(metadata media.Metadata, upstream *pionsdp.SessionDescription, contentBase *url.URL) (*pionsdp.SessionDescription, error) {
+	desc, err := newSessionDescription(metadata, contentBase)
+	if err != nil {
+		return nil, err
+	}
+
+	desc.MediaDescriptions = nil
+
+	for i, md := range upstream.MediaDescriptions {
+		relayed := *md
+		relayed.MediaName.Port = pionsdp.RangedPort{Value: 0}
+		relayed.ConnectionInformation = nil
+		relayed.Attributes = nil
+
+		for _, a := range md.Attributes {
+			if a.Key != "control" {
+				relayed.Attributes = append(relayed.Attributes, a)
+			}
+		}
+
+		relayed.Attributes = append(relayed.Attributes, pionsdp.NewAttribute("control", trackControl(i)))
+		desc.MediaDescriptions = append(desc.MediaDescriptions, &relayed)
+	}
+
+	return desc, nil
+}
+
+// describes the relay of the media, as the upstream describes it
+func (s *RTSPServer) describeRelay(metadata media.Metadata, contentBase *url.URL) (*pionsdp.SessionDescription, error) {
+	upstream, err := s.relays.relay(metadata).describe()
+	if err != nil {
+		return nil, err
+	}
+
+	return newRelaySessionDescription(metadata, upstream, contentBase)
+}
+
+// tears down the RTP stream, and stops relaying to it if it views a relay
+func (s *RTSPServer) teardownStream(st *StreamState) {
+	s.rtpServer.TeardownStream(st.StreamUID)
+	s.relays.unsubscribe(st.StreamUID)
+}
+
+// sets up the relaying of one track of the media to the client. The caller
+// holds the session lock.
+func (s *RTSPServer) handleSetupRelay(w ResponseWriter, r *Request, path mediaPath, metadata media.Metadata, transports []TransportInfo) {
+	session := r.Session()
+
+	// every track is relayed on its own, as the upstream sends it
+	if path.Track == WholeMedia {
+		w.WriteHeader(AggregateOperationNotAllowed)
+		return
+	}
+
+	rl := s.relays.relay(metadata)
+	st := NewStreamState()
+
+	packets, err := rl.subscribe(st.StreamUID, path.Track)
+
+	if err != nil {
+		log.Printf("RTSP SETUP failed for relay %v: %v", path.UID, err)
+
+		if errors.Is(err, ErrUpstreamUnavailable) {
+			w.WriteHeader(BadGateway)
+		} else {
+			w.WriteHeader(NotFound)
+		}
+		return
+	}
+
+	args := RelayArguments{
+		StreamID:             st.StreamUID,
+		RAddr:                r.RemoteAddr,
+		Conn:                 r.Conn(),
+		AcceptableTransports: transports,
+		Packets:              packets,
+	}
+
+	transport, err := s.rtpServer.SetupRelay(args)
+
+	if err != nil {
+		rl.unsubscribe(st.StreamUID)
+		log.Printf("RTSP SETUP failed for relay %v: %v", path.UID, err)
+
+		if errors.Is(err, ErrUnsupportedTransport) {
+			w.WriteHeader(UnsupportedTransport)
+		} else {
+			w.WriteHeader(InternalServerError)
+		}
+		return
+	}
+
+	w.Header().PutLine(s.sessionHeaderLine(session.UID))
+
+	w.Header().PutLine(
+		NewTransportHeaderLine([]TransportInfo{transport}),
+	)
+
+	if transport.IsInterleaved() {
+		st.conn = r.conn
+	}
+
+	session.ContentID = path.UID
+	session.Streams[path.Track] = st
+	st.OnSetup()
+}
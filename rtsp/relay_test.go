@@ -0,0 +1,79 @@
+package rtsp_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/picast/media"
+	"github.com/rebeljah/picast/rtsp"
+)
+
+func TestRelayFansOutOneUpstreamConnection(t *testing.T) {
+	// a stand-in for the camera
+	camera := newTestServer(t, newTestMedia(t, "abc", 30*time.Second))
+	upstream := countRequests(camera)
+	cameraAddr := serveTest(t, camera)
+
+	relay := newTestServer(t, media.Metadata{
+		Title:    "camera",
+		UID:      "cam",
+		Upstream: "rtsp://" + cameraAddr + "/media/abc",
+	})
+	relayURL := "rtsp://" + serveTest(t, relay) + "/media/cam"
+
+	viewers := []*rtsp.Client{
+		playTest(t, relayURL, rtsp.LowerTransportTCP),
+		playTest(t, relayURL, rtsp.LowerTransportUDP),
+		playTest(t, relayURL, rtsp.LowerTransportTCP),
+	}
+
+	for _, viewer := range viewers {
+		awaitPacket(t, viewer)
+	}
+
+	if n := upstream.count(rtsp.PLAY); n != 1 {
+		t.Fatalf("upstream played %d times for %d viewers, want once", n, len(viewers))
+	}
+
+	// the upstream stays connected while any viewer is left
+	for _, viewer := range viewers[:len(viewers)-1] {
+		if _, err := viewer.Teardown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	awaitPacket(t, viewers[len(viewers)-1])
+
+	if n := upstream.count(rtsp.TEARDOWN); n != 0 {
+		t.Fatalf("upstream torn down %d times with a viewer left", n)
+	}
+
+	if _, err := viewers[len(viewers)-1].Teardown(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 5*time.Second, func() bool { return upstream.count(rtsp.TEARDOWN) == 1 },
+		"upstream not torn down after the last viewer left")
+}
+
+func TestRelayUnavailableUpstream(t *testing.T) {
+	relay := newTestServer(t, media.Metadata{
+		Title:    "camera",
+		UID:      "cam",
+		Upstream: "rtsp://127.0.0.1:1/media/abc",
+	})
+
+	client, err := rtsp.Dial("rtsp://"+serveTest(t, relay)+"/media/cam", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, _, err = client.Describe()
+
+	var statusErr *rtsp.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Response.StatusCode != rtsp.BadGateway {
+		t.Fatalf("DESCRIBE of an unavailable upstream: got %v, want 502", err)
+	}
+}
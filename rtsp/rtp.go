@@ -1,38 +1,136 @@
 package rtsp
 
 import (
+	"errors"
 	"net"
+	"time"
 
+	"github.com/rebeljah/picast/media"
 	"gopkg.in/vansante/go-ffprobe.v2"
 )
 
+// returned by RTPServer.SetupStream when it supports none of the acceptable
+// transports.
+var ErrUnsupportedTransport = errors.New("unsupported transport")
+
+// returned by RTPServer.SelectAudioLanguage when the media has no audio in the
+// language, or the stream can't change its audio.
+var ErrNoSuchLanguage = errors.New("no audio in language")
+
 // RTPServer defines what RTSP needs from the RTP implementation
 type RTPServer interface {
 	SetupStream(SetupArguments) (TransportInfo, error)
+	SetupIngest(IngestArguments) (TransportInfo, error)
+	SetupRelay(RelayArguments) (TransportInfo, error)
+	RecordStream(StreamUID) error
 	TeardownStream(StreamUID)
-	PlayStream(StreamUID)
-	PauseStream(StreamUID)
+	PlayStream(PlayArguments) (PlayInfo, error)
+	PauseStream(StreamUID) error
+	StreamStats(StreamUID) (StreamStats, error)
+	SetBitrateCap(uid StreamUID, bitsPerSecond int) error
+	SelectAudioLanguage(uid StreamUID, language string) error
 	Interrupt(error)
 	InterruptCause() <-chan error
 }
 
 type SetupArguments struct {
 	StreamID             StreamUID
+	Track                TrackID // the track to stream, or WholeMedia
 	RAddr                net.Addr
+	Conn                 InterleavedConn // the RTSP connection, for interleaved transports
 	AcceptableTransports []TransportInfo
 	Spec                 ffprobe.ProbeData
+	Source               media.Source     // content of the stream, owned by the RTP server after setup
+	SeekIndex            *media.SeekIndex // keyframe index of the source, nil if the source can't seek
+}
+
+// a track of a live stream, as a client that records it announced it
+type AnnouncedMedia struct {
+	Type        string // SDP media type, e.g `video`
+	Control     string // control URL of the track, relative to the live stream
+	PayloadType uint8
+	Encoding    string // RTP encoding name, upper case, e.g `H264`
+	ClockRate   uint32
+	Channels    int
+	Format      map[string]string // fmtp parameters, with lower case names
+}
+
+// the arguments to set up the receiving of one track of a live stream, which
+// the client sends to be recorded.
+type IngestArguments struct {
+	StreamID             StreamUID
+	RAddr                net.Addr
+	Conn                 InterleavedConn // the RTSP connection, for interleaved transports
+	AcceptableTransports []TransportInfo
+	Media                AnnouncedMedia
+	Recording            *media.Recording
+	Stream               int // the elementary stream of the recording that the track is written to
+}
+
+// the arguments to set up the relaying of one track of an upstream stream to a
+// client. The packets are sent as they come, while the stream is playing.
+type RelayArguments struct {
+	StreamID             StreamUID
+	RAddr                net.Addr
+	Conn                 InterleavedConn // the RTSP connection, for interleaved transports
+	AcceptableTransports []TransportInfo
+	Packets              <-chan Packet // RTP and RTCP of the track, as received from upstream
 }
 
 func newSetupArguments(
 	streamID StreamUID,
+	track TrackID,
 	clientAddr net.Addr,
+	conn InterleavedConn,
 	spec ffprobe.ProbeData,
+	source media.Source,
+	seekIndex *media.SeekIndex,
 	acceptableTransports []TransportInfo,
 ) SetupArguments {
 	return SetupArguments{
 		StreamID:             streamID,
+		Track:                track,
 		RAddr:                clientAddr,
+		Conn:                 conn,
 		Spec:                 spec,
+		Source:               source,
+		SeekIndex:            seekIndex,
 		AcceptableTransports: acceptableTransports,
 	}
 }
+
+type PlayArguments struct {
+	StreamID StreamUID
+	Seek     bool    // true iff playback should restart from Start
+	Start    float64 // normal play time to seek to, in seconds
+	Scale    float64 // rate of normal play time, 1 for normal play (see ParseScale)
+	Speed    float64 // rate of delivery, 1 for real time (see ParseSpeed)
+}
+
+// where playback of a stream actually (re)started
+type PlayInfo struct {
+	Start          float64 // normal play time of the first packet, in seconds
+	SequenceNumber uint16  // sequence number of the first packet
+	RTPTime        uint32  // RTP timestamp of the first packet
+}
+
+// how well a stream is delivered, from what was sent and the RTCP receiver
+// reports of the client.
+type StreamStats struct {
+	SSRC        uint32
+	PacketsSent uint32
+	OctetsSent  uint32  // payload octets
+	Bitrate     float64 // measured send rate, in bits per second
+	Position    float64 // normal play time of the last packet sent, in seconds
+
+	// when a stream that the client records last received media
+	ReceivedAt time.Time
+
+	// from the latest receiver report, only set if HasReceiverReport
+	HasReceiverReport bool
+	ReportedAt        time.Time
+	FractionLost      float64       // fraction of packets lost since the previous report
+	TotalLost         uint32        // packets lost since the start of the stream
+	Jitter            time.Duration // interarrival jitter
+	RTT               time.Duration // round trip time, 0 until the client echoes a sender report
+}
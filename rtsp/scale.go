@@ -0,0 +1,44 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidScale = errors.New("invalid scale")
+var ErrInvalidSpeed = errors.New("invalid speed")
+
+// returned by RTPServer.PlayStream when it can't play a stream at the requested
+// scale or speed.
+var ErrUnsupportedScale = errors.New("unsupported scale")
+var ErrUnsupportedSpeed = errors.New("unsupported speed")
+
+// parses a Scale value (RFC2326-12.34), the rate of normal play time to wall
+// clock time. 2 plays twice as fast, -1 plays in reverse, and 1 is normal play.
+func ParseScale(value string) (float64, error) {
+	scale, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || scale == 0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidScale, value)
+	}
+
+	return scale, nil
+}
+
+// parses a Speed value (RFC2326-12.35), the rate the data is delivered at
+// relative to real time, without changing how it is presented.
+func ParseSpeed(value string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || speed <= 0 || math.IsInf(speed, 0) || math.IsNaN(speed) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidSpeed, value)
+	}
+
+	return speed, nil
+}
+
+// formats a Scale or Speed value
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
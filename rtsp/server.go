@@ -4,147 +4,180 @@ package rtsp
 // is just for fun.
 
 import (
-	"bufio"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rebeljah/picast/media"
 )
 
-type handler interface {
-	serveRTSP(*requestContext)
-	withMiddleware(handler) handler
-}
+func handleMirrorCSeqHeader(w ResponseWriter, r *Request) {
+	cseq, ok := r.Headers.GetLine(HeaderNameCSeq)
+	if !ok {
+		w.WriteHeader(BadRequest)
+		return
+	}
 
-type serveMux map[RTSPMethod]handler
+	n, err := strconv.Atoi(string(cseq.ValueNoError()))
 
-func newDefaultMux() serveMux {
-	return make(serveMux)
-}
+	if err != nil {
+		w.WriteHeader(BadRequest)
+		return
+	}
 
-func (m serveMux) handle(method RTSPMethod, handler handler) {
-	m[method] = handler
-}
+	w.Header().PutGenericLine("CSeq", cseq.ValueNoError())
 
-func (m serveMux) serveRTSP(ctx *requestContext) {
-	handler, ok := m[ctx.request.Method]
+	// CSeq must increase monotonically over the requests of a connection.
+	if r.conn != nil {
+		if n <= r.conn.lastCSeq {
+			w.WriteHeader(BadRequest)
+			return
+		}
 
-	if !ok {
-		ctx.response.writeHeader(MethodNotAllowed)
-		return
+		r.conn.lastCSeq = n
 	}
-
-	handler.serveRTSP(ctx)
 }
 
-func (m serveMux) withMiddleware(mdl handler) handler {
-	return newMiddleWare(mdl, m)
+func handleSettingFinalHeaders(w ResponseWriter, r *Request) {
+	w.Header().PutGenericLine(HeaderNameServer, "picast/"+Version)
+
+	// the connection will be closed after this response if the client asked for it
+	if connection, ok := r.Headers.GetLine(HeaderNameConnection); ok {
+		if strings.EqualFold(connection.ValueNoError(), "close") {
+			w.Header().PutGenericLine(HeaderNameConnection, "close")
+		}
+	}
 }
 
-// HandlerFunc type is an adapter to allow the use of
-// ordinary functions as RTSP handlers. If f is a function
-// with the appropriate signature, HandlerFunc(f) is a
-// Handler that calls f.
-type HandlerFunc func(*requestContext)
+type RTSPServer struct {
+	sessions      sessionManager
+	conns         connSet
+	rtpServer     RTPServer
+	mediaManifest media.MutableManifest
+	live          liveStreams
+	relays        relays
+	peers         peerLoads
+	listenerLock  sync.Mutex
+	listeners     []net.Listener
+	certificates  *certificateReloader // of the TLS listener
+	reaperOnce    sync.Once
+	interruptOnce sync.Once
+	stop          chan struct{} // closed on interrupt
 
-// serveRTSP calls f(ctx) to implement Handler.
-func (f HandlerFunc) serveRTSP(ctx *requestContext) {
-	f(ctx)
-}
+	// max time to wait for the next request on a connection. Zero means no timeout.
+	IdleTimeout time.Duration
 
-func (f HandlerFunc) withMiddleware(mdl handler) handler {
-	return newMiddleWare(mdl, f)
-}
+	// max time to read a request, once it has begun arriving. Zero means no timeout.
+	ReadTimeout time.Duration
 
-type Middleware struct {
-	handler     handler
-	nextHandler handler
-}
+	// max time to write a response. Zero means no timeout.
+	WriteTimeout time.Duration
 
-func newMiddleWare(handler handler, nextHandler handler) Middleware {
-	return Middleware{handler: handler, nextHandler: nextHandler}
-}
+	// bounds the requests that are read. Requests beyond them are refused,
+	// and their connection closed.
+	Limits MessageLimits
 
-func (m Middleware) serveRTSP(ctx *requestContext) {
-	m.handler.serveRTSP(ctx)
+	// time a session lives after the client was last seen. Zero means sessions
+	// never time out.
+	SessionTimeout time.Duration
 
-	if ctx.response.StatusCode == OK {
-		m.nextHandler.serveRTSP(ctx)
-	}
-}
+	// called after a session is torn down because it timed out, if set.
+	OnSessionTimeout func(SessionUID)
 
-func (m Middleware) withMiddleware(mdl handler) handler {
-	return newMiddleWare(mdl, m)
-}
+	// routes requests to the built-in methods, and to any that are added.
+	Mux *ServeMux
 
-func handleMirrorCSeqHeader(ctx *requestContext) {
-	cseq, ok := ctx.request.Headers.GetLine(HeaderNameCSeq)
-	if !ok {
-		ctx.response.writeHeader(BadRequest)
-		return
-	}
+	// serves requests once their CSeq is checked. It looks up the session of
+	// each request and passes it on to the Mux, unless wrapped in middleware,
+	// e.g to authenticate requests before anything else.
+	Handler Handler
 
-	_, err := strconv.Atoi(string(cseq.ValueNoError()))
+	// option tags (RFC2326-3.8) of the extensions that the handlers support,
+	// which clients may require. Requests that require others are refused.
+	Options []string
 
-	if err != nil {
-		ctx.response.writeHeader(BadRequest)
-		return
-	}
+	// directory that live streams announced by clients are recorded into, and
+	// added to the manifest from. Clients can't record if empty.
+	RecordingDir string
 
-	ctx.response.Headers.PutGenericLine("CSeq", cseq.ValueNoError())
-}
+	// the load beyond which new sessions are sent to a peer, or refused if no
+	// peer has room. The zero budget is no limit.
+	Budget LoadBudget
 
-func handleSettingFinalHeaders(ctx *requestContext) {
-	// content-length
-	if n := len(ctx.response.Body); n == 0 {
-		ctx.response.Headers.Delete(HeaderNameContentLength)
-	} else {
-		ctx.response.Headers.PutGenericLine(
-			HeaderNameContentLength, strconv.Itoa(n),
-		)
-	}
+	// how new sessions beyond the Budget are sent to a peer.
+	RedirectMode RedirectMode
 
-	ctx.response.Headers.PutGenericLine(
-		HeaderNameConnection, "close",
-	)
-}
+	// the UDP heartbeat addresses of the other nodes that serve the same
+	// library, e.g `pi2.local:8555`.
+	Peers []string
 
-type RTSPServer struct {
-	sessions      sessionManager
-	handler       handler
-	rtpServer     RTPServer
-	mediaManifest media.Manifest
-	listener      net.Listener
-	interruptOnce sync.Once
+	// the base URL of the server that its peers redirect clients to, e.g
+	// `rtsp://pi1.local:8554`. Heartbeats are only sent if set.
+	AdvertisedURL string
+
+	// time between heartbeats. Zero means DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
 }
 
-func NewRTSPServer(rtpServer RTPServer, manifest media.Manifest) *RTSPServer {
+func NewRTSPServer(rtpServer RTPServer, manifest media.MutableManifest) *RTSPServer {
 	s := &RTSPServer{
 		sessions:      newSessionManager(),
+		conns:         newConnSet(),
 		mediaManifest: manifest,
+		live:          newLiveStreams(),
+		relays:        newRelays(),
+		peers:         newPeerLoads(),
 		rtpServer:     rtpServer,
+		IdleTimeout:   DefaultIdleTimeout,
+		ReadTimeout:   DefaultReadTimeout,
+		WriteTimeout:  DefaultWriteTimeout,
+		Limits:        DefaultMessageLimits,
+
+		SessionTimeout: DefaultSessionTimeout,
+		stop:           make(chan struct{}),
 	}
 
-	mux := newDefaultMux()
-	mux.handle(SETUP, HandlerFunc(s.handleSetup))
-	mux.handle(TEARDOWN, HandlerFunc(s.handleTeardown))
-	mux.handle(PLAY, HandlerFunc(s.handlePlay))
-	mux.handle(PAUSE, HandlerFunc(s.handlePause))
-	mux.handle(OPTIONS, HandlerFunc(s.handleOptions))
+	s.Mux = NewServeMux()
 
-	s.handler = HandlerFunc(handleSettingFinalHeaders)
-	s.handler = mux
-	s.handler = s.handler.withMiddleware(HandlerFunc(s.handleSettingContextSession))
-	s.handler = s.handler.withMiddleware(HandlerFunc(handleMirrorCSeqHeader))
+	// keepalives and server options may be sent for any URL
+	s.Mux.HandleFunc(OPTIONS, "/", s.handleOptions)
+	s.Mux.HandleFunc(GET_PARAMETER, "/", s.handleGetParameter)
+
+	// media of the library, and live streams
+	for _, pattern := range []string{"/media/", "/live/"} {
+		s.Mux.HandleFunc(DESCRIBE, pattern, s.handleDescribe)
+		s.Mux.HandleFunc(SETUP, pattern, s.handleSetup)
+		s.Mux.HandleFunc(PLAY, pattern, s.handlePlay)
+		s.Mux.HandleFunc(PAUSE, pattern, s.handlePause)
+		s.Mux.HandleFunc(TEARDOWN, pattern, s.handleTeardown)
+		s.Mux.HandleFunc(SET_PARAMETER, pattern, s.handleSetParameter)
+	}
+
+	// only live streams are recorded
+	s.Mux.HandleFunc(ANNOUNCE, "/live/", s.handleAnnounce)
+	s.Mux.HandleFunc(RECORD, "/live/", s.handleRecord)
+
+	s.Handler = NewMiddleware(HandlerFunc(s.handleSettingContextSession), s.Mux)
 
 	return s
 }
 
+// ServeRTSP checks the CSeq of a request, and that its required options are
+// supported, and serves it with the Handler.
+func (s *RTSPServer) ServeRTSP(w ResponseWriter, r *Request) {
+	var h Handler = NewMiddleware(HandlerFunc(s.handleRequiredOptions), s.Handler)
+	h = NewMiddleware(HandlerFunc(handleMirrorCSeqHeader), h)
+	h = NewDeferredMiddleware(HandlerFunc(handleSettingFinalHeaders), h)
+
+	h.ServeRTSP(w, r)
+}
+
 func (s *RTSPServer) ListenAndServe(addr string) error {
 	log.Println("starting RTSP server on " + addr)
 
@@ -154,11 +187,21 @@ func (s *RTSPServer) ListenAndServe(addr string) error {
 		return err
 	}
 
-	s.listener = ls
-	defer s.listener.Close()
+	return s.serve(ls)
+}
+
+// accepts connections on the listener until the server is interrupted
+func (s *RTSPServer) serve(ls net.Listener) error {
+	if !s.addListener(ls) {
+		ls.Close()
+		return nil
+	}
+	defer ls.Close()
+
+	s.startReaper()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := ls.Accept()
 
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
@@ -174,241 +217,715 @@ func (s *RTSPServer) ListenAndServe(addr string) error {
 	}
 }
 
+// adds a listener to close on interrupt, unless the server was interrupted
+func (s *RTSPServer) addListener(ls net.Listener) bool {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+
+	s.listeners = append(s.listeners, ls)
+	return true
+}
+
 func (s *RTSPServer) Interrupt(err error) {
 	s.interruptOnce.Do(func() {
 		log.Printf("Interrupting RTSP server: %v\n", err)
 
-		s.listener.Close()
+		s.listenerLock.Lock()
+		close(s.stop)
+		for _, ls := range s.listeners {
+			ls.Close()
+		}
+		s.listenerLock.Unlock()
+
+		s.conns.closeAll()
 
 		log.Println("RTSP server shutdown complete")
 	})
 }
 
-func (s *RTSPServer) handleSetup(ctx *requestContext) {
-	path := strings.Trim(ctx.request.URL.Path, "/ ")
-	segments := strings.Split(path, "/")
+func (s *RTSPServer) handleDescribe(w ResponseWriter, r *Request) {
+	path, status := s.resolveMediaPath(r.URL)
 
-	// media/{uid}
-	if len(segments) != 2 {
-		ctx.response.writeHeader(NotFound)
+	if status != OK {
+		w.WriteHeader(status)
 		return
 	}
 
-	if segments[0] != "media" {
-		ctx.response.writeHeader(MethodNotAllowed)
+	// only the media as a whole is described
+	if path.Track != WholeMedia {
+		w.WriteHeader(NotFound)
 		return
 	}
 
-	mediaUID := media.UID(segments[1])
+	mediaUID := path.UID
 
-	metadata, ok := s.mediaManifest.Get(mediaUID)
+	if accept := r.Headers.Values(HeaderNameAccept); len(accept) > 0 && !accepts(accept, ContentTypeSDP) {
+		w.WriteHeader(NotAcceptable)
+		return
+	}
+
+	metadata, _, ok := s.lookupMedia(mediaUID)
 
 	if !ok {
-		ctx.response.writeHeader(NotFound)
+		w.WriteHeader(NotFound)
 		return
 	}
 
-	ctx.session.Stream = NewStreamState()
+	contentBase := newContentBase(r.URL, mediaUID)
+
+	describe := newSessionDescription
+	if metadata.IsRelay() {
+		describe = s.describeRelay
+	}
+
+	desc, err := describe(metadata, contentBase)
 
-	if ok && ctx.session.Stream.StateNow != Init {
-		ctx.response.writeHeader(MethodNotValidInThisState)
+	if err != nil {
+		if errors.Is(err, ErrUpstreamUnavailable) {
+			log.Printf("RTSP DESCRIBE failed for relay %v: %v", mediaUID, err)
+			w.WriteHeader(BadGateway)
+			return
+		}
+
+		writeError(w, InternalServerError, err)
+		return
+	}
+
+	w.Header().PutGenericLine(HeaderNameContentBase, contentBase.String())
+	w.Header().PutLine(NewContentTypeHeaderLine(ContentTypeSDP, nil))
+	w.Write([]byte(desc.Marshal()))
+}
+
+func (s *RTSPServer) handleSetup(w ResponseWriter, r *Request) {
+	session := r.Session()
+
+	path, status := s.resolveMediaPath(r.URL)
+
+	if status != OK {
+		w.WriteHeader(status)
 		return
 	}
 
-	line, ok := ctx.request.Headers.GetLine(HeaderNameTransport)
+	metadata, recording, ok := s.lookupMedia(path.UID)
+
+	// the tracks of a relay are those that the upstream describes
+	if !ok || (path.Track != WholeMedia && !metadata.IsRelay() && !hasTrack(metadata.Structure, path.Track)) {
+		w.WriteHeader(NotFound)
+		return
+	}
+
+	line, ok := r.Headers.GetLine(HeaderNameTransport)
 
 	if !ok {
-		ctx.response.writeHeader(BadRequest)
+		w.WriteHeader(BadRequest)
 		return
 	}
 
+	// a Transport that could not be parsed is kept as sent
 	var transportHeader TransportHeaderLine
 	if transportHeader, ok = line.(TransportHeaderLine); !ok {
-		ctx.response.writeHeader(InternalServerError)
+		w.WriteHeader(BadRequest)
 		return
 	}
 
 	if len(transportHeader.Transports) == 0 {
-		ctx.response.writeHeader(BadRequest)
+		w.WriteHeader(BadRequest)
+		return
+	}
+
+	// a server over its budget sends a new session to a peer, unless it is of
+	// a live stream, which only the server has
+	var redirectTo *url.URL
+
+	if _, inSession := r.Headers.GetLine(HeaderNameSession); !inSession && recording == nil && !isRecordTransport(transportHeader.Transports) {
+		var responded bool
+		if redirectTo, responded = s.handleOverBudget(w, r); responded {
+			return
+		}
+	}
+
+	// the upstream of a relay is described before the session is locked, as
+	// that may take a while
+	if metadata.IsRelay() {
+		if _, err := s.relays.relay(metadata).describe(); err != nil {
+			log.Printf("RTSP SETUP failed for relay %v: %v", path.UID, err)
+			w.WriteHeader(BadGateway)
+			return
+		}
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	if redirectTo != nil {
+		defer func() {
+			if len(session.Streams) > 0 {
+				s.redirectSession(r, newContentBase(r.URL, path.UID), redirectTo)
+			}
+		}()
+	}
+
+	// a session that SETUP began is only kept once something is set up in it,
+	// so that a SETUP that fails leaves nothing behind
+	if _, inSession := r.Headers.GetLine(HeaderNameSession); !inSession {
+		defer func() {
+			if len(session.Streams) > 0 {
+				s.sessions.add(session)
+			}
+		}()
+	}
+
+	// a session aggregates the tracks of one media, and either streams the
+	// whole media or its tracks one by one.
+	if len(session.Streams) > 0 {
+		_, hasWholeMedia := session.Streams[WholeMedia]
+
+		if path.UID != session.ContentID || hasWholeMedia || path.Track == WholeMedia {
+			w.WriteHeader(AggregateOperationNotAllowed)
+			return
+		}
+	}
+
+	// changing the transport of a stream that is already set up is not supported
+	if _, ok := session.Streams[path.Track]; ok {
+		w.WriteHeader(MethodNotValidInThisState)
+		return
+	}
+
+	if metadata.IsRelay() {
+		s.handleSetupRelay(w, r, path, metadata, transportHeader.Transports)
+		return
+	}
+
+	if isRecordTransport(transportHeader.Transports) {
+		s.handleSetupRecord(w, r, path, transportHeader.Transports)
 		return
 	}
 
+	st := NewStreamState()
+
+	// a live stream is watched from its latest keyframe as it is recorded
+	var source media.Source
+	var err error
+
+	if recording != nil {
+		source, err = recording.Watch()
+	} else {
+		source, err = metadata.OpenSource()
+	}
+
+	if err != nil {
+		log.Printf("RTSP SETUP could not open media %v: %v", path.UID, err)
+		w.WriteHeader(InternalServerError)
+		return
+	}
+
+	// without an index, the media can only be played from the start
+	var seekIndex *media.SeekIndex
+
+	if recording == nil {
+		if index, err := metadata.LoadSeekIndex(); err == nil {
+			seekIndex = &index
+		} else {
+			log.Printf("RTSP SETUP could not load seek index of media %v: %v", path.UID, err)
+		}
+	}
+
 	args := newSetupArguments(
-		ctx.session.Stream.StreamUID,
-		ctx.raddr,
+		st.StreamUID,
+		path.Track,
+		r.RemoteAddr,
+		r.Conn(),
 		metadata.Structure,
+		source,
+		seekIndex,
 		transportHeader.Transports,
 	)
 
 	transport, err := s.rtpServer.SetupStream(args)
 
 	if err != nil {
-		ctx.response.writeHeader(InternalServerError)
+		source.Close()
+		log.Printf("RTSP SETUP failed for media %v: %v", path.UID, err)
+
+		if errors.Is(err, ErrUnsupportedTransport) {
+			w.WriteHeader(UnsupportedTransport)
+		} else {
+			w.WriteHeader(InternalServerError)
+		}
 		return
 	}
 
-	ctx.response.Headers.PutGenericLine(
-		HeaderNameSession, string(ctx.session.UID),
-	)
+	w.Header().PutLine(s.sessionHeaderLine(session.UID))
 
-	ctx.response.Headers.PutLine(
+	w.Header().PutLine(
 		NewTransportHeaderLine([]TransportInfo{transport}),
 	)
 
-	ctx.session.Stream.OnSetup()
+	if transport.IsInterleaved() {
+		st.conn = r.conn
+	}
+
+	session.ContentID = path.UID
+	session.Streams[path.Track] = st
+	st.OnSetup()
 }
 
-func (s *RTSPServer) handleTeardown(ctx *requestContext) {
-	// validate media/{id}
+func (s *RTSPServer) handleTeardown(w ResponseWriter, r *Request) {
+	session := r.Session()
 
-	/////////////////// TODO section is repeated in HandleSetup (extract?)
-	path := strings.Trim(ctx.request.URL.Path, "/ ")
-	segments := strings.Split(path, "/")
+	path, status := s.resolveMediaPath(r.URL)
 
-	if n := len(segments); n != 2 {
-		ctx.response.writeHeader(NotFound)
+	if status != OK {
+		w.WriteHeader(status)
 		return
 	}
 
-	if segments[0] != "media" {
-		ctx.response.writeHeader(MethodNotAllowed)
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
 		return
 	}
-	///////////////////////
 
-	st := ctx.session.Stream
+	tracks, status := session.controlledTracks(path, TEARDOWN)
 
-	if st == nil {
-		ctx.response.writeHeader(NotFound)
+	if status != OK {
+		w.WriteHeader(status)
 		return
 	}
 
-	// make sure stream can actually be torn down in current state
-	if st.StateNow.After(TEARDOWN) == ErrorState {
-		ctx.response.writeHeader(MethodNotValidInThisState)
-		return
+	// make sure every stream can actually be torn down in its current state
+	for _, track := range tracks {
+		if session.Streams[track].StateNow.After(TEARDOWN) == ErrorState {
+			w.WriteHeader(MethodNotValidInThisState)
+			return
+		}
 	}
 
-	s.rtpServer.TeardownStream(st.StreamUID)
-	st.OnTeardown()
+	for _, track := range tracks {
+		st := session.Streams[track]
 
-	s.sessions.delete(ctx.session.UID)
-}
+		s.teardownStream(st)
+		st.OnTeardown()
 
-func (*RTSPServer) handlePlay(ctx *requestContext) {}
+		delete(session.Streams, track)
+	}
 
-func (*RTSPServer) handlePause(ctx *requestContext) {}
+	// the session ends with its last stream
+	if len(session.Streams) == 0 {
+		s.endSession(session)
+	}
+}
 
-func (*RTSPServer) handleOptions(ctx *requestContext) {}
+func (s *RTSPServer) handlePlay(w ResponseWriter, r *Request) {
+	session := r.Session()
 
-func (s *RTSPServer) handleSettingContextSession(ctx *requestContext) {
-	sessionHeader, ok := ctx.request.Headers.GetLine(HeaderNameSession)
+	path, status := s.resolveMediaPath(r.URL)
 
-	// context not required for SETUP, OPTIONS
-	if !ok && ctx.request.Method != SETUP && ctx.request.Method != OPTIONS {
-		ctx.response.writeHeader(SessionNotFound)
+	if status != OK {
+		w.WriteHeader(status)
 		return
 	}
 
-	// SETUP not valid for an active streaming session
-	if ok && ctx.request.Method == SETUP {
-		ctx.response.writeHeader(MethodNotValidInThisState)
+	args := PlayArguments{Scale: 1, Speed: 1}
+
+	// seek when a range is given, otherwise resume from the current position
+	if line, ok := r.Headers.GetLine(HeaderNameRange); ok {
+		rangeHeader, ok := line.(RangeHeaderLine)
+
+		if !ok {
+			w.WriteHeader(InvalidRange)
+			return
+		}
+
+		npt := rangeHeader.Range
+
+		metadata, recording, ok := s.lookupMedia(path.UID)
+
+		if ok && metadata.Duration > 0 && npt.Start > metadata.Duration {
+			w.WriteHeader(InvalidRange)
+			return
+		}
+
+		// a live stream plays on from where it is
+		args.Seek = !npt.IsNow && recording == nil && !metadata.IsRelay()
+		args.Start = npt.Start
+	}
+
+	// trick play, a Scale or Speed applies until the next PLAY
+	line, hasScale := r.Headers.GetLine(HeaderNameScale)
+	if hasScale {
+		scaleHeader, ok := line.(ScaleHeaderLine)
+		if !ok {
+			w.WriteHeader(HeaderFieldNotValid)
+			return
+		}
+		args.Scale = scaleHeader.Scale
+	}
+
+	line, hasSpeed := r.Headers.GetLine(HeaderNameSpeed)
+	if hasSpeed {
+		speedHeader, ok := line.(SpeedHeaderLine)
+		if !ok {
+			w.WriteHeader(HeaderFieldNotValid)
+			return
+		}
+		args.Speed = speedHeader.Speed
+	}
+
+	// a relay plays once it is connected upstream, which may take a while, so
+	// it connects before the session is locked
+	rl, isRelay := s.relays.get(path.UID)
+
+	if isRelay {
+		if err := rl.play(); err != nil {
+			log.Printf("RTSP PLAY failed for relay %v: %v", path.UID, err)
+			w.WriteHeader(BadGateway)
+			return
+		}
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
 		return
 	}
 
-	sessionUID := SessionUID(sessionHeader.ValueNoError())
-	ctx.session, ok = s.sessions.get(sessionUID)
+	tracks, status := session.controlledTracks(path, PLAY)
 
-	if !ok {
-		ctx.response.writeHeader(SessionNotFound)
+	if status != OK {
+		w.WriteHeader(status)
 		return
 	}
-}
 
-func (s *RTSPServer) readRequest(conn net.Conn) (Request, error) {
-	var raw strings.Builder
-	reader := bufio.NewReader(conn)
+	// make sure every stream can actually be played in its current state
+	for _, track := range tracks {
+		if session.Streams[track].StateNow.After(PLAY) == ErrorState {
+			w.WriteHeader(MethodNotValidInThisState)
+			return
+		}
+	}
+
+	infos := make([]PlayInfo, 0, len(tracks))
 
-	for {
-		line, err := reader.ReadString('\n')
+	for _, track := range tracks {
+		st := session.Streams[track]
+		args.StreamID = st.StreamUID
+
+		info, err := s.rtpServer.PlayStream(args)
 
 		if err != nil {
-			return Request{}, err
+			log.Printf("RTSP PLAY failed for stream %v: %v", st.StreamUID, err)
+
+			// the tracks play together or not at all
+			for _, played := range tracks[:len(infos)] {
+				if st := session.Streams[played]; st.StateNow != Playing {
+					s.rtpServer.PauseStream(st.StreamUID)
+				}
+			}
+
+			switch {
+			case errors.Is(err, ErrUnsupportedScale), errors.Is(err, ErrUnsupportedSpeed):
+				w.WriteHeader(HeaderFieldNotValid)
+			case args.Seek:
+				w.WriteHeader(InvalidRange)
+			default:
+				w.WriteHeader(InternalServerError)
+			}
+			return
 		}
 
-		raw.WriteString(line)
+		infos = append(infos, info)
+	}
+
+	rtpInfo := make([]RTPInfo, len(tracks))
+
+	for i, track := range tracks {
+		session.Streams[track].OnPlay()
 
-		if line == "\r\n" {
-			break
+		if isRelay {
+			rtpInfo[i] = rl.rtpInfo(track, trackURL(r.URL, path, track))
+			continue
+		}
+
+		rtpInfo[i] = RTPInfo{
+			URL:        trackURL(r.URL, path, track),
+			Seq:        infos[i].SequenceNumber,
+			HasSeq:     true,
+			RTPTime:    infos[i].RTPTime,
+			HasRTPTime: true,
 		}
 	}
 
-	request, err := newRequestFromString(raw.String())
+	w.Header().PutLine(NewRangeHeaderLine(NPTRange{Start: infos[0].Start}))
+	w.Header().PutLine(NewRTPInfoHeaderLine(rtpInfo))
 
-	if err != nil {
-		return Request{}, err
+	if hasScale {
+		w.Header().PutLine(NewScaleHeaderLine(args.Scale))
 	}
 
-	if contentLenHeaderLine, ok := request.Headers.GetLine(HeaderNameContentLength); ok {
-		contentLength, err := strconv.Atoi(string(contentLenHeaderLine.ValueNoError()))
+	if hasSpeed {
+		w.Header().PutLine(NewSpeedHeaderLine(args.Speed))
+	}
+}
 
-		if err != nil {
-			return request, err
+func (s *RTSPServer) handlePause(w ResponseWriter, r *Request) {
+	session := r.Session()
+
+	path, status := s.resolveMediaPath(r.URL)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.Ended() {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	tracks, status := session.controlledTracks(path, PAUSE)
+
+	if status != OK {
+		w.WriteHeader(status)
+		return
+	}
+
+	// make sure every stream can actually be paused in its current state
+	for _, track := range tracks {
+		if session.Streams[track].StateNow.After(PAUSE) == ErrorState {
+			w.WriteHeader(MethodNotValidInThisState)
+			return
 		}
+	}
 
-		request.Body = make([]byte, contentLength)
-		_, err = io.ReadFull(conn, request.Body)
+	for _, track := range tracks {
+		st := session.Streams[track]
 
-		if err != nil {
-			return request, err
+		if err := s.rtpServer.PauseStream(st.StreamUID); err != nil {
+			log.Printf("RTSP PAUSE failed for stream %v: %v", st.StreamUID, err)
+			w.WriteHeader(InternalServerError)
+			return
+		}
+	}
+
+	for _, track := range tracks {
+		session.Streams[track].OnPause()
+	}
+}
+
+// responds with the methods of the mux, which may be used on any URL
+func (s *RTSPServer) handleOptions(w ResponseWriter, r *Request) {
+	w.Header().PutGenericLine(HeaderNamePublic, joinMethods(s.Mux.Methods()))
+}
+
+func (s *RTSPServer) handleSettingContextSession(w ResponseWriter, r *Request) {
+	sessionHeader, ok := r.Headers.GetLine(HeaderNameSession)
+
+	// a session is required to PLAY, PAUSE, TEARDOWN, RECORD or
+	// SET_PARAMETER, but not for OPTIONS, DESCRIBE, ANNOUNCE, a GET_PARAMETER
+	// ping, or the extension methods of other handlers.
+	// SETUP without a session begins a new one, while SETUP in a session adds
+	// a track to it.
+	if !ok {
+		switch r.Method {
+		case SETUP:
+			// the session is only added to the server once SETUP sets
+			// something up in it
+			r.session = NewSession()
+		case PLAY, PAUSE, TEARDOWN, RECORD, SET_PARAMETER:
+			w.WriteHeader(SessionNotFound)
 		}
+		return
 	}
 
-	return request, nil
+	// the client may echo parameters after the id, e.g `;timeout=60`
+	session, ok := sessionHeader.(SessionHeaderLine)
+	if ok {
+		r.session, ok = s.sessions.get(session.ID)
+	}
+
+	if !ok {
+		w.WriteHeader(SessionNotFound)
+		return
+	}
+
+	// any request in the session keeps it alive
+	r.session.Touch()
+
+	w.Header().PutLine(s.sessionHeaderLine(session.ID))
+}
+
+func (s *RTSPServer) readRequest(c *conn) (Request, error) {
+	if s.ReadTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+
+	return ReadRequest(c.reader, s.Limits)
+}
+
+// responds to a request that could not be read. The connection is closed
+// after, as what follows the request can't be told apart from it.
+func (s *RTSPServer) refuseRequest(c *conn, reqErr *RequestError) {
+	response := newResponse(reqErr.Status)
+	response.Headers.PutGenericLine(HeaderNameConnection, "close")
+	writeError(response, reqErr.Status, reqErr.Err)
+
+	if resp, err := response.marshal(); err == nil {
+		c.writeLocked(resp)
+	}
+}
+
+// tears down every session with a stream interleaved on the connection, which
+// can no longer be sent. Sessions over UDP outlive the connection, as a client
+// may send the requests of a session over any connection, and are left to time
+// out if it never does.
+func (s *RTSPServer) closeConnectionSessions(c *conn) {
+	for _, session := range s.sessions.all() {
+		session.Lock()
+		if session.ended || !session.interleavedOn(c) {
+			session.Unlock()
+			continue
+		}
+
+		for track, st := range session.Streams {
+			s.teardownStream(st)
+			st.OnTeardown()
+			delete(session.Streams, track)
+		}
+		s.endSession(session)
+		session.Unlock()
+
+		log.Printf("RTSP session %v closed with its connection", session.UID)
+	}
+}
+
+// ServeConn serves RTSP on a connection that was accepted elsewhere, e.g one
+// tunneled through HTTP, until it is closed.
+func (s *RTSPServer) ServeConn(c net.Conn) {
+	select {
+	case <-s.stop:
+		c.Close()
+	default:
+		s.startReaper()
+		s.serveConnection(c)
+	}
 }
 
-func (s *RTSPServer) serveConnection(conn net.Conn) {
-	log.Printf("serving RTSP to: %v", conn.RemoteAddr())
+// serves requests from a connection one at a time, in the order they arrive,
+// until the client closes the connection, asks for it to be closed, or it
+// idles past the timeout.
+func (s *RTSPServer) serveConnection(netConn net.Conn) {
+	log.Printf("serving RTSP to: %v", netConn.RemoteAddr())
 
-	var resp []byte
-	var rctx *requestContext
-	raddr := conn.RemoteAddr()
+	c := newConn(netConn, s.WriteTimeout)
+	raddr := c.RemoteAddr()
 
-	defer conn.Close()
-	defer func() {
-		if resp == nil { // Only write if resp was set
+	s.conns.add(c)
+
+	defer s.conns.delete(c)
+	defer c.Close()
+	defer c.closeChannelReaders()
+	defer s.closeConnectionSessions(c)
+
+	for {
+		isInterleaved, err := c.awaitMessage(s.IdleTimeout)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("RTSP connection from %v closing: %v\n", raddr, err)
+			}
 			return
 		}
 
-		log.Printf("writing RTSP response to: %v", raddr)
+		// binary data from the client multiplexed with the RTSP requests, e.g
+		// RTCP receiver reports. Frames on channels nobody reads are discarded.
+		if isInterleaved {
+			channel, payload, err := readInterleavedFrame(c.reader)
+			if err != nil {
+				log.Printf("RTSP interleaved read error from %v: %v\n", raddr, err)
+				return
+			}
+			c.deliverFrame(channel, payload)
+			continue
+		}
+
+		// the client answers the requests that the server sent, e.g a
+		// REDIRECT, which need nothing more
+		if c.isResponseNext() {
+			if s.ReadTimeout > 0 {
+				c.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+			}
+
+			response, err := ReadResponse(c.reader, s.Limits)
+			if err != nil {
+				log.Printf("RTSP read error from %v: %v\n", raddr, err)
+				return
+			}
 
-		_, err := conn.Write(resp)
+			log.Printf("read RTSP response from: %v (%v %v)", raddr, response.StatusCode, response.StatusText)
+			continue
+		}
+
+		log.Printf("reading RTSP request from: %v", raddr)
+
+		req, err := s.readRequest(c)
 		if err != nil {
-			log.Printf("RTSP write error to %v: %v\n", raddr, err)
+			log.Printf("RTSP read error from %v: %v\n", raddr, err)
+
+			var reqErr *RequestError
+			if errors.As(err, &reqErr) {
+				s.refuseRequest(c, reqErr)
+			}
 			return
 		}
 
-		log.Printf("wrote RTSP response to: %v (%v %v)", raddr, rctx.response.StatusCode, rctx.response.StatusText)
-	}()
+		req.RemoteAddr, req.conn = raddr, c
+		response := newResponse(OK)
 
-	log.Printf("reading RTSP request from: %v", raddr)
+		log.Printf("handling RTSP request from: %v (%v %v)", raddr, req.Method, req.URL)
 
-	req, err := s.readRequest(conn)
-	if err != nil {
-		log.Printf("RTSP read error from %v: %v\n", raddr, err)
-		return
-	}
+		s.ServeRTSP(response, &req)
 
-	rctx = newRequestContext(conn.RemoteAddr(), &req, newResponse(OK), nil)
+		resp, err := response.marshal()
+		if err != nil {
+			log.Printf("error while marshalling RTSP response to: %v", raddr)
+			resp, _ = newResponse(InternalServerError).marshal()
+		}
 
-	log.Printf("handling RTSP request from: %v (%v %v)", raddr, req.Method, req.URL)
+		if err := c.writeLocked(resp); err != nil {
+			log.Printf("RTSP write error to %v: %v\n", raddr, err)
+			return
+		}
 
-	s.handler.serveRTSP(rctx)
+		log.Printf("wrote RTSP response to: %v (%v %v)", raddr, response.StatusCode, response.StatusText)
 
-	resp, err = rctx.response.marshal()
-	if err != nil {
-		resp, _ = newResponse(InternalServerError).marshal()
-		log.Printf("error while marshalling RTSP response to: %v", raddr)
-		return
+		if err := c.sendRequests(); err != nil {
+			log.Printf("RTSP write error to %v: %v\n", raddr, err)
+			return
+		}
+
+		if connection, ok := response.Headers.GetLine(HeaderNameConnection); ok {
+			if strings.EqualFold(connection.ValueNoError(), "close") {
+				return
+			}
+		}
 	}
 }
@@ -0,0 +1,126 @@
+package rtsp
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/picast/media"
+)
+
+// serves the server on a loopback port until the test ends, and returns a
+// client of it
+func dialTestServer(t *testing.T, s *RTSPServer) *Client {
+	t.Helper()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.ServeConn(conn)
+		}
+	}()
+
+	t.Cleanup(func() {
+		ls.Close()
+		s.Interrupt(nil)
+	})
+
+	client, err := Dial("rtsp://"+ls.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestBadSetupLeavesNoSession(t *testing.T) {
+	manifest := media.NewFileManifest()
+	manifest.Put(media.Metadata{Title: "abc", UID: "abc", Path: "/nonexistent.ts"})
+
+	s := NewRTSPServer(nil, manifest)
+	client := dialTestServer(t, s)
+
+	transport := NewGenericHeaderLine(HeaderNameTransport, "RTP/AVP;unicast;client_port=5000-5001")
+
+	tests := []struct {
+		path    string
+		headers []HeaderLine
+		want    RTSPStatus
+	}{
+		{"/media/unknown", []HeaderLine{transport}, NotFound},
+		{"/media/abc/trackID=7", []HeaderLine{transport}, NotFound},
+		{"/elsewhere", []HeaderLine{transport}, MethodNotAllowed},
+		{"/media/abc", nil, BadRequest},
+		{"/media/abc", []HeaderLine{NewGenericHeaderLine(HeaderNameTransport, "RTP")}, BadRequest},
+	}
+
+	for _, tt := range tests {
+		req := NewRequest(SETUP, client.URL().JoinPath(tt.path))
+		for _, h := range tt.headers {
+			req.Headers.PutLine(h)
+		}
+
+		response, err := client.Do(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != tt.want {
+			t.Errorf("SETUP %s: got %v, want %v", tt.path, response.StatusCode, tt.want)
+		}
+	}
+
+	if n := len(s.sessions.all()); n != 0 {
+		t.Fatalf("%d sessions left after failed SETUPs", n)
+	}
+}
+
+func TestServeConnReapsSessions(t *testing.T) {
+	s := NewRTSPServer(nil, media.NewFileManifest())
+	s.SessionTimeout = time.Millisecond
+
+	session := NewSession()
+	s.sessions.add(session)
+
+	timedOut := make(chan SessionUID, 1)
+
+	// the callback may take the lock of the session that timed out
+	s.OnSessionTimeout = func(uid SessionUID) {
+		session.Lock()
+		defer session.Unlock()
+
+		timedOut <- uid
+	}
+
+	// a server that only serves connections accepted elsewhere
+	dialTestServer(t, s)
+
+	select {
+	case uid := <-timedOut:
+		if uid != session.UID {
+			t.Fatalf("session %v timed out, want %v", uid, session.UID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not time out")
+	}
+
+	if n := len(s.sessions.all()); n != 0 {
+		t.Fatalf("%d sessions left after timing out", n)
+	}
+}
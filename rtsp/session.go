@@ -2,8 +2,11 @@ package rtsp
 
 import (
 	"crypto/rand"
+	"maps"
 	"math/big"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rebeljah/picast/media"
@@ -26,22 +29,73 @@ type Session struct {
 	UID          SessionUID
 	CreatedAt    time.Time
 	ContentID    media.UID
-	Stream       *StreamState
+	Streams      map[TrackID]*StreamState // one stream per track set up
+
+	// set under the lock once the session is ended, e.g by timing out while a
+	// request in it waited for the lock, which then finds it gone
+	ended bool
+
+	lastSeen atomic.Int64 // unix nanoseconds of the last request in the session
 }
 
 func NewSession() *Session {
-	return &Session{
+	s := &Session{
 		UID:       newSessionUID(16),
 		CreatedAt: time.Now().UTC(),
-		Stream:    nil,
+		Streams:   make(map[TrackID]*StreamState),
 	}
+	s.Touch()
+	return s
+}
+
+// Touch marks the client as seen, which keeps the session alive.
+func (s *Session) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Ended reports whether the session was ended, e.g by timing out, while a
+// request in it waited for its lock. The caller must hold the session lock.
+func (s *Session) Ended() bool {
+	return s.ended
+}
+
+// LastSeen returns when the client last made a request in the session.
+func (s *Session) LastSeen() time.Time {
+	return time.Unix(0, s.lastSeen.Load())
 }
 
+// the aggregate state of the streams of the session: Playing (or Recording) if
+// any stream is, otherwise Ready if any stream is set up.
 func (s *Session) State() StreamStateName {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.Stream.StateNow
+	state := Init
+	for _, st := range s.Streams {
+		switch st.StateNow {
+		case Playing, Recording:
+			return st.StateNow
+		case Ready:
+			state = Ready
+		}
+	}
+	return state
+}
+
+// the tracks set up in the session, in track order
+func (s *Session) Tracks() []TrackID {
+	return slices.Sorted(maps.Keys(s.Streams))
+}
+
+// reports whether a stream of the session is interleaved on the connection. The
+// session must be locked.
+func (s *Session) interleavedOn(c *conn) bool {
+	for _, st := range s.Streams {
+		if st.conn == c {
+			return true
+		}
+	}
+	return false
 }
 
 type sessionManager struct {
@@ -70,6 +124,14 @@ func (s *sessionManager) get(uid SessionUID) (*Session, bool) {
 	return session, ok
 }
 
+// returns every session, in no particular order
+func (s *sessionManager) all() []*Session {
+	s.RLock()
+	defer s.RUnlock()
+
+	return slices.Collect(maps.Values(s.sessions))
+}
+
 func (s *sessionManager) delete(uid SessionUID) bool {
 	s.Lock()
 	defer s.Unlock()
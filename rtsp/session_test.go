@@ -0,0 +1,69 @@
+package rtsp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rebeljah/picast/rtsp"
+)
+
+// plays the media at the URL over the lower transport, and returns the client
+// and the ID of its session
+func playSession(t *testing.T, mediaURL string, lowerTransport string) (*rtsp.Client, rtsp.SessionUID) {
+	t.Helper()
+
+	client := playTest(t, mediaURL, lowerTransport)
+
+	response, err := client.GetParameter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _ := response.Headers.GetLine(rtsp.HeaderNameSession)
+	session, ok := header.(rtsp.SessionHeaderLine)
+	if !ok {
+		t.Fatalf("no session in the response: %v", header)
+	}
+
+	return client, session.ID
+}
+
+func TestConnectionCloseEndsInterleavedSessions(t *testing.T) {
+	metadata := newTestMedia(t, "abc", 30*time.Second)
+	mediaURL := "rtsp://" + serveTest(t, newTestServer(t, metadata)) + "/media/abc"
+
+	tcp, tcpSession := playSession(t, mediaURL, rtsp.LowerTransportTCP)
+	udp, udpSession := playSession(t, mediaURL, rtsp.LowerTransportUDP)
+
+	tcp.Close()
+	udp.Close()
+
+	client, err := rtsp.Dial(mediaURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	// a keepalive of the session, over another connection
+	keepalive := func(session rtsp.SessionUID) rtsp.RTSPStatus {
+		req := rtsp.NewRequest(rtsp.GET_PARAMETER, client.URL())
+		req.Headers.PutLine(rtsp.NewSessionHeaderLine(session, 0))
+
+		response, err := client.Do(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode
+	}
+
+	// the streams interleaved on the connection can't be sent without it
+	eventually(t, 5*time.Second, func() bool {
+		return keepalive(tcpSession) == rtsp.SessionNotFound
+	}, "the session over TCP outlived its connection")
+
+	// while the session over UDP is left to time out, and can be kept alive
+	// from elsewhere
+	if status := keepalive(udpSession); status != rtsp.OK {
+		t.Fatalf("keepalive of the session over UDP: got %v, want %v", status, rtsp.OK)
+	}
+}
@@ -20,6 +20,14 @@ func newStreamUID() StreamUID {
 	return StreamUID(newSessionUID(8))
 }
 
+// identifies a track of a media by the index of its stream in the media
+// structure, as in the `trackID=N` control URL of the track.
+type TrackID int
+
+// the track of a stream of the whole media, with every track multiplexed, which
+// is set up on the aggregate control URL of the media.
+const WholeMedia TrackID = -1
+
 // RTSP server state transitions based on RFC2326.
 var streamStateTransitions = map[StreamStateName]map[RTSPMethod]StreamStateName{
 	Init: {
@@ -56,6 +64,10 @@ func (s StreamStateName) After(m RTSPMethod) StreamStateName {
 type StreamState struct {
 	StateNow  StreamStateName
 	StreamUID StreamUID
+
+	// the RTSP connection that the stream is interleaved on, which tears it
+	// down when it closes, or nil for a stream over UDP
+	conn *conn
 }
 
 func NewStreamState() *StreamState {
@@ -73,3 +85,15 @@ func (s *StreamState) OnTeardown() {
 func (s *StreamState) OnSetup() {
 	s.StateNow = s.StateNow.After(SETUP)
 }
+
+func (s *StreamState) OnPlay() {
+	s.StateNow = s.StateNow.After(PLAY)
+}
+
+func (s *StreamState) OnPause() {
+	s.StateNow = s.StateNow.After(PAUSE)
+}
+
+func (s *StreamState) OnRecord() {
+	s.StateNow = s.StateNow.After(RECORD)
+}
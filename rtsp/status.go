@@ -73,12 +73,12 @@ var statusText = map[RTSPStatus]string{
 	RequestEntityTooLarge:         "Request Entity Too Large",
 	RequestURITooLong:             "Request-URI Too Long",
 	UnsupportedMediaType:          "Unsupported Media Type",
-	InvalidParameter:              "Invalid Parameter",
+	InvalidParameter:              "Parameter Not Understood",
 	IllegalConferenceIdentifier:   "Illegal Conference Identifier",
 	NotEnoughBandwidth:            "Not Enough Bandwidth",
 	SessionNotFound:               "Session Not Found",
 	MethodNotValidInThisState:     "Method Not Valid in This State",
-	HeaderFieldNotValid:           "Header Field Not Valid",
+	HeaderFieldNotValid:           "Header Field Not Valid for Resource",
 	InvalidRange:                  "Invalid Range",
 	ParameterIsReadOnly:           "Parameter Is Read-Only",
 	AggregateOperationNotAllowed:  "Aggregate Operation Not Allowed",
@@ -0,0 +1,192 @@
+package rtsp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// the port of the rtsps scheme, RTSP over TLS
+const DefaultRTSPSPort = 322
+
+// the validity of a generated self-signed certificate
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+var ErrNoTLSListener = errors.New("no TLS listener")
+
+// ListenAndServeTLS serves RTSP over TLS, for the rtsps scheme, with the
+// certificate and key of the PEM files. If neither file exists, a self-signed
+// certificate is generated and saved to them, to be used from then on, while
+// if only one exists it is an ErrIncompleteCertificate. The files are read
+// again on ReloadCertificates.
+//
+// Only the RTSP connection is encrypted, so clients should choose interleaved
+// transports for the media to be encrypted too.
+func (s *RTSPServer) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	log.Println("starting RTSPS server on " + addr)
+
+	if err := ensureCertificate(certFile, keyFile); err != nil {
+		return err
+	}
+
+	certificates := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := certificates.reload(); err != nil {
+		return err
+	}
+
+	s.listenerLock.Lock()
+	s.certificates = certificates
+	s.listenerLock.Unlock()
+
+	ls, err := tls.Listen("tcp", addr, &tls.Config{
+		GetCertificate: certificates.get,
+		MinVersion:     tls.VersionTLS12,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return s.serve(ls)
+}
+
+// ReloadCertificates reads the certificate and key of the TLS listener again,
+// e.g once they are renewed. Connections made from then on use the new
+// certificate, while those already made are unaffected. If the files can't be
+// loaded, the certificate in use is kept.
+func (s *RTSPServer) ReloadCertificates() error {
+	s.listenerLock.Lock()
+	certificates := s.certificates
+	s.listenerLock.Unlock()
+
+	if certificates == nil {
+		return ErrNoTLSListener
+	}
+
+	return certificates.reload()
+}
+
+// serves the certificate last loaded from its files
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func (c *certificateReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.certificate = &certificate
+	return nil
+}
+
+func (c *certificateReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.certificate, nil
+}
+
+var ErrIncompleteCertificate = errors.New("TLS certificate without its key, or key without its certificate")
+
+// generates a self-signed certificate into the files if neither exists. If
+// only one of them exists, the pair is incomplete and nothing is generated,
+// so that a certificate or key that was put in place is not overwritten.
+func ensureCertificate(certFile, keyFile string) error {
+	var missing []string
+	for _, name := range []string{certFile, keyFile} {
+		_, err := os.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, name)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%w: %s does not exist", ErrIncompleteCertificate, missing[0])
+	}
+
+	log.Printf("no TLS certificate found at: %v, generating a self-signed one...", certFile)
+
+	certPEM, keyPEM, err := selfSignedCertificate()
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, certPEM, 0644)
+}
+
+// returns the PEM of a certificate for this host, and of its key
+func selfSignedCertificate() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
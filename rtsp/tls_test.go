@@ -0,0 +1,65 @@
+package rtsp
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	// neither file exists: a certificate is generated
+	if err := ensureCertificate(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatalf("generated certificate: %v", err)
+	}
+
+	generated, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both exist: they are kept
+	if err := ensureCertificate(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept, _ := os.ReadFile(certFile); string(kept) != string(generated) {
+		t.Fatal("the certificate was generated again")
+	}
+
+	// one exists: it is an error, and nothing is generated
+	for _, missing := range []string{keyFile, certFile} {
+		present := keyFile
+		if missing == keyFile {
+			present = certFile
+		}
+
+		if err := os.Remove(missing); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ensureCertificate(certFile, keyFile); !errors.Is(err, ErrIncompleteCertificate) {
+			t.Fatalf("without %s: got %v, want ErrIncompleteCertificate", filepath.Base(missing), err)
+		}
+
+		if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s was generated alongside %s", filepath.Base(missing), filepath.Base(present))
+		}
+
+		// the pair again, for the other case
+		if err := os.Remove(present); err != nil {
+			t.Fatal(err)
+		}
+		if err := ensureCertificate(certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -32,7 +32,7 @@ func PopulateStructFromAttributes(v any, attributes []sdp.Attribute) error {
 			sdpTag := field.Tag.Get("sdp")
 
 			// Skip fields without an sdp tag
-			if sdpTag == "" {
+			if sdpTag == "" || sdpTag == "-" {
 				continue
 			}
 
@@ -74,17 +74,24 @@ func PopulateStructFromAttributes(v any, attributes []sdp.Attribute) error {
 //     format the value.
 //   - If a struct field has an sdp tag, but the field value is
 //     not Stringable, this function will return an error.
-func NewAttributesFromStruct(v *any) ([]sdp.Attribute, error) {
+//   - Fields tagged `sdp:"-"` are skipped.
+//   - `v` may be a struct or a pointer to a struct.
+func NewAttributesFromStruct(v any) ([]sdp.Attribute, error) {
 	var attributes []sdp.Attribute
 
-	anyValue := reflect.ValueOf(v).Elem()
-	typ := reflect.TypeOf(v).Elem()
+	anyValue := reflect.Indirect(reflect.ValueOf(v))
+
+	if anyValue.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot make attributes from kind %s", anyValue.Kind())
+	}
+
+	typ := anyValue.Type()
 
 	for i := range typ.NumField() {
 		sdpKey := typ.Field(i).Tag.Get("sdp")
 
 		// No sdp key is defined
-		if sdpKey == "" {
+		if sdpKey == "" || sdpKey == "-" {
 			continue
 		}
 
@@ -3,6 +3,9 @@ package bpipes
 import (
 	"context"
 	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -69,24 +72,150 @@ func NewPipeLineThrottler(ratePerSecond rate.Limit, burst uint16) *ThrottlerStag
 }
 
 type PauserStage struct {
-	*ThrottlerStage
+	stageBase
+	lock    sync.Mutex
+	resumed chan struct{} // closed while the stage is not paused
+}
+
+func (p *PauserStage) Effect(ctx context.Context, _ any) error {
+	p.lock.Lock()
+	resumed := p.resumed
+	p.lock.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return errors.Join(ctx.Err(), context.Cause(ctx))
+	}
 }
 
 func (p *PauserStage) SetPaused(isPaused bool) {
-	if isPaused {
-		p.SetLimit(0)
-	} else {
-		p.SetLimit(rate.Inf)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.resumed: // currently resumed
+		if isPaused {
+			p.resumed = make(chan struct{})
+		}
+	default: // currently paused
+		if !isPaused {
+			close(p.resumed)
+		}
 	}
 }
 
-// A pipeline pauser is a throttler where the rate can be toggled
-// between 0 and inf by the set paused function.
-// The default state is paused (a rate of 0).
+func (p *PauserStage) IsPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// A pipeline pauser is a gate that can be toggled open and closed by the set
+// paused function. While paused, data is held at this stage and the pipeline
+// stalls behind it.
+// The default state is paused.
 func NewPauserStage() *PauserStage {
 	return &PauserStage{
-		ThrottlerStage: NewPipeLineThrottler(0, 1),
+		resumed: make(chan struct{}),
+	}
+}
+
+// the furthest behind or ahead of schedule data may be before the pacer gives
+// up on the schedule, and anchors a new one at that data.
+const (
+	pacerMaxLate = time.Second
+	pacerMaxLead = 2 * time.Second
+)
+
+type PacerStage struct {
+	stageBase
+	timeOf   func(any) (time.Duration, bool)
+	reanchor atomic.Bool
+	rate     atomic.Uint64 // math.Float64bits of the media time per wall clock time
+
+	// the wall clock
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	// only accessed by the Effect
+	anchored    bool
+	wallAnchor  time.Time
+	mediaAnchor time.Duration
+	anchorRate  float64
+}
+
+func (p *PacerStage) Effect(ctx context.Context, data any) error {
+	t, discontinuous := p.timeOf(data)
+	now := p.now()
+
+	// a reanchor asked for ahead of the first data is taken by its anchor
+	if reanchor := p.reanchor.Swap(false); !p.anchored || discontinuous || reanchor {
+		p.anchor(now, t)
+		return nil
+	}
+
+	// measure every deadline from the anchor so that error does not accumulate
+	// over long streams.
+	wait := p.wallAnchor.Add(time.Duration(float64(t-p.mediaAnchor) / p.anchorRate)).Sub(now)
+
+	if wait < -pacerMaxLate || wait > pacerMaxLead {
+		p.anchor(now, t)
+		return nil
+	}
+
+	if wait <= 0 {
+		return nil // catching up
+	}
+
+	select {
+	case <-p.after(wait):
+		return nil
+	case <-ctx.Done():
+		return errors.Join(ctx.Err(), context.Cause(ctx))
+	}
+}
+
+func (p *PacerStage) anchor(now time.Time, t time.Duration) {
+	p.anchored = true
+	p.wallAnchor = now
+	p.mediaAnchor = t
+	p.anchorRate = math.Float64frombits(p.rate.Load())
+}
+
+// Reanchor releases the next data immediately and schedules the data after it
+// from there, e.g after the pipeline was stalled on purpose.
+func (p *PacerStage) Reanchor() {
+	p.reanchor.Store(true)
+}
+
+// SetRate paces data faster (rate > 1) or slower (rate < 1) than real time,
+// from the next data on. The rate must be positive.
+func (p *PacerStage) SetRate(rate float64) {
+	p.rate.Store(math.Float64bits(rate))
+	p.reanchor.Store(true)
+}
+
+// A pipeline pacer releases data in real time, at the wall clock time of its
+// position on a media timeline, given by timeOf. The first data is released
+// immediately. timeOf also reports if the timeline is discontinuous at the data
+// (e.g. it jumped after a seek), and the schedule is then anchored anew at that
+// data. Data that falls too far behind or ahead of schedule also restarts it.
+func NewPacerStage(timeOf func(data any) (t time.Duration, discontinuous bool)) *PacerStage {
+	p := &PacerStage{
+		timeOf: timeOf,
+		now:    time.Now,
+		after:  time.After,
 	}
+	p.rate.Store(math.Float64bits(1))
+	return p
 }
 
 type SplitStage struct {
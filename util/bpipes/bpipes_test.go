@@ -0,0 +1,254 @@
+package bpipes
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// a wall clock that only moves when the pacer waits on it, or when the test
+// moves it
+type fakeClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+
+	fired := make(chan time.Time, 1)
+	fired <- c.now
+	return fired
+}
+
+type pacedData struct {
+	t             time.Duration
+	discontinuous bool
+}
+
+func newTestPacer() (*PacerStage, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	p := NewPacerStage(func(data any) (time.Duration, bool) {
+		d := data.(pacedData)
+		return d.t, d.discontinuous
+	})
+	p.now, p.after = clock.Now, clock.After
+
+	return p, clock
+}
+
+func TestPacerStage(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name string
+		data []pacedData
+		rate float64
+		want []time.Duration // the waits of the pacer
+	}{
+		{
+			name: "real time",
+			data: []pacedData{{t: 0}, {t: 100 * ms}, {t: 200 * ms}, {t: 250 * ms}},
+			want: []time.Duration{100 * ms, 100 * ms, 50 * ms},
+		},
+		{
+			name: "from the first data",
+			data: []pacedData{{t: 5 * time.Second}, {t: 5*time.Second + 40*ms}},
+			want: []time.Duration{40 * ms},
+		},
+		{
+			name: "twice as fast",
+			data: []pacedData{{t: 0}, {t: 100 * ms}, {t: 200 * ms}},
+			rate: 2,
+			want: []time.Duration{50 * ms, 50 * ms},
+		},
+		{
+			name: "discontinuity",
+			data: []pacedData{{t: 0}, {t: 100 * ms}, {t: 10 * time.Second, discontinuous: true}, {t: 10*time.Second + 100*ms}},
+			want: []time.Duration{100 * ms, 100 * ms},
+		},
+		{
+			name: "too far ahead",
+			data: []pacedData{{t: 0}, {t: 3 * time.Second}, {t: 3*time.Second + 100*ms}},
+			want: []time.Duration{100 * ms},
+		},
+		{
+			name: "at once",
+			data: []pacedData{{t: 0}, {t: 0}, {t: 0}},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, clock := newTestPacer()
+
+			if tt.rate != 0 {
+				p.SetRate(tt.rate)
+			}
+
+			for _, data := range tt.data {
+				if err := p.Effect(context.Background(), data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !slices.Equal(clock.waits, tt.want) {
+				t.Fatalf("waited %v, want %v", clock.waits, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacerStageFallsBehind(t *testing.T) {
+	ms := time.Millisecond
+	p, clock := newTestPacer()
+
+	for _, data := range []pacedData{{t: 0}, {t: 100 * ms}} {
+		if err := p.Effect(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// held up a little: the data that is late is released to catch up
+	clock.now = clock.now.Add(500 * ms)
+
+	for _, data := range []pacedData{{t: 200 * ms}, {t: 300 * ms}, {t: 700 * ms}} {
+		if err := p.Effect(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []time.Duration{100 * ms, 100 * ms}; !slices.Equal(clock.waits, want) {
+		t.Fatalf("waited %v, want %v", clock.waits, want)
+	}
+
+	// held up too long: the schedule begins again at the next data
+	clock.now = clock.now.Add(5 * time.Second)
+	clock.waits = nil
+
+	for _, data := range []pacedData{{t: 800 * ms}, {t: 900 * ms}} {
+		if err := p.Effect(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []time.Duration{100 * ms}; !slices.Equal(clock.waits, want) {
+		t.Fatalf("waited %v after falling behind, want %v", clock.waits, want)
+	}
+}
+
+func TestPacerStageCancel(t *testing.T) {
+	p, _ := newTestPacer()
+	p.after = func(time.Duration) <-chan time.Time { return nil } // never
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := p.Effect(ctx, pacedData{t: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	if err := p.Effect(ctx, pacedData{t: time.Second}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+// receives n values from the channel, or fails once none arrive for a while
+func receive(t *testing.T, c <-chan int, n int) []int {
+	t.Helper()
+
+	var got []int
+	for range n {
+		select {
+		case v := <-c:
+			got = append(got, v)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, then nothing", got)
+		}
+	}
+
+	return got
+}
+
+// fails if a value arrives on the channel soon
+func expectNothing(t *testing.T, c <-chan int) {
+	t.Helper()
+
+	select {
+	case v := <-c:
+		t.Fatalf("received %d while paused", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPauserStage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	head := make(chan int)
+	pauser := NewPauserStage()
+	tail, _ := NewPipeline(ctx, head, pauser)
+
+	go func() {
+		for i := range 100 {
+			select {
+			case head <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if !pauser.IsPaused() {
+		t.Fatal("not paused at first")
+	}
+
+	expectNothing(t, tail)
+
+	var got []int
+
+	// resumed and paused again a few times, in bursts
+	for range 4 {
+		pauser.SetPaused(false)
+		pauser.SetPaused(false) // resuming twice is resuming
+
+		got = append(got, receive(t, tail, 10)...)
+
+		pauser.SetPaused(true)
+		pauser.SetPaused(true)
+
+		// what was let through before the pause is still delivered
+		for drained := false; !drained; {
+			select {
+			case v := <-tail:
+				got = append(got, v)
+			case <-time.After(50 * time.Millisecond):
+				drained = true
+			}
+		}
+
+		if !pauser.IsPaused() {
+			t.Fatal("not paused")
+		}
+	}
+
+	pauser.SetPaused(false)
+	got = append(got, receive(t, tail, 100-len(got))...)
+
+	// nothing is dropped or reordered
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("received %v, want 0 to 99 in order", got)
+		}
+	}
+}